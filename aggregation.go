@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// aggregation describes an aggregation function supported by experimental_func.
+type aggregation struct {
+	Name string
+	// Flux is the Flux call used for un-windowed aggregations.
+	Flux string
+	// WindowFn is the fn argument passed to aggregateWindow for windowed aggregations.
+	WindowFn string
+	// Selector is true for functions which select existing rows and keep their
+	// timestamp. Other functions drop the _time column, so un-windowed results are
+	// timestamped with the start of the query range instead. Windowed results are
+	// always timestamped with the end of their window.
+	Selector bool
+	// Quantile is the quantile computed by median and pNN functions.
+	Quantile float64
+	// Multiple is true for functions which may return multiple records for each
+	// series or window.
+	Multiple bool
+}
+
+var aggregations = map[string]*aggregation{
+	"mean":     {Name: "mean", Flux: "mean()", WindowFn: "mean"},
+	"median":   {Name: "median", Flux: "median()", WindowFn: "median", Quantile: 0.5},
+	"sum":      {Name: "sum", Flux: "sum()", WindowFn: "sum"},
+	"count":    {Name: "count", Flux: "count()", WindowFn: "count"},
+	"stddev":   {Name: "stddev", Flux: "stddev()", WindowFn: "stddev"},
+	"spread":   {Name: "spread", Flux: "spread()", WindowFn: "spread"},
+	"distinct": {Name: "distinct", Flux: "distinct()", WindowFn: "distinct", Multiple: true},
+	"min":      {Name: "min", Flux: "min()", WindowFn: "min", Selector: true},
+	"max":      {Name: "max", Flux: "max()", WindowFn: "max", Selector: true},
+	"first":    {Name: "first", Flux: "first()", WindowFn: "first", Selector: true},
+	"last":     {Name: "last", Flux: "last()", WindowFn: "last", Selector: true},
+}
+
+// quantileRE matches quantile aggregations like p50, p95 or p99.9.
+var quantileRE = regexp.MustCompile(`^p(100|[0-9]{1,2}(\.[0-9]+)?)$`)
+
+// lookupAggregation returns the aggregation for a function name. Besides the
+// registered functions, pNN selects the NN-th percentile.
+func lookupAggregation(name string) (*aggregation, error) {
+	if agg, ok := aggregations[name]; ok {
+		return agg, nil
+	}
+
+	if m := quantileRE.FindStringSubmatch(name); m != nil {
+		q := percentToDecimal(m[1])
+		quantile, _ := strconv.ParseFloat(q, 64)
+		return &aggregation{
+			Name:     name,
+			Flux:     fmt.Sprintf("quantile(q: %s)", q),
+			WindowFn: fmt.Sprintf("(column, tables=<-) => tables |> quantile(q: %s, column: column)", q),
+			Quantile: quantile,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported function %q", name)
+}
+
+// percentToDecimal converts a percentage like 99.9 to a Flux float literal like
+// 0.999. This is done on the digits directly to avoid floating point rounding.
+func percentToDecimal(p string) string {
+	if p == "100" {
+		return "1.0"
+	}
+	whole, frac, _ := strings.Cut(p, ".")
+	if len(whole) < 2 {
+		whole = "0" + whole
+	}
+	s := strings.TrimRight("0."+whole+frac, "0")
+	if s == "0." {
+		return "0.0"
+	}
+	return s
+}
+
+// fluxDurationRE matches Flux duration literals like 10m or 1h30m.
+var fluxDurationRE = regexp.MustCompile(`^([0-9]+(ns|us|µs|ms|s|m|h|d|w|mo|y))+$`)
+
+// validateAggregation checks the experimental_func, experimental_window and group_by fields of a query.
+func validateAggregation(query *Query) error {
+	if query.Window != nil && len(query.Func) == 0 {
+		return fmt.Errorf("window cannot be used without aggregation function")
+	}
+	if query.GroupBy != nil && len(query.Func) == 0 {
+		return fmt.Errorf("group_by cannot be used without aggregation function")
+	}
+	for _, k := range query.GroupBy {
+		if !metaRE.MatchString(k) {
+			return fmt.Errorf("invalid group_by key: %q", k)
+		}
+	}
+	if query.Window != nil && !fluxDurationRE.MatchString(*query.Window) {
+		return fmt.Errorf("invalid window %q", *query.Window)
+	}
+	seen := make(map[string]bool)
+	for _, fn := range query.Func {
+		if _, err := lookupAggregation(fn); err != nil {
+			return err
+		}
+		if seen[fn] {
+			return fmt.Errorf("duplicate function %q", fn)
+		}
+		seen[fn] = true
+	}
+	return nil
+}
+
+// useStartTimestamp reports whether results of the aggregation fn in a query are
+// timestamped with the start of the query range, which is the case for
+// un-windowed aggregations that aren't selectors.
+func useStartTimestamp(query *Query, fn string) bool {
+	if fn == "" || query.Window != nil {
+		return false
+	}
+	agg, err := lookupAggregation(fn)
+	return err == nil && !agg.Selector
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryCoalescedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "query_coalesced_total",
+		Help:      "The total number of queries which shared the results of an identical in-flight query.",
+	})
+	querySubscribersDroppedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "query_subscribers_dropped_total",
+		Help:      "The total number of queries dropped from shared results for falling too far behind.",
+	})
+)
+
+var errSubscriberTooSlow = errors.New("client fell too far behind shared query results")
+
+// CoalescingBackend wraps a backend so identical concurrent queries share a
+// single query to the backend. Records are fanned out to each query through its
+// own buffer, so a slow client doesn't hold up the others. While several queries
+// share the results, one which falls too far behind is dropped with an error.
+// The last query left is never dropped. Instead, reading from the backend waits
+// until it catches up, as it would without coalescing.
+//
+// Queries can only join an in-flight query until its first record is read, as
+// the records before that aren't kept.
+type CoalescingBackend struct {
+	backend   Backend
+	maxBuffer int
+
+	mu       sync.Mutex
+	inflight map[string]*sharedQuery
+}
+
+// NewCoalescingBackend creates a CoalescingBackend which buffers at most
+// maxBuffer records for each query.
+func NewCoalescingBackend(backend Backend, maxBuffer int) *CoalescingBackend {
+	return &CoalescingBackend{
+		backend:   backend,
+		maxBuffer: maxBuffer,
+		inflight:  make(map[string]*sharedQuery),
+	}
+}
+
+// Query joins an identical in-flight query, if possible, or starts a new one.
+func (c *CoalescingBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	key := queryKey(query)
+	sub := &subscriber{ctx: ctx, notify: make(chan struct{}, 1), space: make(chan struct{}, 1)}
+
+	c.mu.Lock()
+	shared, ok := c.inflight[key]
+	if ok && shared.subscribe(sub) {
+		queryCoalescedTotal.Inc()
+	} else {
+		shared = c.newSharedQuery(key)
+		shared.subscribe(sub)
+		go shared.run(c.backend, query)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-shared.ready:
+	case <-ctx.Done():
+		shared.unsubscribe(sub)
+		return nil, ctx.Err()
+	}
+
+	if shared.err != nil {
+		return nil, shared.err
+	}
+	return &subscriberResults{shared: shared, sub: sub}, nil
+}
+
+func (c *CoalescingBackend) newSharedQuery(key string) *sharedQuery {
+	// the backend query isn't tied to any request, as others may join it. it is
+	// cancelled once every query has left.
+	ctx, cancel := context.WithCancel(context.Background())
+	shared := &sharedQuery{
+		coalescer: c,
+		key:       key,
+		ctx:       ctx,
+		cancel:    cancel,
+		ready:     make(chan struct{}),
+		subs:      make(map[*subscriber]bool),
+	}
+	c.inflight[key] = shared
+	return shared
+}
+
+// forget stops new queries from joining shared.
+func (c *CoalescingBackend) forget(shared *sharedQuery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight[shared.key] == shared {
+		delete(c.inflight, shared.key)
+	}
+}
+
+// sharedQuery reads the results of a backend query and fans them out to subscribers.
+type sharedQuery struct {
+	coalescer *CoalescingBackend
+	key       string
+	ctx       context.Context
+	cancel    context.CancelFunc
+	// ready is closed once the backend query has started. err holds any error.
+	ready chan struct{}
+	err   error
+
+	mu sync.Mutex
+	// subs is nil once the shared query has finished
+	subs      map[*subscriber]bool
+	cancelled bool
+}
+
+func (s *sharedQuery) run(backend Backend, query *Query) {
+	defer s.cancel()
+
+	results, err := backend.Query(s.ctx, query)
+	if err != nil {
+		s.coalescer.forget(s)
+		s.err = err
+		close(s.ready)
+		return
+	}
+	defer results.Close()
+	close(s.ready)
+
+	first := true
+	for results.Next() {
+		if first {
+			s.coalescer.forget(s)
+			first = false
+		}
+		rec := results.Record()
+		subs := s.subscribers()
+		for _, sub := range subs {
+			// only drop slow queries while others are waiting on them
+			if !sub.push(s.ctx, rec, s.coalescer.maxBuffer, len(subs) == 1) {
+				s.remove(sub)
+			}
+		}
+	}
+	if first {
+		s.coalescer.forget(s)
+	}
+
+	err = results.Err()
+	s.mu.Lock()
+	for sub := range s.subs {
+		sub.finish(err)
+	}
+	s.subs = nil
+	s.mu.Unlock()
+}
+
+// subscribers returns the current subscribers.
+func (s *sharedQuery) subscribers() []*subscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := make([]*subscriber, 0, len(s.subs))
+	for sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// subscribe adds a subscriber. It returns false if the shared query has
+// already finished or been cancelled.
+func (s *sharedQuery) subscribe(sub *subscriber) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs == nil || s.cancelled {
+		return false
+	}
+	s.subs[sub] = true
+	return true
+}
+
+// unsubscribe removes a subscriber which has left.
+func (s *sharedQuery) unsubscribe(sub *subscriber) {
+	sub.close()
+	s.remove(sub)
+}
+
+// remove removes a subscriber and cancels the backend query once none are left.
+func (s *sharedQuery) remove(sub *subscriber) {
+	s.mu.Lock()
+	delete(s.subs, sub)
+	cancel := s.subs != nil && len(s.subs) == 0 && !s.cancelled
+	if cancel {
+		s.cancelled = true
+	}
+	s.mu.Unlock()
+
+	if cancel {
+		s.coalescer.forget(s)
+		s.cancel()
+	}
+}
+
+// subscriber buffers the records of a shared query for a single query.
+type subscriber struct {
+	ctx context.Context
+	// notify is signalled when records are added. space is signalled when
+	// records are read or the subscriber is closed.
+	notify chan struct{}
+	space  chan struct{}
+
+	mu     sync.Mutex
+	buffer []*Record
+	done   bool
+	closed bool
+	err    error
+}
+
+// push adds a record to the buffer. If the buffer is full, push waits for room
+// when wait is true and otherwise finishes the subscriber with an error. It
+// returns false if the record wasn't added.
+func (sub *subscriber) push(ctx context.Context, rec *Record, maxBuffer int, wait bool) bool {
+	sub.mu.Lock()
+	for maxBuffer > 0 && len(sub.buffer) >= maxBuffer && !sub.closed {
+		sub.mu.Unlock()
+		if !wait {
+			querySubscribersDroppedTotal.Inc()
+			sub.finish(errSubscriberTooSlow)
+			return false
+		}
+		select {
+		case <-sub.space:
+		case <-sub.ctx.Done():
+			return false
+		case <-ctx.Done():
+			return false
+		}
+		sub.mu.Lock()
+	}
+	if sub.closed {
+		sub.mu.Unlock()
+		return false
+	}
+	sub.buffer = append(sub.buffer, rec)
+	sub.mu.Unlock()
+	signal(sub.notify)
+	return true
+}
+
+// close marks that the subscriber has left, so records are no longer added.
+func (sub *subscriber) close() {
+	sub.mu.Lock()
+	sub.closed = true
+	sub.buffer = nil
+	sub.mu.Unlock()
+	signal(sub.space)
+}
+
+// finish marks the end of the records with an optional error.
+func (sub *subscriber) finish(err error) {
+	sub.mu.Lock()
+	sub.done = true
+	sub.err = err
+	sub.mu.Unlock()
+	signal(sub.notify)
+}
+
+// signal wakes a waiter on ch without blocking.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// subscriberResults provides the records of a shared query through Results.
+type subscriberResults struct {
+	shared *sharedQuery
+	sub    *subscriber
+	record *Record
+	err    error
+}
+
+func (r *subscriberResults) Err() error {
+	return r.err
+}
+
+func (r *subscriberResults) Close() error {
+	r.shared.unsubscribe(r.sub)
+	return nil
+}
+
+func (r *subscriberResults) Record() *Record {
+	return r.record
+}
+
+func (r *subscriberResults) Next() bool {
+	sub := r.sub
+	for {
+		sub.mu.Lock()
+		if len(sub.buffer) > 0 {
+			r.record = sub.buffer[0]
+			sub.buffer[0] = nil
+			sub.buffer = sub.buffer[1:]
+			sub.mu.Unlock()
+			signal(sub.space)
+			return true
+		}
+		if sub.done {
+			r.err = sub.err
+			sub.mu.Unlock()
+			return false
+		}
+		sub.mu.Unlock()
+
+		select {
+		case <-sub.notify:
+		case <-sub.ctx.Done():
+			r.err = sub.ctx.Err()
+			return false
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// gatedBackend provides records which are each released by a send on step.
+type gatedBackend struct {
+	records []*Record
+	step    chan struct{}
+	queries int
+	ctx     context.Context
+}
+
+func (backend *gatedBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	backend.queries++
+	backend.ctx = ctx
+	return &gatedResults{records: backend.records, step: backend.step, ctx: ctx}, nil
+}
+
+type gatedResults struct {
+	recordResults
+	records []*Record
+	step    chan struct{}
+	ctx     context.Context
+	err     error
+}
+
+func (r *gatedResults) Err() error {
+	return r.err
+}
+
+func (r *gatedResults) Next() bool {
+	if len(r.records) == 0 {
+		return false
+	}
+	select {
+	case <-r.step:
+	case <-r.ctx.Done():
+		r.err = r.ctx.Err()
+		return false
+	}
+	r.record = r.records[0]
+	r.records = r.records[1:]
+	return true
+}
+
+func gatedRecords(n int) []*Record {
+	records := make([]*Record, n)
+	for i := range records {
+		records[i] = &Record{Name: "env.temperature", Value: float64(i)}
+	}
+	return records
+}
+
+func TestCoalescingBackend(t *testing.T) {
+	backend := &gatedBackend{records: gatedRecords(3), step: make(chan struct{})}
+	c := NewCoalescingBackend(backend, 0)
+	query := &Query{Start: "-1h", Filter: map[string]string{"vsn": "W001"}}
+
+	r1 := mustQuery(t, c, query)
+	r2 := mustQuery(t, c, &Query{Start: "-1h", Filter: map[string]string{"vsn": "W001"}, Format: "csv"})
+	r3 := mustQuery(t, c, &Query{Start: "-1h", Filter: map[string]string{"vsn": "W002"}})
+	close(backend.step)
+
+	for _, results := range []Results{r1, r2, r3} {
+		if records := readAllRecords(t, results); len(records) != 3 {
+			t.Fatalf("expected 3 records. got %d", len(records))
+		}
+	}
+	if backend.queries != 2 {
+		t.Fatalf("expected 2 backend queries. got %d", backend.queries)
+	}
+
+	// finished queries aren't joined
+	readAllRecords(t, mustQuery(t, c, query))
+	if backend.queries != 3 {
+		t.Fatalf("expected 3 backend queries. got %d", backend.queries)
+	}
+}
+
+func TestCoalescingBackendSlowSubscriber(t *testing.T) {
+	backend := &gatedBackend{records: gatedRecords(5), step: make(chan struct{})}
+	c := NewCoalescingBackend(backend, 2)
+	query := &Query{Start: "-1h"}
+
+	fast := mustQuery(t, c, query)
+	slow := mustQuery(t, c, query)
+
+	for i := 0; i < 5; i++ {
+		backend.step <- struct{}{}
+		if !fast.Next() {
+			t.Fatalf("expected record %d", i)
+		}
+	}
+	if fast.Next() || fast.Err() != nil {
+		t.Fatalf("expected fast query to complete")
+	}
+
+	n := 0
+	for slow.Next() {
+		n++
+	}
+	if n != 2 || slow.Err() != errSubscriberTooSlow {
+		t.Fatalf("expected slow query to fail after 2 records. got %d records and error %v", n, slow.Err())
+	}
+}
+
+func TestCoalescingBackendSingleSlowSubscriber(t *testing.T) {
+	step := make(chan struct{})
+	close(step)
+	backend := &gatedBackend{records: gatedRecords(10), step: step}
+	c := NewCoalescingBackend(backend, 2)
+
+	results := mustQuery(t, c, &Query{Start: "-1h"})
+
+	// give the shared query time to read ahead of the only query
+	time.Sleep(20 * time.Millisecond)
+	sub := results.(*subscriberResults).sub
+	sub.mu.Lock()
+	buffered := len(sub.buffer)
+	sub.mu.Unlock()
+	if buffered > 2 {
+		t.Fatalf("expected at most 2 buffered records. got %d", buffered)
+	}
+
+	if records := readAllRecords(t, results); len(records) != 10 {
+		t.Fatalf("expected 10 records. got %d", len(records))
+	}
+}
+
+func TestCoalescingBackendCancel(t *testing.T) {
+	backend := &gatedBackend{records: gatedRecords(1), step: make(chan struct{})}
+	c := NewCoalescingBackend(backend, 0)
+	query := &Query{Start: "-1h"}
+
+	r1 := mustQuery(t, c, query)
+	r2 := mustQuery(t, c, query)
+
+	r1.Close()
+	if backend.ctx.Err() != nil {
+		t.Fatalf("expected backend query to continue while a query is left")
+	}
+	r2.Close()
+	if backend.ctx.Err() == nil {
+		t.Fatalf("expected backend query to be cancelled")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var responseCompressionRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricNamespace,
+	Name:      "response_compression_ratio",
+	Help:      "A histogram of the ratio of uncompressed to compressed response size.",
+	Buckets:   []float64{1, 2, 4, 6, 8, 10, 15, 20, 30, 50},
+}, []string{"encoding"})
+
+// compressionFlushInterval is how often compressed output is flushed to the client.
+const compressionFlushInterval = time.Second
+
+// zstdWindowSize bounds the memory used by each zstd response. The default
+// window, and an encoder per CPU, is far more than a single response needs.
+const zstdWindowSize = 1 << 20
+
+// compressor is implemented by the gzip and zstd writers.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// responseEncodings holds the supported content encodings by preference.
+var responseEncodings = []struct {
+	Name      string
+	NewWriter func(io.Writer) (compressor, error)
+}{
+	{"zstd", func(w io.Writer) (compressor, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindowSize))
+	}},
+	{"gzip", func(w io.Writer) (compressor, error) { return gzip.NewWriterLevel(w, gzip.DefaultCompression) }},
+}
+
+// negotiateEncoding picks the content encoding for a response from the
+// Accept-Encoding header. It returns an empty string for uncompressed responses.
+// Formats which are already compressed are never encoded. A wildcard matches
+// any encoding not listed, so "*, gzip;q=0" excludes gzip.
+func negotiateEncoding(r *http.Request, format *outputFormat) string {
+	if format.Compressed {
+		return ""
+	}
+	// Accept-Encoding uses the same syntax for preferences as Accept
+	accepted := parseAcceptHeader(r.Header.Get("Accept-Encoding"))
+
+	listed := make(map[string]bool)
+	for _, accept := range accepted {
+		listed[accept.value] = true
+	}
+
+	for _, accept := range accepted {
+		if accept.q == 0 {
+			break
+		}
+		if accept.value == "identity" {
+			return ""
+		}
+		if accept.value == "*" {
+			// gzip is preferred for wildcards as every client supports it
+			for _, name := range []string{"gzip", "zstd"} {
+				if !listed[name] {
+					return name
+				}
+			}
+			continue
+		}
+		for _, enc := range responseEncodings {
+			if accept.value == enc.Name {
+				return enc.Name
+			}
+		}
+	}
+	return ""
+}
+
+// compressWriter compresses a response. The first write is flushed to the
+// client immediately and later writes within compressionFlushInterval, even if
+// nothing else is written, so clients receive records while the response is
+// still being written.
+type compressWriter struct {
+	w        http.ResponseWriter
+	out      *countingWriter
+	c        compressor
+	encoding string
+	in       int64
+
+	// mu guards the compressor and response, which are also flushed by timer.
+	mu     sync.Mutex
+	timer  *time.Timer
+	closed bool
+}
+
+func newCompressWriter(w http.ResponseWriter, encoding string) (*compressWriter, error) {
+	cw := &compressWriter{
+		w:        w,
+		out:      &countingWriter{w: w},
+		encoding: encoding,
+	}
+	for _, enc := range responseEncodings {
+		if enc.Name == encoding {
+			c, err := enc.NewWriter(cw.out)
+			if err != nil {
+				return nil, err
+			}
+			cw.c = c
+		}
+	}
+	return cw, nil
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	first := cw.in == 0
+	n, err := cw.c.Write(p)
+	cw.in += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if first {
+		return n, cw.flush()
+	}
+	if cw.timer == nil {
+		cw.timer = time.AfterFunc(compressionFlushInterval, cw.flushTimer)
+	}
+	return n, nil
+}
+
+// Flush writes any buffered compressed output to the client.
+func (cw *compressWriter) Flush() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	return cw.flush()
+}
+
+// flushTimer flushes the output buffered since the timer was started.
+func (cw *compressWriter) flushTimer() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	// a flush which fails also fails the next write or close
+	if !cw.closed {
+		cw.flush()
+	}
+}
+
+// flush flushes the compressor and response. cw.mu must be held.
+func (cw *compressWriter) flush() error {
+	if cw.timer != nil {
+		cw.timer.Stop()
+		cw.timer = nil
+	}
+	if err := cw.c.Flush(); err != nil {
+		return err
+	}
+	if f, ok := cw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Close writes the end of the compressed stream and records the compression
+// ratio. Nothing is written to the response after it returns.
+func (cw *compressWriter) Close() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	cw.closed = true
+	if cw.timer != nil {
+		cw.timer.Stop()
+		cw.timer = nil
+	}
+	if err := cw.c.Close(); err != nil {
+		return err
+	}
+	if cw.in > 0 && cw.out.n > 0 {
+		responseCompressionRatio.WithLabelValues(cw.encoding).Observe(float64(cw.in) / float64(cw.out.n))
+	}
+	return nil
+}
+
+// countingWriter tracks the number of bytes written.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testcases := map[string]struct {
+		accept string
+		format *outputFormat
+		want   string
+	}{
+		"None":                 {"", outputFormats["ndjson"], ""},
+		"Gzip":                 {"gzip, deflate", outputFormats["ndjson"], "gzip"},
+		"Zstd":                 {"zstd", outputFormats["csv"], "zstd"},
+		"Preference":           {"gzip;q=0.5, zstd;q=0.8", outputFormats["ndjson"], "zstd"},
+		"Wildcard":             {"*", outputFormats["ndjson"], "gzip"},
+		"Identity":             {"identity, gzip;q=0.5", outputFormats["ndjson"], ""},
+		"Disabled":             {"gzip;q=0", outputFormats["ndjson"], ""},
+		"WildcardExcludesGzip": {"*, gzip;q=0", outputFormats["ndjson"], "zstd"},
+		"WildcardExcludesAll":  {"gzip;q=0, zstd;q=0, *", outputFormats["ndjson"], ""},
+		"WildcardListed":       {"gzip;q=0.1, *", outputFormats["ndjson"], "zstd"},
+		"IdentityDisabled":     {"identity;q=0, gzip", outputFormats["ndjson"], "gzip"},
+		"Parquet":              {"gzip", outputFormats["parquet"], ""},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			r.Header.Set("Accept-Encoding", tc.accept)
+			if s := negotiateEncoding(r, tc.format); s != tc.want {
+				t.Fatalf("expected encoding %q. got %q", tc.want, s)
+			}
+		})
+	}
+}
+
+func TestCompressedQuery(t *testing.T) {
+	var records []*Record
+	for i := 0; i < 100; i++ {
+		records = append(records, &Record{
+			Timestamp: time.Date(2022, 1, 1, 10, 0, i, 0, time.UTC),
+			Name:      "env.temperature",
+			Value:     float64(i),
+			Meta:      map[string]string{"vsn": "W001", "node": "000048b02d15bc7c", "plugin": "waggle/plugin-iio:0.4.5"},
+		})
+	}
+
+	svc := NewService(&ServiceConfig{
+		Backend: &DummyBackend{records},
+	})
+
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	want, _ := io.ReadAll(w.Result().Body)
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"zstd": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+	}
+
+	for encoding, newReader := range decoders {
+		t.Run(encoding, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h"}`))
+			r.Header.Set("Accept-Encoding", encoding)
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			resp := w.Result()
+
+			assertStatusCode(t, resp, http.StatusOK)
+			if s := resp.Header.Get("Content-Encoding"); s != encoding {
+				t.Fatalf("expected content encoding %q. got %q", encoding, s)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			if len(body) >= len(want) {
+				t.Fatalf("expected compressed body to be smaller. got %d >= %d bytes", len(body), len(want))
+			}
+
+			zr, err := newReader(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("decompressed body doesn't match")
+			}
+		})
+	}
+}
+
+func TestCompressWriterFlush(t *testing.T) {
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	cw, err := newCompressWriter(w, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first record is flushed right away
+	cw.Write([]byte("first\n"))
+	if n := w.flushCount(); n != 1 {
+		t.Fatalf("expected 1 flush after first write. got %d", n)
+	}
+
+	// later records are flushed even if nothing else is written
+	cw.Write([]byte("second\n"))
+	deadline := time.Now().Add(3 * compressionFlushInterval)
+	for w.flushCount() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected buffered output to be flushed while idle")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != "first\nsecond\n" {
+		t.Fatalf("unexpected body %q", b)
+	}
+}
+
+// flushRecorder counts flushes of a response.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	mu      sync.Mutex
+	flushes int
+}
+
+func (w *flushRecorder) Flush() {
+	w.mu.Lock()
+	w.flushes++
+	w.mu.Unlock()
+	w.ResponseRecorder.Flush()
+}
+
+func (w *flushRecorder) flushCount() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushes
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
+)
+
+// conformanceNow is the time relative conformance queries are resolved against.
+var conformanceNow = time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// conformanceRecords is the data set conformance cases are run against.
+var conformanceRecords = []*Record{
+	{Timestamp: time.Date(2022, 1, 1, 9, 0, 0, 0, time.UTC), Name: "env.temperature", Value: 19.0, Meta: map[string]string{"vsn": "W001", "plugin": "waggle/plugin-iio:0.4.5"}},
+	{Timestamp: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC), Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": "W001", "plugin": "waggle/plugin-iio:0.4.5"}},
+	{Timestamp: time.Date(2022, 1, 1, 10, 20, 0, 0, time.UTC), Name: "env.temperature", Value: 23.0, Meta: map[string]string{"vsn": "W001", "plugin": "waggle/plugin-iio:0.4.5"}},
+	{Timestamp: time.Date(2022, 1, 1, 10, 40, 0, 0, time.UTC), Name: "env.temperature", Value: 26.0, Meta: map[string]string{"vsn": "W001", "plugin": "waggle/plugin-iio:0.4.5"}},
+	{Timestamp: time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC), Name: "env.temperature", Value: 15.0, Meta: map[string]string{"vsn": "W002", "plugin": "waggle/plugin-iio.dev"}},
+	{Timestamp: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC), Name: "env.temperature", Value: 17.0, Meta: map[string]string{"vsn": "W002", "plugin": "waggle/plugin-iio.dev"}},
+	{Timestamp: time.Date(2022, 1, 1, 10, 15, 0, 0, time.UTC), Name: "env.humidity", Value: 40.0, Meta: map[string]string{"vsn": "W001", "plugin": "waggle/plugin-iio:0.4.5"}},
+	{Timestamp: time.Date(2022, 1, 1, 10, 25, 0, 0, time.UTC), Name: "sys.uptime", Value: 3600.0, Meta: map[string]string{"vsn": "W001"}},
+}
+
+// conformanceCases pair a query with the Flux query built for it by
+// InfluxBackend and the records it returns from InfluxDB for conformanceRecords.
+// MemoryBackend must return the same records.
+var conformanceCases = map[string]struct {
+	Query  *Query
+	Flux   string
+	Expect string
+}{
+	"RelativeRange": {
+		Query: &Query{Start: "-1h30m", End: "-1h45s"},
+		Flux:  `from(bucket:"mybucket") |> range(start:-1h30m,stop:-1h45s)`,
+		Expect: `{"timestamp":"2022-01-01T10:30:00Z","name":"env.temperature","value":17,"meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T10:40:00Z","name":"env.temperature","value":26,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+	"AbsoluteRange": {
+		Query: &Query{Start: "2022-01-01T10:00:00Z", End: "2022-01-01T10:20:00Z", Filter: map[string]string{"name": "env.temperature"}},
+		Flux:  `from(bucket:"mybucket") |> range(start:2022-01-01T10:00:00Z,stop:2022-01-01T10:20:00Z) |> filter(fn: (r) => r._measurement == "env.temperature")`,
+		Expect: `{"timestamp":"2022-01-01T10:10:00Z","name":"env.temperature","value":15,"meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":20,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+	"Glob": {
+		Query: &Query{Start: "-4h", Filter: map[string]string{"name": "env.*"}, Head: intptr(1)},
+		Flux:  `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement =~ /^env.*$/) |> limit(n:1)`,
+		Expect: `{"timestamp":"2022-01-01T10:15:00Z","name":"env.humidity","value":40,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+{"timestamp":"2022-01-01T10:10:00Z","name":"env.temperature","value":15,"meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T09:00:00Z","name":"env.temperature","value":19,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+	"Alternation": {
+		Query: &Query{Start: "-4h", Filter: map[string]string{"name": "env.humidity|sys.uptime"}},
+		Flux:  `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement =~ /^(env.humidity|sys.uptime)$/)`,
+		Expect: `{"timestamp":"2022-01-01T10:15:00Z","name":"env.humidity","value":40,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+{"timestamp":"2022-01-01T10:25:00Z","name":"sys.uptime","value":3600,"meta":{"vsn":"W001"}}
+`,
+	},
+	// the dot keeps its regular expression meaning, so this matches both plugins
+	"GlobDot": {
+		Query: &Query{Start: "-4h", Filter: map[string]string{"plugin": "waggle/plugin-iio.*"}, Tail: intptr(1)},
+		Flux:  `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r.plugin =~ /^waggle\/plugin-iio.*$/) |> tail(n:1)`,
+		Expect: `{"timestamp":"2022-01-01T10:15:00Z","name":"env.humidity","value":40,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+{"timestamp":"2022-01-01T10:30:00Z","name":"env.temperature","value":17,"meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T10:40:00Z","name":"env.temperature","value":26,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+	"Negated": {
+		Query: &Query{Start: "-4h", Filter: map[string]string{"plugin": "!waggle/plugin-iio:*"}},
+		Flux:  `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => (not exists r.plugin or r.plugin !~ /^waggle\/plugin-iio:.*$/))`,
+		Expect: `{"timestamp":"2022-01-01T10:10:00Z","name":"env.temperature","value":15,"meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T10:30:00Z","name":"env.temperature","value":17,"meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T10:25:00Z","name":"sys.uptime","value":3600,"meta":{"vsn":"W001"}}
+`,
+	},
+	"TailPerSeries": {
+		Query: &Query{Start: "-4h", Filter: map[string]string{"name": "env.temperature"}, Tail: intptr(1)},
+		Flux:  `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement == "env.temperature") |> tail(n:1)`,
+		Expect: `{"timestamp":"2022-01-01T10:30:00Z","name":"env.temperature","value":17,"meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T10:40:00Z","name":"env.temperature","value":26,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+	"WindowedMean": {
+		Query: &Query{Start: "2022-01-01T10:00:00Z", End: "2022-01-01T11:00:00Z", Filter: map[string]string{"name": "env.temperature"}, Func: StringList{"mean"}, Window: strptr("30m")},
+		Flux:  `from(bucket:"mybucket") |> range(start:2022-01-01T10:00:00Z,stop:2022-01-01T11:00:00Z) |> filter(fn: (r) => r._measurement == "env.temperature") |> aggregateWindow(every: 30m, fn: mean)`,
+		Expect: `{"timestamp":"2022-01-01T10:30:00Z","name":"env.temperature","value":15,"aggregation":"mean","meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T11:00:00Z","name":"env.temperature","value":17,"aggregation":"mean","meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T10:30:00Z","name":"env.temperature","value":21.5,"aggregation":"mean","meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+{"timestamp":"2022-01-01T11:00:00Z","name":"env.temperature","value":26,"aggregation":"mean","meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+	"Selector": {
+		Query: &Query{Start: "-4h", Filter: map[string]string{"name": "env.temperature"}, Func: StringList{"max"}},
+		Flux:  `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement == "env.temperature") |> max()`,
+		Expect: `{"timestamp":"2022-01-01T10:30:00Z","name":"env.temperature","value":17,"aggregation":"max","meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T10:40:00Z","name":"env.temperature","value":26,"aggregation":"max","meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+	"Aggregate": {
+		Query: &Query{Start: "-4h", Filter: map[string]string{"name": "env.temperature"}, Func: StringList{"spread"}},
+		Flux:  `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement == "env.temperature") |> spread()`,
+		Expect: `{"timestamp":"2022-01-01T08:00:00Z","name":"env.temperature","value":2,"aggregation":"spread","meta":{"plugin":"waggle/plugin-iio.dev","vsn":"W002"}}
+{"timestamp":"2022-01-01T08:00:00Z","name":"env.temperature","value":7,"aggregation":"spread","meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+	"GroupBy": {
+		Query: &Query{Start: "-4h", Filter: map[string]string{"name": "env.temperature"}, Func: StringList{"count"}, GroupBy: []string{}},
+		Flux:  `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement == "env.temperature") |> group(columns: ["_start", "_stop", "_measurement", "_field"]) |> sort(columns: ["_time"]) |> count()`,
+		Expect: `{"timestamp":"2022-01-01T08:00:00Z","name":"env.temperature","value":6,"aggregation":"count","meta":{}}
+`,
+	},
+	"ValueFilter": {
+		Query: &Query{Start: "-4h", ValueFilter: "20..30"},
+		Flux: `import "types"
+from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => types.isNumeric(v: r._value) and float(v: r._value) >= 20.0 and float(v: r._value) <= 30.0)`,
+		Expect: `{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":20,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+{"timestamp":"2022-01-01T10:20:00Z","name":"env.temperature","value":23,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+{"timestamp":"2022-01-01T10:40:00Z","name":"env.temperature","value":26,"meta":{"plugin":"waggle/plugin-iio:0.4.5","vsn":"W001"}}
+`,
+	},
+}
+
+func TestConformanceFluxQuery(t *testing.T) {
+	for name, tc := range conformanceCases {
+		t.Run(name, func(t *testing.T) {
+			s, err := buildFluxQuery("mybucket", tc.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s != tc.Flux {
+				t.Fatalf("flux query expected:\nexpect: %s\noutput: %s", tc.Flux, s)
+			}
+		})
+	}
+}
+
+func TestConformanceMemoryBackend(t *testing.T) {
+	backend := NewMemoryBackend(conformanceRecords)
+	backend.Now = func() time.Time { return conformanceNow }
+
+	for name, tc := range conformanceCases {
+		t.Run(name, func(t *testing.T) {
+			results, err := backend.Query(context.Background(), tc.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer results.Close()
+
+			var b bytes.Buffer
+			encoder := json.NewEncoder(&b)
+			for results.Next() {
+				encoder.Encode(results.Record())
+			}
+			if err := results.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tc.Expect {
+				t.Fatalf("records expected:\nexpect:\n%s\noutput:\n%s", tc.Expect, b.String())
+			}
+		})
+	}
+}
+
+// TestConformanceInfluxBackend runs the conformance cases against a real InfluxDB
+// given by INFLUXDB_TEST_URL, INFLUXDB_TEST_TOKEN and INFLUXDB_TEST_ORG. The
+// records are written to a temporary bucket which is deleted afterwards. The
+// test is skipped if InfluxDB isn't available.
+func TestConformanceInfluxBackend(t *testing.T) {
+	url := os.Getenv("INFLUXDB_TEST_URL")
+	if url == "" {
+		t.Skip("INFLUXDB_TEST_URL not set")
+	}
+	org := os.Getenv("INFLUXDB_TEST_ORG")
+	if org == "" {
+		org = "waggle"
+	}
+
+	client := influxdb2.NewClient(url, os.Getenv("INFLUXDB_TEST_TOKEN"))
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if ok, err := client.Ping(ctx); !ok {
+		t.Skipf("influxdb not available: %v", err)
+	}
+
+	orgDomain, err := client.OrganizationsAPI().FindOrganizationByName(ctx, org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.BucketsAPI().CreateBucketWithName(ctx, orgDomain, fmt.Sprintf("conformance-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.BucketsAPI().DeleteBucket(context.Background(), bucket)
+
+	writeAPI := client.WriteAPIBlocking(org, bucket.Name)
+	for _, rec := range conformanceRecords {
+		p := influxdb2.NewPoint(rec.Name, rec.Meta, map[string]interface{}{"value": rec.Value}, rec.Timestamp)
+		if err := writeAPI.WritePoint(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := &InfluxBackend{Client: client, Org: org, Bucket: bucket.Name}
+
+	for name, tc := range conformanceCases {
+		t.Run(name, func(t *testing.T) {
+			fluxQuery, err := buildFluxQuery(bucket.Name, tc.Query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := backend.query(ctx, tc.Query, withFluxNow(fluxQuery, conformanceNow))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer results.Close()
+
+			var b bytes.Buffer
+			encoder := json.NewEncoder(&b)
+			for results.Next() {
+				encoder.Encode(results.Record())
+			}
+			if err := results.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tc.Expect {
+				t.Fatalf("records expected:\nexpect:\n%s\noutput:\n%s", tc.Expect, b.String())
+			}
+		})
+	}
+}
+
+// withFluxNow sets the time relative ranges in a Flux query are resolved against.
+func withFluxNow(fluxQuery string, now time.Time) string {
+	// options must follow any imports
+	var imports strings.Builder
+	for strings.HasPrefix(fluxQuery, "import ") {
+		line, rest, _ := strings.Cut(fluxQuery, "\n")
+		imports.WriteString(line + "\n")
+		fluxQuery = rest
+	}
+	return fmt.Sprintf("%soption now = () => %s\n%s", imports.String(), now.Format(time.RFC3339), fluxQuery)
+}
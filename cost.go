@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryCost = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricNamespace,
+		Name:      "query_cost",
+		Help:      "A histogram of estimated query costs.",
+		Buckets:   prometheus.ExponentialBuckets(1, 10, 10),
+	})
+	queryCostRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "query_cost_rejections_total",
+		Help:      "The total number of queries rejected for their estimated cost by the limit they exceeded.",
+	}, []string{"limit"})
+)
+
+// aggregationCostFactor scales the cost of aggregated queries. They still read
+// every record in range but return far fewer of them.
+const aggregationCostFactor = 0.5
+
+// queryCostEstimate holds the estimated cost of a query and what it was based on.
+type queryCostEstimate struct {
+	Series int           `json:"series"`
+	Range  time.Duration `json:"-"`
+	Cost   float64       `json:"cost"`
+}
+
+// String formats the cost for the X-Query-Cost header and error messages.
+func (e *queryCostEstimate) String() string {
+	return formatCost(e.Cost)
+}
+
+func formatCost(cost float64) string {
+	return strconv.FormatFloat(cost, 'f', 1, 64)
+}
+
+// estimateQueryCost scores a query by the number of series it matches times the
+// number of hours in its range, which is roughly proportional to the number of
+// records the backend reads. Aggregations are scaled by aggregationCostFactor.
+// series is the number of series matching the query filter, as reported by a
+// CardinalityBackend.
+func estimateQueryCost(query *Query, series int, now time.Time) (*queryCostEstimate, error) {
+	start, end, err := estimateQueryRange(query, now)
+	if err != nil {
+		return nil, err
+	}
+	r := max(end.Sub(start), 0)
+	cost := float64(series) * r.Hours()
+	if len(query.Func) > 0 {
+		cost *= aggregationCostFactor
+	}
+	return &queryCostEstimate{Series: series, Range: r, Cost: cost}, nil
+}
+
+// estimateQueryRange resolves the range of a query like resolveQueryRange, but
+// also accepts durations in months and years using their approximate lengths.
+func estimateQueryRange(query *Query, now time.Time) (time.Time, time.Time, error) {
+	if start, end, err := resolveQueryRange(query, now); err == nil {
+		return start, end, nil
+	}
+	start, ok := estimateQueryTime(query.Start, now)
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("unsupported start time %q", query.Start)
+	}
+	end := now
+	if query.End != "" {
+		if end, ok = estimateQueryTime(query.End, now); !ok {
+			return time.Time{}, time.Time{}, fmt.Errorf("unsupported end time %q", query.End)
+		}
+	}
+	return start, end, nil
+}
+
+var approxDurationRE = regexp.MustCompile(`^([0-9]+(ns|us|µs|ms|s|mo|m|h|d|w|y))+$`)
+
+var approxDurationPartRE = regexp.MustCompile(`([0-9]+)(ns|us|µs|ms|s|mo|m|h|d|w|y)`)
+
+// approxDurationUnits holds the approximate lengths of the units without a fixed length.
+var approxDurationUnits = map[string]time.Duration{
+	"mo": 30 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// estimateQueryTime resolves a query time like parseQueryTime, using the
+// approximate lengths of months and years.
+func estimateQueryTime(s string, now time.Time) (time.Time, bool) {
+	if t, ok := parseQueryTime(s, now); ok {
+		return t, true
+	}
+	if len(s) == 0 || s[0] != '-' || !approxDurationRE.MatchString(s[1:]) {
+		return time.Time{}, false
+	}
+	var d time.Duration
+	for _, m := range approxDurationPartRE.FindAllStringSubmatch(s[1:], -1) {
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		unit, ok := approxDurationUnits[m[2]]
+		if !ok {
+			unit = fixedDurationUnits[m[2]]
+		}
+		d += time.Duration(n) * unit
+	}
+	return now.Add(-d), true
+}
+
+// countSeries returns the number of distinct series in records.
+func countSeries(records []*Record) int {
+	series := make(map[string]bool)
+	for _, rec := range records {
+		series[seriesKey(rec)] = true
+	}
+	return len(series)
+}
+
+// estimateCost estimates the cost of a query using cardinality to count its
+// series. It returns nil if cardinality is nil.
+func estimateCost(ctx context.Context, cardinality CardinalityBackend, query *Query, now time.Time) (*queryCostEstimate, error) {
+	if cardinality == nil {
+		return nil, nil
+	}
+	series, err := cardinality.Cardinality(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cardinality: %w", err)
+	}
+	return estimateQueryCost(query, series, now)
+}
+
+// costLimits holds the limits on the estimated cost of queries shared by the
+// services which query the backend.
+type costLimits struct {
+	cardinality CardinalityBackend
+	costLimit   float64
+	maxCost     float64
+	now         func() time.Time
+}
+
+// estimateCost estimates the cost of a query. It returns nil without a
+// CardinalityBackend.
+func (limits *costLimits) estimateCost(ctx context.Context, query *Query) (*queryCostEstimate, error) {
+	estimate, err := estimateCost(ctx, limits.cardinality, query, limits.now())
+	if estimate != nil {
+		queryCost.Observe(estimate.Cost)
+	}
+	return estimate, err
+}
+
+// checkCost returns an error if an estimate exceeds the max cost or exceeds the
+// cost limit without the query allowing expensive queries.
+func (limits *costLimits) checkCost(query *Query, estimate *queryCostEstimate) error {
+	if limits.maxCost > 0 && estimate.Cost > limits.maxCost {
+		queryCostRejectionsTotal.WithLabelValues("max").Inc()
+		return fmt.Errorf("query is too expensive: estimated cost %s exceeds max cost %s. narrow the time range or filter", estimate, formatCost(limits.maxCost))
+	}
+	if limits.costLimit > 0 && estimate.Cost > limits.costLimit && !query.AllowExpensive {
+		queryCostRejectionsTotal.WithLabelValues("limit").Inc()
+		return fmt.Errorf("query is expensive: estimated cost %s exceeds cost limit %s. narrow the time range or filter or set allow_expensive to run it anyway", estimate, formatCost(limits.costLimit))
+	}
+	return nil
+}
+
+// checkQueryCost estimates the cost of a query and checks it against limits. If
+// the query is rejected, it writes the error response and returns false. Nil
+// limits accept every query.
+//
+// The estimate takes a backend query, so it should only be made once a queue
+// slot is free. Without a max cost, queries which can't be estimated are let
+// through, as the cost limit is only a safeguard.
+func checkQueryCost(w http.ResponseWriter, r *http.Request, limits *costLimits, query *Query, remoteAddr string) bool {
+	if limits == nil {
+		return true
+	}
+	estimate, err := limits.estimateCost(r.Context(), query)
+	if err != nil {
+		log.Printf("%s error: failed to estimate query cost: %s", remoteAddr, err.Error())
+		if limits.maxCost > 0 {
+			http.Error(w, fmt.Sprintf("error: failed to estimate query cost: %s", err.Error()), http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	}
+	if estimate == nil {
+		return true
+	}
+	log.Printf("%s query cost: %s (%d series over %s)", remoteAddr, estimate, estimate.Series, estimate.Range)
+	w.Header().Set("X-Query-Cost", estimate.String())
+	if err := limits.checkCost(query, estimate); err != nil {
+		log.Printf("%s error: rejected query: %s", remoteAddr, err.Error())
+		http.Error(w, fmt.Sprintf("error: %s", err.Error()), http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEstimateQueryCost(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testcases := map[string]struct {
+		Query  *Query
+		Series int
+		Cost   float64
+	}{
+		"Relative":    {&Query{Start: "-4h"}, 10, 40},
+		"Absolute":    {&Query{Start: "2021-12-31T00:00:00Z", End: "2021-12-31T12:00:00Z"}, 2, 24},
+		"Years":       {&Query{Start: "-5y"}, 1, 5 * 365 * 24},
+		"Months":      {&Query{Start: "-1mo", End: "-1w"}, 1, 23 * 24},
+		"Aggregation": {&Query{Start: "-4h", Func: StringList{"mean"}}, 10, 20},
+		"EmptyRange":  {&Query{Start: "-1h", End: "-2h"}, 10, 0},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			estimate, err := estimateQueryCost(tc.Query, tc.Series, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if estimate.Cost != tc.Cost {
+				t.Fatalf("expected cost %f. got %f", tc.Cost, estimate.Cost)
+			}
+		})
+	}
+
+	if _, err := estimateQueryCost(&Query{Start: "yesterday"}, 1, now); err == nil {
+		t.Fatalf("expected error for unsupported start")
+	}
+}
+
+func TestQueryCostLimit(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var records []*Record
+	for _, vsn := range []string{"W001", "W002"} {
+		for _, age := range []time.Duration{30 * time.Minute, 5 * time.Hour, 9 * time.Hour} {
+			records = append(records, &Record{Timestamp: now.Add(-age), Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": vsn}})
+		}
+	}
+	backend := NewMemoryBackend(records)
+	backend.Now = func() time.Time { return now }
+
+	svc := NewService(&ServiceConfig{
+		Backend:     backend,
+		Cardinality: backend,
+		CostLimit:   5,
+		MaxCost:     100,
+		Now:         func() time.Time { return now },
+	})
+
+	testcases := map[string]struct {
+		Body   string
+		Status int
+		Cost   string
+		Error  string
+	}{
+		"BelowLimit":  {`{"start": "-2h", "filter": {"vsn": "W001"}}`, http.StatusOK, "2.0", ""},
+		"AboveLimit":  {`{"start": "-10h", "filter": {"vsn": "W001"}}`, http.StatusUnprocessableEntity, "10.0", "error: query is expensive: estimated cost 10.0 exceeds cost limit 5.0. narrow the time range or filter or set allow_expensive to run it anyway\n"},
+		"Allowed":     {`{"start": "-10h", "filter": {"vsn": "W001"}, "allow_expensive": true}`, http.StatusOK, "10.0", ""},
+		"Aggregation": {`{"start": "-10h", "experimental_func": "mean"}`, http.StatusUnprocessableEntity, "10.0", ""},
+		"AboveMax":    {`{"start": "-100h", "allow_expensive": true}`, http.StatusUnprocessableEntity, "200.0", "error: query is too expensive: estimated cost 200.0 exceeds max cost 100.0. narrow the time range or filter\n"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", bytes.NewBufferString(tc.Body))
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			resp := w.Result()
+			assertStatusCode(t, resp, tc.Status)
+			if s := resp.Header.Get("X-Query-Cost"); s != tc.Cost {
+				t.Fatalf("expected X-Query-Cost %q. got %q", tc.Cost, s)
+			}
+			if tc.Error != "" {
+				assertReadBody(t, resp, []byte(tc.Error))
+			}
+		})
+	}
+}
+
+func TestLatestAndMetadataCostLimit(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var records []*Record
+	for _, vsn := range []string{"W001", "W002"} {
+		records = append(records, &Record{Timestamp: now.Add(-30 * time.Minute), Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": vsn}})
+	}
+	backend := NewMemoryBackend(records)
+	backend.Now = func() time.Time { return now }
+
+	cost := &costLimits{cardinality: backend, maxCost: 100, now: func() time.Time { return now }}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/latest", &LatestService{Backend: backend, Cost: cost})
+	mux.Handle("/api/v1/names", &MetadataService{Backend: backend, Kind: MetadataNames, Cost: cost})
+	mux.Handle("/api/v1/meta/{key}/values", &MetadataService{Backend: backend, Kind: MetadataValues, Cost: cost})
+
+	testcases := map[string]struct {
+		Path   string
+		Body   string
+		Status int
+	}{
+		"Latest":         {"/api/v1/latest", `{"start": "-2h"}`, http.StatusOK},
+		"LatestAboveMax": {"/api/v1/latest", `{"start": "-1000h"}`, http.StatusUnprocessableEntity},
+		"Names":          {"/api/v1/names", `{"start": "-2h"}`, http.StatusOK},
+		"NamesAboveMax":  {"/api/v1/names", `{"start": "-1000h"}`, http.StatusUnprocessableEntity},
+		"ValuesAboveMax": {"/api/v1/meta/vsn/values", `{"start": "-1000h"}`, http.StatusUnprocessableEntity},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tc.Path, bytes.NewBufferString(tc.Body))
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			resp := w.Result()
+			assertStatusCode(t, resp, tc.Status)
+			if resp.Header.Get("X-Query-Cost") == "" {
+				t.Fatalf("expected X-Query-Cost header")
+			}
+		})
+	}
+}
+
+// failingCardinality is a CardinalityBackend which always fails.
+type failingCardinality struct {
+	calls int
+}
+
+func (c *failingCardinality) Cardinality(ctx context.Context, query *Query) (int, error) {
+	c.calls++
+	return 0, errors.New("cardinality unavailable")
+}
+
+func TestQueryCostEstimateError(t *testing.T) {
+	testcases := map[string]struct {
+		CostLimit float64
+		MaxCost   float64
+		Status    int
+	}{
+		"CostLimit": {CostLimit: 5, Status: http.StatusOK},
+		"MaxCost":   {CostLimit: 5, MaxCost: 100, Status: http.StatusServiceUnavailable},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			svc := NewService(&ServiceConfig{
+				Backend:     &DummyBackend{},
+				Cardinality: &failingCardinality{},
+				CostLimit:   tc.CostLimit,
+				MaxCost:     tc.MaxCost,
+			})
+			r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h"}`))
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			assertStatusCode(t, w.Result(), tc.Status)
+		})
+	}
+}
+
+func TestQueryCostEstimateQueued(t *testing.T) {
+	cardinality := &failingCardinality{}
+	svc := NewService(&ServiceConfig{
+		Backend:      &DummyBackend{},
+		QueueSize:    1,
+		QueueTimeout: 10 * time.Millisecond,
+		Cardinality:  cardinality,
+		MaxCost:      100,
+	})
+
+	// occupy the only slot in the queue
+	if err := svc.queue.Enter(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.queue.Leave()
+
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusServiceUnavailable)
+	if cardinality.calls != 0 {
+		t.Fatalf("expected no cost estimate before entering the queue. got %d", cardinality.calls)
+	}
+}
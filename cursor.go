@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// queryCursor marks the last record of a page of results. Results are ordered by
+// timestamp and then by series key, so the next page starts at the first record
+// after this position.
+type queryCursor struct {
+	Timestamp time.Time `json:"ts"`
+	Series    string    `json:"series"`
+}
+
+// after reports whether a record at ts with series key series comes after the cursor.
+func (c *queryCursor) after(ts time.Time, series string) bool {
+	if !ts.Equal(c.Timestamp) {
+		return ts.After(c.Timestamp)
+	}
+	return series > c.Series
+}
+
+// cursorStartsRange reports whether a query's range starts at its cursor. Records
+// before the cursor are skipped when the page is built either way, but moving
+// the start means less is read. Aggregations keep their start, as a windowed
+// record stamped at the cursor comes from the window before it, which other
+// series' records at the cursor timestamp also need.
+func cursorStartsRange(query *Query) bool {
+	return query.Cursor != "" && len(query.Func) == 0
+}
+
+// encodeCursor encodes a cursor as an opaque continuation token.
+func encodeCursor(c *queryCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (*queryCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	c := &queryCursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+// seriesKey identifies the series a record belongs to using its name and meta.
+func seriesKey(rec *Record) string {
+	var b strings.Builder
+	b.WriteString(rec.Name)
+	for _, k := range sortedKeys(rec.Meta) {
+		b.WriteByte(',')
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(rec.Meta[k])
+	}
+	return b.String()
+}
+
+// pageSlack is the number of records fetched past the end of a page when its
+// limit is pushed down to the backend. It leaves room for the records at the
+// cursor timestamp which were returned on the previous page.
+const pageSlack = 100
+
+// pageFetchLimit returns the number of records to fetch for a page of limit
+// records. One more record is needed to tell whether there's another page.
+func pageFetchLimit(limit int) int {
+	return limit + 1 + pageSlack
+}
+
+// truncatePage checks whether records fetched by time with a limit of n hold a
+// full page of limit records following cursor. When n records were fetched, the
+// limit may have cut off the records sharing the last timestamp. Their order by
+// series isn't known, so they are dropped. It returns false if the remaining
+// records don't fill the page, so the records must be fetched without a limit.
+func truncatePage(records []*Record, n int, cursor *queryCursor, limit int) ([]*Record, bool) {
+	if len(records) < n {
+		return records, true
+	}
+	end := len(records)
+	for end > 0 && records[end-1].Timestamp.Equal(records[len(records)-1].Timestamp) {
+		end--
+	}
+	records = records[:end]
+
+	count := 0
+	for _, rec := range records {
+		if cursor == nil || cursor.after(rec.Timestamp, seriesKey(rec)) {
+			count++
+		}
+	}
+	return records, count > limit
+}
+
+// pageResults limits results to a single page of limit records following cursor.
+// The underlying results must be ordered by timestamp. Records sharing a
+// timestamp are ordered by series key, so every record has a stable position
+// across pages. A nil cursor starts at the first record.
+func pageResults(results Results, cursor *queryCursor, limit int) *pagedResults {
+	return &pagedResults{results: results, cursor: cursor, limit: limit}
+}
+
+type pagedResults struct {
+	results Results
+	cursor  *queryCursor
+	limit   int
+	count   int
+	record  *Record
+	last    *Record
+	more    bool
+	done    bool
+
+	// run holds buffered records sharing the same timestamp. pending holds the
+	// record read after the end of the run.
+	run     []*Record
+	pending *Record
+}
+
+func (r *pagedResults) Err() error {
+	return r.results.Err()
+}
+
+func (r *pagedResults) Close() error {
+	return r.results.Close()
+}
+
+func (r *pagedResults) Record() *Record {
+	return r.record
+}
+
+func (r *pagedResults) Next() bool {
+	if r.count >= r.limit {
+		// check if there are any records left for another page
+		if !r.done {
+			r.done = true
+			r.more = len(r.run) > 0 || r.pending != nil || r.results.Next()
+		}
+		return false
+	}
+	for {
+		if len(r.run) == 0 && !r.fillRun() {
+			return false
+		}
+		rec := r.run[0]
+		r.run = r.run[1:]
+		if r.cursor != nil && !r.cursor.after(rec.Timestamp, seriesKey(rec)) {
+			continue
+		}
+		r.record = rec
+		r.last = rec
+		r.count++
+		return true
+	}
+}
+
+// fillRun reads the next run of records sharing a timestamp and sorts it by series key.
+func (r *pagedResults) fillRun() bool {
+	if r.pending == nil {
+		if !r.results.Next() {
+			return false
+		}
+		r.pending = r.results.Record()
+	}
+
+	r.run = append(r.run[:0], r.pending)
+	r.pending = nil
+
+	for r.results.Next() {
+		rec := r.results.Record()
+		if !rec.Timestamp.Equal(r.run[0].Timestamp) {
+			r.pending = rec
+			break
+		}
+		r.run = append(r.run, rec)
+	}
+
+	sort.SliceStable(r.run, func(i, j int) bool {
+		return seriesKey(r.run[i]) < seriesKey(r.run[j])
+	})
+	return true
+}
+
+// NextCursor returns the continuation token for the next page or an empty string
+// if this was the last page. It is only valid once Next has returned false.
+func (r *pagedResults) NextCursor() string {
+	if !r.more || r.last == nil {
+		return ""
+	}
+	return encodeCursor(&queryCursor{Timestamp: r.last.Timestamp, Series: seriesKey(r.last)})
+}
@@ -11,27 +11,76 @@ type DummyBackend struct {
 
 // Query provides the test records through Results.
 func (backend *DummyBackend) Query(ctx context.Context, query *Query) (Results, error) {
-	return &dummyResults{records: backend.Records}, nil
+	matcher, err := newQueryMatcher(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for _, rec := range backend.Records {
+		if matcher.match(rec.Name, rec.Meta, rec.Value) {
+			records = append(records, rec)
+		}
+	}
+
+	var results Results = &recordResults{records: records}
+	if query.Pivot != nil {
+		results = pivotResults(results, query.Pivot.By)
+	}
+	return results, nil
+}
+
+// Latest provides the most recent test record of each series through Results.
+func (backend *DummyBackend) Latest(ctx context.Context, query *Query) (Results, error) {
+	matcher, err := newQueryMatcher(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for _, rec := range backend.Records {
+		if matcher.match(rec.Name, rec.Meta, rec.Value) {
+			records = append(records, rec)
+		}
+	}
+
+	return &recordResults{records: latestRecords(records)}, nil
+}
+
+// Names lists the names of the test records.
+func (backend *DummyBackend) Names(ctx context.Context, query *Query) ([]string, error) {
+	return distinctNames(backend.Records), nil
+}
+
+// MetaKeys lists the meta keys of the test records.
+func (backend *DummyBackend) MetaKeys(ctx context.Context, query *Query) ([]string, error) {
+	return distinctMetaKeys(backend.Records), nil
+}
+
+// MetaValues lists the values of a meta key in the test records.
+func (backend *DummyBackend) MetaValues(ctx context.Context, query *Query, key string) ([]string, error) {
+	return distinctMetaValues(backend.Records, key), nil
 }
 
-type dummyResults struct {
+// recordResults provides a list of records through Results.
+type recordResults struct {
 	records []*Record
 	record  *Record
 }
 
-func (r *dummyResults) Err() error {
+func (r *recordResults) Err() error {
 	return nil
 }
 
-func (r *dummyResults) Close() error {
+func (r *recordResults) Close() error {
 	return nil
 }
 
-func (r *dummyResults) Record() *Record {
+func (r *recordResults) Record() *Record {
 	return r.record
 }
 
-func (r *dummyResults) Next() bool {
+func (r *recordResults) Next() bool {
 	if len(r.records) == 0 {
 		return false
 	}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// maxEvaluateWindows limits the number of windows per series of an in process
+// windowed aggregation.
+const maxEvaluateWindows = 100000
+
+// evaluateQuery evaluates a query in process against a list of records, for
+// backends which can't push queries down to a database. It follows the Flux
+// queries built by InfluxBackend: head, tail and aggregations apply to each
+// series, or to each group of series when group_by is used, and windowed
+// aggregations create empty windows with null values. Quantiles are exact,
+// interpolating between the closest values.
+//
+// Output is ordered by function, series and then timestamp, or only by
+// timestamp when a limit is used.
+func evaluateQuery(records []*Record, query *Query, now time.Time) ([]*Record, error) {
+	if query.Head != nil && query.Tail != nil {
+		return nil, fmt.Errorf("head and tail cannot both be specified")
+	}
+	if err := validateAggregation(query); err != nil {
+		return nil, err
+	}
+	start, end, err := resolveQueryRange(query, now)
+	if err != nil {
+		return nil, err
+	}
+	records, err = selectRecords(records, query, now)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[string][]*Record)
+	for _, rec := range records {
+		k := seriesKey(rec)
+		series[k] = append(series[k], rec)
+	}
+
+	keys := sortedKeys(series)
+	for _, k := range keys {
+		recs := series[k]
+		sortRecordsByTime(recs)
+		if query.Head != nil && *query.Head < len(recs) {
+			recs = recs[:*query.Head]
+		}
+		if query.Tail != nil && *query.Tail < len(recs) {
+			recs = recs[len(recs)-*query.Tail:]
+		}
+		series[k] = recs
+	}
+
+	var results []*Record
+
+	if len(query.Func) == 0 {
+		for _, k := range keys {
+			results = append(results, series[k]...)
+		}
+		if query.Pivot != nil {
+			if results, err = pivotRecords(&recordResults{records: results}, query.Pivot.By); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		groups := groupSeries(series, keys, query.GroupBy)
+		for _, fn := range query.Func {
+			agg, err := lookupAggregation(fn)
+			if err != nil {
+				return nil, err
+			}
+			var aggregated []*Record
+			for _, group := range groups {
+				recs, err := aggregateGroup(group, agg, query, start, end)
+				if err != nil {
+					return nil, err
+				}
+				aggregated = append(aggregated, recs...)
+			}
+			if query.Pivot != nil {
+				if aggregated, err = pivotAggregatedRecords(aggregated, query.Pivot.By, fn); err != nil {
+					return nil, err
+				}
+			}
+			results = append(results, aggregated...)
+		}
+	}
+
+	if query.Limit != nil {
+		sortRecordsByTime(results)
+	}
+	return results, nil
+}
+
+// selectRecords returns the records in the range of a query which match its filters.
+func selectRecords(records []*Record, query *Query, now time.Time) ([]*Record, error) {
+	start, end, err := resolveQueryRange(query, now)
+	if err != nil {
+		return nil, err
+	}
+	matcher, err := newQueryMatcher(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []*Record
+	for _, rec := range records {
+		if rec.Timestamp.Before(start) || !rec.Timestamp.Before(end) {
+			continue
+		}
+		if !matcher.match(rec.Name, rec.Meta, rec.Value) {
+			continue
+		}
+		selected = append(selected, rec)
+	}
+	return selected, nil
+}
+
+func sortRecordsByTime(records []*Record) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+}
+
+// recordGroup holds the records aggregated together along with the name and
+// meta of the aggregated records.
+type recordGroup struct {
+	name    string
+	meta    map[string]string
+	records []*Record
+}
+
+// groupSeries groups series for aggregation. Without group_by, each series is
+// its own group. Otherwise, series are grouped by name and the group_by keys
+// and only those keys are kept in the meta.
+func groupSeries(series map[string][]*Record, keys []string, groupBy []string) []*recordGroup {
+	var groups []*recordGroup
+
+	if groupBy == nil {
+		for _, k := range keys {
+			recs := series[k]
+			groups = append(groups, &recordGroup{name: recs[0].Name, meta: recs[0].Meta, records: recs})
+		}
+		return groups
+	}
+
+	byKey := make(map[string]*recordGroup)
+	for _, k := range keys {
+		for _, rec := range series[k] {
+			meta := make(map[string]string)
+			for _, k := range groupBy {
+				if v, ok := rec.Meta[k]; ok {
+					meta[k] = v
+				}
+			}
+			groupKey := rec.Name + "\x00" + pivotGroupKey(groupBy, meta)
+			group, ok := byKey[groupKey]
+			if !ok {
+				group = &recordGroup{name: rec.Name, meta: meta}
+				byKey[groupKey] = group
+			}
+			group.records = append(group.records, rec)
+		}
+	}
+
+	for _, k := range sortedKeys(byKey) {
+		sortRecordsByTime(byKey[k].records)
+		groups = append(groups, byKey[k])
+	}
+	return groups
+}
+
+// aggregateGroup applies an aggregation to a group. Windowed results are
+// timestamped with the end of their window. Un-windowed results are timestamped
+// with the selected record for selectors and with the range start otherwise.
+func aggregateGroup(group *recordGroup, agg *aggregation, query *Query, start, end time.Time) ([]*Record, error) {
+	var results []*Record
+
+	newRecord := func(ts time.Time, value interface{}) *Record {
+		return &Record{
+			Timestamp:   ts,
+			Name:        group.name,
+			Value:       value,
+			Aggregation: agg.Name,
+			Meta:        group.meta,
+		}
+	}
+
+	if query.Window == nil {
+		for _, v := range evaluateAggregation(agg, group.records) {
+			ts := start
+			if v.Record != nil {
+				ts = v.Record.Timestamp
+			}
+			results = append(results, newRecord(ts, v.Value))
+		}
+		return results, nil
+	}
+
+	every, ok := parseFixedDuration(*query.Window)
+	if !ok || every <= 0 {
+		return nil, fmt.Errorf("unsupported window %q", *query.Window)
+	}
+	windows := windowBounds(start, end, every)
+	if len(windows) > maxEvaluateWindows {
+		return nil, fmt.Errorf("window %q is too small for query range", *query.Window)
+	}
+
+	recs := group.records
+	for _, w := range windows {
+		n := 0
+		for n < len(recs) && recs[n].Timestamp.Before(w[1]) {
+			n++
+		}
+		for _, v := range evaluateAggregation(agg, recs[:n]) {
+			results = append(results, newRecord(w[1], v.Value))
+		}
+		recs = recs[n:]
+	}
+	return results, nil
+}
+
+// windowBounds returns the start and stop of each window covering a range.
+// Windows are aligned to the Unix epoch and truncated to the range.
+func windowBounds(start, end time.Time, every time.Duration) [][2]time.Time {
+	if !start.Before(end) {
+		return nil
+	}
+	offset := start.UnixNano() % int64(every)
+	if offset < 0 {
+		offset += int64(every)
+	}
+	var windows [][2]time.Time
+	for t := start.Add(-time.Duration(offset)); t.Before(end); t = t.Add(every) {
+		stop := t.Add(every)
+		if stop.After(end) {
+			stop = end
+		}
+		windows = append(windows, [2]time.Time{maxTime(t, start), stop})
+		if len(windows) > maxEvaluateWindows {
+			break
+		}
+	}
+	return windows
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// aggregateValue is a single value produced by an aggregation. Record holds the
+// selected record for selectors.
+type aggregateValue struct {
+	Value  interface{}
+	Record *Record
+}
+
+// evaluateAggregation applies an aggregation to records sorted by time. As in
+// Flux, numeric aggregations ignore other values and produce a null value when
+// there is nothing to aggregate.
+func evaluateAggregation(agg *aggregation, records []*Record) []aggregateValue {
+	switch agg.Name {
+	case "count":
+		return []aggregateValue{{Value: len(records)}}
+	case "first":
+		if len(records) == 0 {
+			return []aggregateValue{{}}
+		}
+		return []aggregateValue{{Value: records[0].Value, Record: records[0]}}
+	case "last":
+		if len(records) == 0 {
+			return []aggregateValue{{}}
+		}
+		return []aggregateValue{{Value: records[len(records)-1].Value, Record: records[len(records)-1]}}
+	case "distinct":
+		if len(records) == 0 {
+			return []aggregateValue{{}}
+		}
+		var values []aggregateValue
+		seen := make(map[interface{}]bool)
+		for _, rec := range records {
+			if !isComparableValue(rec.Value) || seen[rec.Value] {
+				continue
+			}
+			seen[rec.Value] = true
+			values = append(values, aggregateValue{Value: rec.Value})
+		}
+		return values
+	case "min", "max":
+		var selected *Record
+		var best float64
+		for _, rec := range records {
+			v, ok := toFloat64(rec.Value)
+			if !ok {
+				continue
+			}
+			if selected == nil || (agg.Name == "min" && v < best) || (agg.Name == "max" && v > best) {
+				selected, best = rec, v
+			}
+		}
+		if selected == nil {
+			return []aggregateValue{{}}
+		}
+		return []aggregateValue{{Value: selected.Value, Record: selected}}
+	}
+
+	var values []float64
+	for _, rec := range records {
+		if v, ok := toFloat64(rec.Value); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return []aggregateValue{{}}
+	}
+
+	switch agg.Name {
+	case "sum":
+		return []aggregateValue{{Value: sumFloat64(values)}}
+	case "mean":
+		return []aggregateValue{{Value: sumFloat64(values) / float64(len(values))}}
+	case "stddev":
+		// flux uses the sample standard deviation by default
+		if len(values) < 2 {
+			return []aggregateValue{{}}
+		}
+		mean := sumFloat64(values) / float64(len(values))
+		var ss float64
+		for _, v := range values {
+			ss += (v - mean) * (v - mean)
+		}
+		return []aggregateValue{{Value: math.Sqrt(ss / float64(len(values)-1))}}
+	case "spread":
+		lo, hi := values[0], values[0]
+		for _, v := range values {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+		return []aggregateValue{{Value: hi - lo}}
+	}
+
+	return []aggregateValue{{Value: quantile(values, agg.Quantile)}}
+}
+
+func sumFloat64(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+// quantile computes the q-th quantile of values, interpolating linearly between
+// the closest values. values is sorted in place.
+//
+// This is exact, unlike Flux's quantile, which estimates it with a t-digest by
+// default. Quantiles from InfluxBackend may differ slightly from the in-process
+// backends, so conformance cases don't compare them.
+func quantile(values []float64, q float64) float64 {
+	sort.Float64s(values)
+	pos := q * float64(len(values)-1)
+	i := int(math.Floor(pos))
+	if i >= len(values)-1 {
+		return values[len(values)-1]
+	}
+	frac := pos - float64(i)
+	return values[i] + frac*(values[i+1]-values[i])
+}
+
+// isComparableValue reports whether v can be used as a map key. Decoded JSON
+// values are always comparable except for arrays and objects.
+func isComparableValue(v interface{}) bool {
+	switch v.(type) {
+	case []interface{}, map[string]interface{}:
+		return false
+	}
+	return true
+}
+
+// pivotAggregatedRecords pivots the results of an aggregation function. As
+// with the Flux pivot, measurements without a value are omitted from a row.
+func pivotAggregatedRecords(records []*Record, keys []string, fn string) ([]*Record, error) {
+	rows, err := pivotRecords(&recordResults{records: records}, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		row.Aggregation = fn
+		for k, v := range row.Values {
+			if v == nil {
+				delete(row.Values, k)
+			}
+		}
+	}
+	return rows, nil
+}
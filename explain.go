@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ExplainService describes how a query would be run without running it. It
+// accepts the same query body as Service and returns the normalized query, the
+// backend queries it makes and the shape of its results.
+//
+// The estimated cost is only included when requested with the cost=true URL
+// parameter, as it takes a backend query. In GET requests, cost can't be used as
+// a meta filter.
+type ExplainService struct {
+	Backend Backend
+	// Cardinality is used to estimate query costs.
+	Cardinality CardinalityBackend
+	// Queue limits the cost estimates made concurrently with other requests. It
+	// may be nil.
+	Queue *RequestQueue
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// queryExplanation is the response of ExplainService.
+type queryExplanation struct {
+	Query *Query             `json:"query"`
+	Plan  *QueryPlan         `json:"plan,omitempty"`
+	Shape *resultShape       `json:"shape"`
+	Cost  *queryCostEstimate `json:"cost,omitempty"`
+}
+
+// resultShape describes the records returned by a query.
+type resultShape struct {
+	// Start and End are the query range resolved to absolute times, if possible.
+	Start *time.Time `json:"start,omitempty"`
+	End   *time.Time `json:"end,omitempty"`
+	// Fields lists the record fields which are set.
+	Fields []string `json:"fields"`
+	// Aggregations lists the aggregation functions applied to each series or group.
+	Aggregations []string `json:"aggregations,omitempty"`
+	// Windows is the number of windows each series or group is aggregated over.
+	Windows int `json:"windows,omitempty"`
+	// MaxRecordsPerSeries is the most records returned for each series or
+	// group, if the query bounds it.
+	MaxRecordsPerSeries *int `json:"max_records_per_series,omitempty"`
+	// MaxRecords is the most records returned in total, if the query is paged.
+	MaxRecords *int `json:"max_records,omitempty"`
+}
+
+func (svc *ExplainService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := getRemoteAddr(r)
+
+	values := r.URL.Query()
+	withCost := false
+	if s := values.Get("cost"); s != "" {
+		var err error
+		if withCost, err = strconv.ParseBool(s); err != nil {
+			log.Printf("%s error: invalid cost parameter: %q", remoteAddr, s)
+			http.Error(w, fmt.Sprintf("error: invalid cost parameter: %q", s), http.StatusBadRequest)
+			return
+		}
+		// don't treat cost as a filter in GET requests
+		values.Del("cost")
+		r.URL.RawQuery = values.Encode()
+	}
+	if withCost && svc.Cardinality == nil {
+		http.Error(w, "error: backend does not support query costs", http.StatusBadRequest)
+		return
+	}
+
+	query, _, ok := readQuery(w, r, remoteAddr)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if svc.Now != nil {
+		now = svc.Now()
+	}
+
+	explanation := &queryExplanation{
+		Query: query,
+		Shape: explainResultShape(query, now),
+	}
+
+	if backend, ok := svc.Backend.(ExplainBackend); ok {
+		plan, err := backend.Explain(r.Context(), query)
+		if err != nil {
+			log.Printf("%s error: failed to explain query: %s", remoteAddr, err.Error())
+			http.Error(w, fmt.Sprintf("error: failed to explain query: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		explanation.Plan = plan
+	}
+
+	if withCost {
+		leave, ok := enterQueue(w, r, svc.Queue, remoteAddr)
+		if !ok {
+			return
+		}
+		defer leave()
+
+		estimate, err := estimateCost(r.Context(), svc.Cardinality, query, now)
+		if err != nil {
+			log.Printf("%s error: failed to estimate query cost: %s", remoteAddr, err.Error())
+			http.Error(w, fmt.Sprintf("error: failed to estimate query cost: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		explanation.Cost = estimate
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(explanation)
+}
+
+// explainResultShape describes the records a query returns.
+func explainResultShape(query *Query, now time.Time) *resultShape {
+	shape := &resultShape{}
+
+	start, end, err := estimateQueryRange(query, now)
+	if err == nil {
+		shape.Start = &start
+		shape.End = &end
+	}
+
+	shape.Fields = []string{"timestamp"}
+	if query.Pivot != nil {
+		shape.Fields = append(shape.Fields, "values")
+	} else {
+		shape.Fields = append(shape.Fields, "name", "value")
+	}
+	if len(query.Func) > 0 {
+		shape.Fields = append(shape.Fields, "aggregation")
+	}
+	shape.Fields = append(shape.Fields, "meta")
+
+	switch {
+	case len(query.Func) > 0:
+		shape.Aggregations = query.Func
+		n := len(query.Func)
+		bounded := true
+		for _, fn := range query.Func {
+			if agg, err := lookupAggregation(fn); err != nil || agg.Multiple {
+				bounded = false
+			}
+		}
+		if query.Window != nil {
+			every, ok := parseFixedDuration(*query.Window)
+			if !ok || every <= 0 || err != nil {
+				// the number of windows isn't known
+				break
+			}
+			shape.Windows = windowCount(start, end, every)
+			n *= shape.Windows
+		}
+		if bounded {
+			shape.MaxRecordsPerSeries = &n
+		}
+	case query.Head != nil:
+		shape.MaxRecordsPerSeries = query.Head
+	case query.Tail != nil:
+		shape.MaxRecordsPerSeries = query.Tail
+	}
+
+	// a page never has more records than its limit
+	if query.Limit != nil {
+		shape.MaxRecords = query.Limit
+		if shape.MaxRecordsPerSeries == nil || *shape.MaxRecordsPerSeries > *query.Limit {
+			shape.MaxRecordsPerSeries = query.Limit
+		}
+	}
+
+	return shape
+}
+
+// windowCount returns the number of windows covering a range, like windowBounds.
+func windowCount(start, end time.Time, every time.Duration) int {
+	if !start.Before(end) {
+		return 0
+	}
+	offset := start.UnixNano() % int64(every)
+	if offset < 0 {
+		offset += int64(every)
+	}
+	d := end.Sub(start) + time.Duration(offset)
+	return int((d + every - 1) / every)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExplainService(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	backend := &InfluxBackend{
+		Bucket:        "waggle",
+		BucketAliases: map[string][]string{"all": {"waggle", "downsampled"}},
+	}
+	svc := &ExplainService{Backend: backend, Now: func() time.Time { return now }}
+
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h", "filter": {"vsn": "W001"}, "experimental_func": "mean", "experimental_window": "1h", "bucket": "all"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp := w.Result()
+	assertStatusCode(t, resp, http.StatusOK)
+
+	var explanation queryExplanation
+	if err := json.NewDecoder(resp.Body).Decode(&explanation); err != nil {
+		t.Fatal(err)
+	}
+
+	if explanation.Query.Filter["vsn"] != "W001" {
+		t.Fatalf("expected normalized query. got %+v", explanation.Query)
+	}
+
+	if explanation.Plan == nil || len(explanation.Plan.Queries) != 2 {
+		t.Fatalf("expected a query for each bucket. got %+v", explanation.Plan)
+	}
+	for i, bucket := range []string{"waggle", "downsampled"} {
+		planned := explanation.Plan.Queries[i]
+		expect, err := buildSortedFluxQuery(bucket, bucketQuery(explanation.Query), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if planned.Bucket != bucket || planned.Flux != expect {
+			t.Fatalf("unexpected planned query %+v", planned)
+		}
+	}
+
+	shape := explanation.Shape
+	if !reflect.DeepEqual(shape.Fields, []string{"timestamp", "name", "value", "aggregation", "meta"}) {
+		t.Fatalf("unexpected fields %v", shape.Fields)
+	}
+	if shape.Windows != 4 || shape.MaxRecordsPerSeries == nil || *shape.MaxRecordsPerSeries != 4 {
+		t.Fatalf("expected 4 windows. got %+v", shape)
+	}
+	if explanation.Cost != nil {
+		t.Fatalf("expected no cost unless requested")
+	}
+}
+
+func TestExplainServiceCost(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	backend := NewMemoryBackend([]*Record{
+		{Timestamp: now.Add(-time.Hour), Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: now.Add(-time.Hour), Name: "env.temperature", Value: 21.0, Meta: map[string]string{"vsn": "W002"}},
+	})
+	backend.Now = func() time.Time { return now }
+	svc := &ExplainService{Backend: backend, Cardinality: backend, Now: func() time.Time { return now }}
+
+	r := httptest.NewRequest("GET", "/?start=-4h&tail=1&pivot=vsn&cost=true", nil)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp := w.Result()
+	assertStatusCode(t, resp, http.StatusOK)
+
+	var explanation queryExplanation
+	if err := json.NewDecoder(resp.Body).Decode(&explanation); err != nil {
+		t.Fatal(err)
+	}
+	if explanation.Plan != nil {
+		t.Fatalf("expected no plan from memory backend")
+	}
+	if explanation.Cost == nil || explanation.Cost.Series != 2 || explanation.Cost.Cost != 8 {
+		t.Fatalf("unexpected cost %+v", explanation.Cost)
+	}
+	shape := explanation.Shape
+	if !reflect.DeepEqual(shape.Fields, []string{"timestamp", "values", "meta"}) {
+		t.Fatalf("unexpected fields %v", shape.Fields)
+	}
+	if shape.MaxRecordsPerSeries == nil || *shape.MaxRecordsPerSeries != 1 {
+		t.Fatalf("expected tail to bound records. got %+v", shape)
+	}
+	if !shape.Start.Equal(now.Add(-4*time.Hour)) || !shape.End.Equal(now) {
+		t.Fatalf("unexpected range %s - %s", shape.Start, shape.End)
+	}
+}
+
+func TestExplainServiceCostRequested(t *testing.T) {
+	cardinality := &failingCardinality{}
+	svc := &ExplainService{Backend: &DummyBackend{}, Cardinality: cardinality}
+
+	testcases := map[string]struct {
+		Method string
+		URL    string
+		Status int
+		Calls  int
+	}{
+		"NotRequested": {"POST", "/", http.StatusOK, 0},
+		"Disabled":     {"POST", "/?cost=false", http.StatusOK, 0},
+		"Requested":    {"POST", "/?cost=true", http.StatusInternalServerError, 1},
+		"GetRequested": {"GET", "/?start=-4h&cost=1", http.StatusInternalServerError, 1},
+		"Invalid":      {"POST", "/?cost=maybe", http.StatusBadRequest, 0},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			cardinality.calls = 0
+			r := httptest.NewRequest(tc.Method, tc.URL, bytes.NewBufferString(`{"start": "-4h"}`))
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			assertStatusCode(t, w.Result(), tc.Status)
+			if cardinality.calls != tc.Calls {
+				t.Fatalf("expected %d cardinality queries. got %d", tc.Calls, cardinality.calls)
+			}
+		})
+	}
+}
+
+func TestExplainResultShapeBounds(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	window := "1h"
+
+	testcases := map[string]struct {
+		Query      *Query
+		PerSeries  *int
+		MaxRecords *int
+	}{
+		"Window":      {&Query{Start: "-4h", Func: StringList{"mean"}, Window: &window}, intptr(4), nil},
+		"Distinct":    {&Query{Start: "-4h", Func: StringList{"distinct"}, Window: &window}, nil, nil},
+		"Limit":       {&Query{Start: "-4h", Limit: intptr(10)}, intptr(10), intptr(10)},
+		"WindowLimit": {&Query{Start: "-4h", Func: StringList{"mean"}, Window: &window, Limit: intptr(2)}, intptr(2), intptr(2)},
+		"TailLimit":   {&Query{Start: "-4h", Tail: intptr(3), Limit: intptr(10)}, intptr(3), intptr(10)},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			shape := explainResultShape(tc.Query, now)
+			if !reflect.DeepEqual(shape.MaxRecordsPerSeries, tc.PerSeries) || !reflect.DeepEqual(shape.MaxRecords, tc.MaxRecords) {
+				t.Fatalf("unexpected bounds %+v", shape)
+			}
+		})
+	}
+}
+
+func TestExplainServiceBadQuery(t *testing.T) {
+	svc := &ExplainService{Backend: &InfluxBackend{Bucket: "waggle"}}
+
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h", "bucket": "_monitoring"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusBadRequest)
+}
+
+func TestWindowCount(t *testing.T) {
+	start := time.Date(2022, 1, 1, 0, 17, 0, 0, time.UTC)
+	for _, end := range []time.Time{start, start.Add(time.Minute), start.Add(time.Hour), start.Add(43 * time.Minute), start.Add(5 * time.Hour)} {
+		for _, every := range []time.Duration{time.Minute, 10 * time.Minute, time.Hour} {
+			if n, expect := windowCount(start, end, every), len(windowBounds(start, end, every)); n != expect {
+				t.Errorf("%s %s: expected %d windows. got %d", end.Sub(start), every, expect, n)
+			}
+		}
+	}
+}
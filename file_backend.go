@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/parquet-go/parquet-go"
+)
+
+// fileBackendDayLayout is the layout of the day in archive file names.
+const fileBackendDayLayout = "2006-01-02"
+
+// FileBackend implements a backend which replays records archived in a directory.
+// Archives hold records in the same form returned by queries and are partitioned
+// by UTC day into files named like 2022-01-02.ndjson, which may be gzipped as
+// 2022-01-02.ndjson.gz, or 2022-01-02.parquet. Parquet archives must have the
+// columns written by the parquet format for records which aren't pivoted.
+//
+// Only files overlapping the query range are read. Queries are evaluated in
+// process by evaluateQuery, so all matching records are held in memory. Queries
+// matching more than MaxRecords records fail instead.
+type FileBackend struct {
+	Dir string
+	// MaxRecords is the max number of records a query may match. Zero disables the limit.
+	MaxRecords int
+	// Now returns the time relative query times are resolved against. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// Query provides the archived records matching a query through Results.
+func (backend *FileBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	now := backend.now()
+	records, err := backend.readRecords(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	records, err = evaluateQuery(records, query, now)
+	if err != nil {
+		return nil, err
+	}
+	return &recordResults{records: records}, nil
+}
+
+// Latest provides the most recent archived record of each series through Results.
+func (backend *FileBackend) Latest(ctx context.Context, query *Query) (Results, error) {
+	if err := validateLatestQuery(query); err != nil {
+		return nil, err
+	}
+	records, err := backend.readRecords(ctx, query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return &recordResults{records: latestRecords(records)}, nil
+}
+
+// Names lists the names of the archived records matching a query.
+func (backend *FileBackend) Names(ctx context.Context, query *Query) ([]string, error) {
+	records, err := backend.readRecords(ctx, query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return distinctNames(records), nil
+}
+
+// MetaKeys lists the meta keys of the archived records matching a query.
+func (backend *FileBackend) MetaKeys(ctx context.Context, query *Query) ([]string, error) {
+	records, err := backend.readRecords(ctx, query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return distinctMetaKeys(records), nil
+}
+
+// MetaValues lists the values of a meta key in the archived records matching a query.
+func (backend *FileBackend) MetaValues(ctx context.Context, query *Query, key string) ([]string, error) {
+	records, err := backend.readRecords(ctx, query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return distinctMetaValues(records, key), nil
+}
+
+func (backend *FileBackend) now() time.Time {
+	if backend.Now != nil {
+		return backend.Now()
+	}
+	return time.Now()
+}
+
+// readRecords reads the archived records in the range of a query which match
+// its filters.
+func (backend *FileBackend) readRecords(ctx context.Context, query *Query, now time.Time) ([]*Record, error) {
+	if query.Bucket != nil || query.Buckets != nil {
+		return nil, fmt.Errorf("bucket is not supported by file backend")
+	}
+	start, end, err := resolveQueryRange(query, now)
+	if err != nil {
+		return nil, err
+	}
+	matcher, err := newQueryMatcher(query)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := backend.archiveFiles(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		err := readArchiveFile(path, func(rec *Record) error {
+			if rec.Timestamp.Before(start) || !rec.Timestamp.Before(end) {
+				return nil
+			}
+			if !matcher.match(rec.Name, rec.Meta, rec.Value) {
+				return nil
+			}
+			if backend.MaxRecords > 0 && len(records) >= backend.MaxRecords {
+				return fmt.Errorf("query matches more than %d archived records", backend.MaxRecords)
+			}
+			records = append(records, rec)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// archiveFiles returns the paths of the archive files for days overlapping a range.
+func (backend *FileBackend) archiveFiles(start, end time.Time) ([]string, error) {
+	entries, err := os.ReadDir(backend.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		day, ok := cutArchiveSuffix(name)
+		if entry.IsDir() || !ok {
+			continue
+		}
+		t, err := time.Parse(fileBackendDayLayout, day)
+		if err != nil {
+			continue
+		}
+		if !t.Add(24*time.Hour).After(start) || !t.Before(end) {
+			continue
+		}
+		paths = append(paths, filepath.Join(backend.Dir, name))
+	}
+	return paths, nil
+}
+
+// cutArchiveSuffix returns an archive file name without its suffix.
+func cutArchiveSuffix(name string) (string, bool) {
+	for _, suffix := range []string{".ndjson", ".ndjson.gz", ".parquet"} {
+		if day, ok := strings.CutSuffix(name, suffix); ok {
+			return day, true
+		}
+	}
+	return "", false
+}
+
+// readArchiveFile calls fn for each record in an archive file. It stops at the
+// first error returned by fn.
+func readArchiveFile(path string, fn func(*Record) error) error {
+	if strings.HasSuffix(path, ".parquet") {
+		return readParquetArchiveFile(path, fn)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	decoder := json.NewDecoder(r)
+	for {
+		rec := &Record{}
+		if err := decoder.Decode(rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if rec.Meta == nil {
+			rec.Meta = make(map[string]string)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// readParquetArchiveFile calls fn for each record in a Parquet archive file.
+// Columns other than timestamp, name, aggregation and the value columns are
+// read as meta.
+func readParquetArchiveFile(path string, fn func(*Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	file, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var columns []string
+	for _, field := range file.Schema().Fields() {
+		columns = append(columns, field.Name())
+	}
+	if !slices.Contains(columns, "timestamp") || !slices.Contains(columns, "name") {
+		return fmt.Errorf("failed to read %s: missing timestamp or name column", path)
+	}
+
+	reader := parquet.NewReader(file)
+	defer reader.Close()
+
+	rows := make([]parquet.Row, 1024)
+	for {
+		n, err := reader.ReadRows(rows)
+		for _, row := range rows[:n] {
+			rec := &Record{Meta: make(map[string]string)}
+			for _, v := range row {
+				if v.IsNull() {
+					continue
+				}
+				switch column := columns[v.Column()]; column {
+				case "timestamp":
+					rec.Timestamp = time.Unix(0, v.Int64()).UTC()
+				case "name":
+					rec.Name = string(v.ByteArray())
+				case "aggregation":
+					rec.Aggregation = string(v.ByteArray())
+				case "value_double":
+					rec.Value = v.Double()
+				case "value_int":
+					rec.Value = v.Int64()
+				case "value_string":
+					rec.Value = string(v.ByteArray())
+				case "value_bool":
+					rec.Value = v.Boolean()
+				default:
+					rec.Meta[column] = string(v.ByteArray())
+				}
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+}
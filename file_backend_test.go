@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+func writeArchiveFile(t *testing.T, path string, data string) {
+	t.Helper()
+	var b bytes.Buffer
+	if filepath.Ext(path) == ".gz" {
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(data))
+		zw.Close()
+	} else {
+		b.WriteString(data)
+	}
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileBackend(t *testing.T) {
+	dir := t.TempDir()
+
+	writeArchiveFile(t, filepath.Join(dir, "2022-01-01.ndjson"), `{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":20,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:05:00Z","name":"env.temperature","value":22,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:10:00Z","name":"env.temperature","value":24,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":18,"meta":{"vsn":"W002"}}
+{"timestamp":"2022-01-01T10:00:00Z","name":"env.humidity","value":40,"meta":{"vsn":"W001"}}
+`)
+	writeArchiveFile(t, filepath.Join(dir, "2022-01-02.ndjson.gz"), `{"timestamp":"2022-01-02T00:00:00Z","name":"env.temperature","value":26,"meta":{"vsn":"W001"}}
+`)
+	// files which aren't archives are ignored
+	writeArchiveFile(t, filepath.Join(dir, "README"), "not an archive")
+
+	now := time.Date(2022, 1, 2, 12, 0, 0, 0, time.UTC)
+
+	svc := NewService(&ServiceConfig{
+		Backend: &FileBackend{Dir: dir, Now: func() time.Time { return now }},
+	})
+
+	testcases := map[string]struct {
+		body   string
+		status int
+		resp   string
+	}{
+		"Range": {`{"start": "2022-01-01T10:05:00Z", "end": "2022-01-02T00:00:00Z", "filter": {"name": "env.temperature"}}`, http.StatusOK,
+			`{"timestamp":"2022-01-01T10:05:00Z","name":"env.temperature","value":22,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:10:00Z","name":"env.temperature","value":24,"meta":{"vsn":"W001"}}
+`},
+		"RelativeStart": {`{"start": "-13h"}`, http.StatusOK,
+			`{"timestamp":"2022-01-02T00:00:00Z","name":"env.temperature","value":26,"meta":{"vsn":"W001"}}
+`},
+		"Tail": {`{"start": "2022-01-01T00:00:00Z", "tail": 1, "filter": {"name": "env.temperature"}}`, http.StatusOK,
+			`{"timestamp":"2022-01-02T00:00:00Z","name":"env.temperature","value":26,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":18,"meta":{"vsn":"W002"}}
+`},
+		"Limit": {`{"start": "2022-01-01T00:00:00Z", "limit": 2}`, http.StatusOK,
+			`{"timestamp":"2022-01-01T10:00:00Z","name":"env.humidity","value":40,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":20,"meta":{"vsn":"W001"}}
+`},
+		"Mean": {`{"start": "2022-01-01T00:00:00Z", "end": "2022-01-02T00:00:00Z", "experimental_func": "mean", "filter": {"name": "env.temperature"}}`, http.StatusOK,
+			`{"timestamp":"2022-01-01T00:00:00Z","name":"env.temperature","value":22,"aggregation":"mean","meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T00:00:00Z","name":"env.temperature","value":18,"aggregation":"mean","meta":{"vsn":"W002"}}
+`},
+		"Selector": {`{"start": "2022-01-01T00:00:00Z", "experimental_func": "max", "filter": {"name": "env.temperature", "vsn": "W001"}}`, http.StatusOK,
+			`{"timestamp":"2022-01-02T00:00:00Z","name":"env.temperature","value":26,"aggregation":"max","meta":{"vsn":"W001"}}
+`},
+		"Window": {`{"start": "2022-01-01T10:00:00Z", "end": "2022-01-01T10:20:00Z", "experimental_func": "first", "experimental_window": "5m", "filter": {"name": "env.temperature", "vsn": "W001"}}`, http.StatusOK,
+			`{"timestamp":"2022-01-01T10:05:00Z","name":"env.temperature","value":20,"aggregation":"first","meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:10:00Z","name":"env.temperature","value":22,"aggregation":"first","meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:15:00Z","name":"env.temperature","value":24,"aggregation":"first","meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:20:00Z","name":"env.temperature","value":null,"aggregation":"first","meta":{"vsn":"W001"}}
+`},
+		"GroupBy": {`{"start": "2022-01-01T00:00:00Z", "experimental_func": ["count", "p50"], "group_by": [], "filter": {"name": "env.temperature"}}`, http.StatusOK,
+			`{"timestamp":"2022-01-01T00:00:00Z","name":"env.temperature","value":5,"aggregation":"count","meta":{}}
+{"timestamp":"2022-01-01T00:00:00Z","name":"env.temperature","value":22,"aggregation":"p50","meta":{}}
+`},
+		"Pivot": {`{"start": "2022-01-01T00:00:00Z", "end": "2022-01-01T10:05:00Z", "pivot": {"by": ["vsn"]}}`, http.StatusOK,
+			`{"timestamp":"2022-01-01T10:00:00Z","values":{"env.humidity":40,"env.temperature":20},"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:00:00Z","values":{"env.temperature":18},"meta":{"vsn":"W002"}}
+`},
+		"UnsupportedStart": {`{"start": "-1mo"}`, http.StatusInternalServerError,
+			"error: failed to query backend: unsupported start time \"-1mo\"\n"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/query", bytes.NewBufferString(tc.body))
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			resp := w.Result()
+			assertStatusCode(t, resp, tc.status)
+			assertReadBody(t, resp, []byte(tc.resp))
+		})
+	}
+}
+
+func TestWindowBounds(t *testing.T) {
+	start := time.Date(2022, 1, 1, 10, 2, 0, 0, time.UTC)
+	end := time.Date(2022, 1, 1, 10, 12, 0, 0, time.UTC)
+
+	windows := windowBounds(start, end, 5*time.Minute)
+
+	want := [][2]time.Time{
+		{start, time.Date(2022, 1, 1, 10, 5, 0, 0, time.UTC)},
+		{time.Date(2022, 1, 1, 10, 5, 0, 0, time.UTC), time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC)},
+		{time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC), end},
+	}
+
+	if len(windows) != len(want) {
+		t.Fatalf("expected %d windows. got %d", len(want), len(windows))
+	}
+	for i := range want {
+		if !windows[i][0].Equal(want[i][0]) || !windows[i][1].Equal(want[i][1]) {
+			t.Errorf("window %d: expected %v. got %v", i, want[i], windows[i])
+		}
+	}
+}
+
+func TestFileBackendParquet(t *testing.T) {
+	dir := t.TempDir()
+
+	records := []*Record{
+		{Timestamp: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC), Name: "env.temperature", Value: 20.5, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: time.Date(2022, 1, 1, 10, 5, 0, 0, time.UTC), Name: "sys.uptime", Value: int64(1234), Meta: map[string]string{"vsn": "W002"}},
+		{Timestamp: time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC), Name: "upload", Value: "sample.jpg", Meta: map[string]string{"vsn": "W001", "camera": "top"}},
+	}
+	var b bytes.Buffer
+	w := newParquetWriter(&b)
+	for _, rec := range records {
+		if err := w.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "2022-01-01.parquet"), b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &FileBackend{Dir: dir}
+	results, err := backend.Query(context.Background(), &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-02T00:00:00Z", Limit: intptr(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readAllRecords(t, results)
+	if len(got) != len(records) {
+		t.Fatalf("expected %d records. got %d", len(records), len(got))
+	}
+	for i := range records {
+		if !got[i].Timestamp.Equal(records[i].Timestamp) || got[i].Name != records[i].Name || got[i].Value != records[i].Value || !reflect.DeepEqual(got[i].Meta, records[i].Meta) {
+			t.Errorf("record %d: expected %v. got %v", i, records[i], got[i])
+		}
+	}
+}
+
+func TestFileBackendMaxRecords(t *testing.T) {
+	dir := t.TempDir()
+	writeArchiveFile(t, filepath.Join(dir, "2022-01-01.ndjson"), `{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":20,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:05:00Z","name":"env.temperature","value":22,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:10:00Z","name":"env.humidity","value":40,"meta":{"vsn":"W001"}}
+`)
+
+	backend := &FileBackend{Dir: dir, MaxRecords: 2}
+	query := &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-02T00:00:00Z"}
+
+	if _, err := backend.Query(context.Background(), query); err == nil {
+		t.Fatalf("expected error for query matching more than max records")
+	}
+	// records which don't match don't count
+	query.Filter = map[string]string{"name": "env.temperature"}
+	if _, err := backend.Query(context.Background(), query); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// filterOp is the kind of comparison made by a filterTerm.
+type filterOp int
+
+const (
+	// filterEqual matches a key equal to a value.
+	filterEqual filterOp = iota
+	// filterMatch matches a key matching a pattern.
+	filterMatch
+	// filterExists matches records which have the key.
+	filterExists
+)
+
+// filterTerm is a single parsed entry of a query filter. Filter values use the
+// following syntax:
+//
+//	value         key equals value
+//	env.*, a|b    key matches the whole glob pattern. * and .* match any text, .
+//	              matches any character and | separates alternatives. all
+//	              other characters are literal.
+//	re:pattern    key contains a match of the regular expression pattern
+//	*             key exists
+//	!value, !env.*, !re:pattern
+//	              key doesn't match or is missing
+//	!*            key is missing
+type filterTerm struct {
+	Key    string
+	Op     filterOp
+	Negate bool
+	// Value holds the value for filterEqual or the regular expression for filterMatch.
+	Value string
+	re    *regexp.Regexp
+}
+
+// filterRegexPrefix marks a filter value as a regular expression.
+const filterRegexPrefix = "re:"
+
+// parseFilter parses a query filter into a list of terms sorted by key.
+func parseFilter(filter map[string]string) ([]*filterTerm, error) {
+	terms := make([]*filterTerm, 0, len(filter))
+	for _, k := range sortedKeys(filter) {
+		term, err := parseFilterTerm(k, filter[k])
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+func parseFilterTerm(key, value string) (*filterTerm, error) {
+	term := &filterTerm{Key: key}
+
+	pattern := value
+	if strings.HasPrefix(pattern, "!") {
+		term.Negate = true
+		pattern = pattern[1:]
+	}
+
+	switch {
+	case pattern == "*":
+		term.Op = filterExists
+		return term, nil
+	case strings.HasPrefix(pattern, filterRegexPrefix):
+		term.Op = filterMatch
+		term.Value = strings.TrimPrefix(pattern, filterRegexPrefix)
+		// check the syntax up front, so errors describe the problem with the pattern
+		if _, err := syntax.Parse(term.Value, syntax.Perl); err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %q for key %q: %s", value, key, err.Error())
+		}
+	case strings.ContainsAny(pattern, "*|"):
+		term.Op = filterMatch
+		term.Value = globToRegexp(pattern)
+	default:
+		term.Op = filterEqual
+		term.Value = pattern
+		return term, nil
+	}
+
+	re, err := regexp.Compile(term.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter pattern %q for key %q: %s", value, key, err.Error())
+	}
+	term.re = re
+	return term, nil
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression. Only *,
+// . and | have special meaning. All other characters are matched literally. The
+// dot keeps its regular expression meaning, so existing patterns like env.* and
+// waggle/plugin-iio.* match the same values as before.
+func globToRegexp(pattern string) string {
+	alternatives := strings.Split(pattern, "|")
+	for i, alt := range alternatives {
+		var b strings.Builder
+		for _, c := range alt {
+			switch c {
+			case '*':
+				// .* is already a wildcard
+				if !strings.HasSuffix(b.String(), ".") {
+					b.WriteByte('.')
+				}
+				b.WriteByte('*')
+			case '.':
+				b.WriteByte('.')
+			default:
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		alternatives[i] = b.String()
+	}
+	if len(alternatives) == 1 {
+		return "^" + alternatives[0] + "$"
+	}
+	return "^(" + strings.Join(alternatives, "|") + ")$"
+}
+
+// match reports whether a record with the given name and meta matches the term.
+// The key "name" refers to the record name.
+func (term *filterTerm) match(name string, meta map[string]string) bool {
+	var v string
+	var ok bool
+	if term.Key == "name" {
+		v, ok = name, true
+	} else {
+		v, ok = meta[term.Key]
+	}
+
+	if !ok {
+		// negated terms are also satisfied by missing keys
+		return term.Negate
+	}
+
+	switch term.Op {
+	case filterEqual:
+		return (v == term.Value) != term.Negate
+	case filterMatch:
+		return term.re.MatchString(v) != term.Negate
+	}
+	return !term.Negate
+}
+
+// fluxPredicate builds the Flux predicate expression equivalent to match.
+func (term *filterTerm) fluxPredicate() string {
+	field := term.Key
+	if s, ok := fieldRenameMap[field]; ok {
+		field = s
+	}
+
+	var expr string
+	switch term.Op {
+	case filterExists:
+		if term.Negate {
+			return fmt.Sprintf("not exists r.%s", field)
+		}
+		return fmt.Sprintf("exists r.%s", field)
+	case filterMatch:
+		op := "=~"
+		if term.Negate {
+			op = "!~"
+		}
+		expr = fmt.Sprintf("r.%s %s /%s/", field, op, escapeFluxRegex(term.Value))
+	default:
+		op := "=="
+		if term.Negate {
+			op = "!="
+		}
+		expr = fmt.Sprintf("r.%s %s %s", field, op, quoteFluxString(term.Value))
+	}
+
+	if term.Negate {
+		return fmt.Sprintf("(not exists r.%s or %s)", field, expr)
+	}
+	return expr
+}
+
+// matchFilter reports whether a record with the given name and meta matches all filter terms.
+func matchFilter(terms []*filterTerm, name string, meta map[string]string) bool {
+	for _, term := range terms {
+		if !term.match(name, meta) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterNode is a parsed FilterExpr.
+type filterNode struct {
+	// op is one of and, or, not or empty for a leaf matching all terms.
+	op       string
+	children []*filterNode
+	terms    []*filterTerm
+}
+
+func parseFilterExpr(e *FilterExpr) (*filterNode, error) {
+	if e == nil {
+		return nil, fmt.Errorf("filter expression must be an object")
+	}
+
+	switch {
+	case e.And != nil:
+		return parseFilterExprList("and", e.And)
+	case e.Or != nil:
+		return parseFilterExprList("or", e.Or)
+	case e.Not != nil:
+		child, err := parseFilterExpr(e.Not)
+		if err != nil {
+			return nil, err
+		}
+		return &filterNode{op: "not", children: []*filterNode{child}}, nil
+	}
+
+	for k := range e.Match {
+		if !metaRE.MatchString(k) {
+			return nil, fmt.Errorf("invalid filter key: %q", k)
+		}
+	}
+	terms, err := parseFilter(e.Match)
+	if err != nil {
+		return nil, err
+	}
+	return &filterNode{terms: terms}, nil
+}
+
+func parseFilterExprList(op string, exprs []*FilterExpr) (*filterNode, error) {
+	if len(exprs) == 0 {
+		return nil, fmt.Errorf("%s requires at least one filter expression", op)
+	}
+	node := &filterNode{op: op}
+	for _, e := range exprs {
+		child, err := parseFilterExpr(e)
+		if err != nil {
+			return nil, err
+		}
+		node.children = append(node.children, child)
+	}
+	return node, nil
+}
+
+// match reports whether a record with the given name and meta matches the expression.
+func (node *filterNode) match(name string, meta map[string]string) bool {
+	switch node.op {
+	case "and":
+		for _, child := range node.children {
+			if !child.match(name, meta) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, child := range node.children {
+			if child.match(name, meta) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !node.children[0].match(name, meta)
+	}
+	return matchFilter(node.terms, name, meta)
+}
+
+// fluxPredicate builds the Flux predicate expression equivalent to match.
+func (node *filterNode) fluxPredicate() string {
+	var parts []string
+
+	switch node.op {
+	case "not":
+		p := node.children[0].fluxPredicate()
+		if !strings.HasPrefix(p, "(") {
+			p = "(" + p + ")"
+		}
+		return "not " + p
+	case "and", "or":
+		for _, child := range node.children {
+			parts = append(parts, child.fluxPredicate())
+		}
+	default:
+		if len(node.terms) == 0 {
+			return "true"
+		}
+		for _, term := range node.terms {
+			parts = append(parts, term.fluxPredicate())
+		}
+	}
+
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	op := node.op
+	if op == "" {
+		op = "and"
+	}
+	return "(" + strings.Join(parts, " "+op+" ") + ")"
+}
+
+// queryMatcher evaluates the filter, filter_expr and value_filter fields of a
+// query in-process, for backends and services which can't push them down.
+type queryMatcher struct {
+	terms       []*filterTerm
+	expr        *filterNode
+	valueFilter *valueFilter
+}
+
+func newQueryMatcher(query *Query) (*queryMatcher, error) {
+	m := &queryMatcher{}
+	var err error
+
+	m.terms, err = parseFilter(query.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if query.FilterExpr != nil {
+		m.expr, err = parseFilterExpr(query.FilterExpr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if query.ValueFilter != "" {
+		m.valueFilter, err = parseValueFilter(query.ValueFilter)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// match reports whether a record with the given name, meta and value matches the query.
+func (m *queryMatcher) match(name string, meta map[string]string, value interface{}) bool {
+	if !matchFilter(m.terms, name, meta) {
+		return false
+	}
+	if m.expr != nil && !m.expr.match(name, meta) {
+		return false
+	}
+	if m.valueFilter != nil && !m.valueFilter.match(value) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	meta := map[string]string{
+		"node":   "000048b02d15bc7c",
+		"plugin": "waggle/plugin-iio:0.4.5",
+		"vsn":    "W001",
+	}
+
+	testcases := map[string]struct {
+		Filter map[string]string
+		Match  bool
+	}{
+		"Empty":           {map[string]string{}, true},
+		"Equal":           {map[string]string{"vsn": "W001"}, true},
+		"EqualMismatch":   {map[string]string{"vsn": "W002"}, false},
+		"Glob":            {map[string]string{"plugin": "waggle/plugin-iio.*"}, true},
+		"GlobStar":        {map[string]string{"plugin": "waggle/plugin-iio*"}, true},
+		"GlobDot":         {map[string]string{"name": "env.temp.*"}, true},
+		"GlobAnchored":    {map[string]string{"plugin": "plugin-iio.*"}, false},
+		"GlobLiteral":     {map[string]string{"vsn": "W00?|W00[1]"}, false},
+		"Regex":           {map[string]string{"plugin": "re:iio:0\\.[0-9]"}, true},
+		"RegexMismatch":   {map[string]string{"plugin": "re:^iio"}, false},
+		"NotRegex":        {map[string]string{"plugin": "!re:test"}, true},
+		"Alternation":     {map[string]string{"vsn": "W002|W001"}, true},
+		"Name":            {map[string]string{"name": "env.temperature"}, true},
+		"NotEqual":        {map[string]string{"vsn": "!W002"}, true},
+		"NotEqualMatches": {map[string]string{"vsn": "!W001"}, false},
+		"NotEqualMissing": {map[string]string{"sensor": "!bme680"}, true},
+		"NotMatch":        {map[string]string{"plugin": "!.*:test.*"}, true},
+		"NotMatchMatches": {map[string]string{"plugin": "!.*iio.*"}, false},
+		"NotName":         {map[string]string{"name": "!env.*"}, false},
+		"Exists":          {map[string]string{"node": "*"}, true},
+		"ExistsMissing":   {map[string]string{"sensor": "*"}, false},
+		"Missing":         {map[string]string{"sensor": "!*"}, true},
+		"MissingExists":   {map[string]string{"node": "!*"}, false},
+		"EqualMissingKey": {map[string]string{"sensor": "bme680"}, false},
+		"Combined":        {map[string]string{"vsn": "W001", "sensor": "!*", "plugin": "!.*:test.*"}, true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			terms, err := parseFilter(tc.Filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match := matchFilter(terms, "env.temperature", meta); match != tc.Match {
+				t.Fatalf("expected match %v. got %v", tc.Match, match)
+			}
+			matcher, err := newQueryMatcher(&Query{Filter: tc.Filter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := &Message{Name: "env.temperature", Meta: meta}
+			if match := matchMessage(matcher, msg); match != tc.Match {
+				t.Fatalf("expected message match %v. got %v", tc.Match, match)
+			}
+		})
+	}
+}
+
+func TestParseStreamQuery(t *testing.T) {
+	msg := &Message{
+		Name: "env.temperature",
+		Meta: map[string]string{"node": "000048b02d15bc7c", "plugin": "waggle/plugin-iio:0.4.5", "vsn": "W001"},
+	}
+
+	testcases := map[string]struct {
+		Values string
+		Topics []string
+		Match  bool
+	}{
+		"Empty":       {"", []string{"#"}, true},
+		"Substring":   {"plugin=plugin-iio", []string{"#"}, true},
+		"Regex":       {"plugin=iio:0%5C.4%5C.[0-9]$", []string{"#"}, true},
+		"Mismatch":    {"plugin=plugin-raingauge", []string{"#"}, false},
+		"Lowercase":   {"vsn=w001", []string{"#"}, true},
+		"NotMatch":    {"plugin=!test", []string{"#"}, true},
+		"NotMatches":  {"plugin=!iio", []string{"#"}, false},
+		"Exists":      {"node=*", []string{"#"}, true},
+		"Missing":     {"sensor=!*", []string{"#"}, true},
+		"NameTopics":  {"name=env.*|sys.uptime", []string{"env.*", "sys.uptime"}, true},
+		"NotName":     {"name=!env", []string{"#"}, false},
+		"RegexName":   {"name=re:temp", []string{"#"}, true},
+		"ValueFilter": {"value_filter=%3E40", []string{"#"}, false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			values, err := url.ParseQuery(tc.Values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query, topics, err := parseStreamQuery(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(topics, tc.Topics) {
+				t.Fatalf("expected topics %v. got %v", tc.Topics, topics)
+			}
+			matcher, err := newQueryMatcher(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match := matchMessage(matcher, msg); match != tc.Match {
+				t.Fatalf("expected message match %v. got %v", tc.Match, match)
+			}
+		})
+	}
+
+	if _, _, err := parseStreamQuery(url.Values{"vsn": {"W0(1"}}); err == nil {
+		t.Fatalf("expected error for invalid pattern")
+	}
+}
+
+func TestFilterInvalidPattern(t *testing.T) {
+	if _, err := parseFilter(map[string]string{"vsn": "re:W0(1|2"}); err == nil {
+		t.Fatal("expected error for invalid pattern")
+	}
+}
+
+func TestFilterExpr(t *testing.T) {
+	meta := map[string]string{
+		"plugin": "waggle/plugin-iio:0.4.5",
+		"vsn":    "W01B",
+	}
+
+	testcases := map[string]struct {
+		Expr  string
+		Match bool
+		Flux  string
+	}{
+		"Leaf": {
+			`{"vsn": "W01B", "plugin": "*iio*"}`,
+			true,
+			`(r.plugin =~ /^.*iio.*$/ and r.vsn == "W01B")`,
+		},
+		"Or": {
+			`{"or": [{"vsn": "W01C"}, {"plugin": "*iio*"}]}`,
+			true,
+			`(r.vsn == "W01C" or r.plugin =~ /^.*iio.*$/)`,
+		},
+		"OrNoMatch": {
+			`{"or": [{"vsn": "W01C"}, {"name": "sys.*"}]}`,
+			false,
+			`(r.vsn == "W01C" or r._measurement =~ /^sys.*$/)`,
+		},
+		"And": {
+			`{"and": [{"vsn": "W01B"}, {"or": [{"name": "env.*"}, {"sensor": "*"}]}]}`,
+			true,
+			`(r.vsn == "W01B" and (r._measurement =~ /^env.*$/ or exists r.sensor))`,
+		},
+		"Not": {
+			`{"not": {"vsn": "W01B"}}`,
+			false,
+			`not (r.vsn == "W01B")`,
+		},
+		"NotOr": {
+			`{"not": {"or": [{"vsn": "W01C"}, {"vsn": "W01D"}]}}`,
+			true,
+			`not (r.vsn == "W01C" or r.vsn == "W01D")`,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			var e FilterExpr
+			if err := json.Unmarshal([]byte(tc.Expr), &e); err != nil {
+				t.Fatal(err)
+			}
+			node, err := parseFilterExpr(&e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match := node.match("env.temperature", meta); match != tc.Match {
+				t.Fatalf("expected match %v. got %v", tc.Match, match)
+			}
+			if s := node.fluxPredicate(); s != tc.Flux {
+				t.Fatalf("flux predicate mismatch\nexpect: %s\noutput: %s", tc.Flux, s)
+			}
+			// expression should survive a round trip through json
+			b, err := json.Marshal(&e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var e2 FilterExpr
+			if err := json.Unmarshal(b, &e2); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(e, e2) {
+				t.Fatalf("round trip mismatch: %s", b)
+			}
+		})
+	}
+}
+
+func TestFilterExprInvalid(t *testing.T) {
+	testcases := []string{
+		`[]`,
+		`{"or": []}`,
+		`{"or": {"vsn": "W01B"}}`,
+		`{"and": [null]}`,
+		`{"not": null}`,
+		`{"vsn": 1}`,
+		`{"meta.vsn": "W01B"}`,
+		`{"vsn": "re:("}`,
+	}
+
+	for _, s := range testcases {
+		var e FilterExpr
+		if err := json.Unmarshal([]byte(s), &e); err != nil {
+			continue
+		}
+		if _, err := parseFilterExpr(&e); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
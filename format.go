@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordWriter writes a stream of records in a particular output format. Close
+// must be called after the last record to flush any buffered output.
+type recordWriter interface {
+	WriteRecord(*Record) error
+	Close() error
+}
+
+// columnWriter is implemented by recordWriters which must fix their columns
+// before writing records. SetColumns adds the meta and value keys expected in
+// the results to the columns found in the first records, so keys which first
+// appear later still get a column.
+type columnWriter interface {
+	SetColumns(metaKeys, valueKeys []string)
+}
+
+// queryColumns lists the meta and value keys expected in the results of a query.
+// Pivoted results are keyed by the pivot keys and measurement names and grouped
+// aggregations only keep the group_by keys. An empty group_by is a global
+// aggregation with no meta keys.
+func queryColumns(ctx context.Context, metadata MetadataBackend, query *Query) ([]string, []string, error) {
+	if query.Pivot != nil {
+		names, err := metadata.Names(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		return query.Pivot.By, names, nil
+	}
+	if len(query.Func) > 0 && query.GroupBy != nil {
+		return query.GroupBy, nil, nil
+	}
+	metaKeys, err := metadata.MetaKeys(ctx, query)
+	return metaKeys, nil, err
+}
+
+// outputFormat describes a supported output format for query results.
+type outputFormat struct {
+	Name        string
+	ContentType string
+	Extension   string
+	NewWriter   func(w io.Writer) recordWriter
+	// Compressed is true for formats which are already compressed.
+	Compressed bool
+}
+
+var defaultOutputFormat = outputFormats["ndjson"]
+
+var outputFormats = map[string]*outputFormat{
+	"ndjson": {
+		Name:        "ndjson",
+		ContentType: "application/x-ndjson",
+		Extension:   "ndjson",
+		NewWriter:   newNDJSONWriter,
+	},
+	"csv": {
+		Name:        "csv",
+		ContentType: "text/csv",
+		Extension:   "csv",
+		NewWriter:   newCSVWriter,
+	},
+	"parquet": {
+		Name:        "parquet",
+		ContentType: "application/vnd.apache.parquet",
+		Extension:   "parquet",
+		NewWriter:   newParquetWriter,
+		Compressed:  true,
+	},
+}
+
+// negotiateOutputFormat picks the output format for a request. An explicit format
+// in the query takes precedence over the Accept header. Requests which don't
+// accept any supported format get the default format.
+func negotiateOutputFormat(r *http.Request, query *Query) (*outputFormat, error) {
+	if query.Format != "" {
+		format, ok := outputFormats[query.Format]
+		if !ok {
+			return nil, fmt.Errorf("unsupported format %q", query.Format)
+		}
+		return format, nil
+	}
+
+	for _, accept := range parseAcceptHeader(r.Header.Get("Accept")) {
+		if accept.q == 0 {
+			break
+		}
+		for _, format := range outputFormats {
+			if format.ContentType == accept.value {
+				return format, nil
+			}
+		}
+	}
+
+	return defaultOutputFormat, nil
+}
+
+// acceptValue is a value listed in an Accept or Accept-Encoding header with
+// its q value.
+type acceptValue struct {
+	value string
+	q     float64
+}
+
+// parseAcceptHeader returns the values listed in an Accept header ordered by
+// preference. Values with q=0 are kept, last, as they exclude a value matched
+// by a wildcard.
+func parseAcceptHeader(s string) []acceptValue {
+	var values []acceptValue
+
+	for _, part := range strings.Split(s, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		values = append(values, acceptValue{mediaType, max(q, 0)})
+	}
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].q > values[j].q
+	})
+	return values
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) recordWriter {
+	return &ndjsonWriter{encoder: json.NewEncoder(w)}
+}
+
+func (w *ndjsonWriter) WriteRecord(rec *Record) error {
+	return w.encoder.Encode(rec)
+}
+
+func (w *ndjsonWriter) Close() error {
+	return nil
+}
+
+// csvHeaderSampleSize is the number of records buffered by the CSV writer to
+// determine the meta columns before the header is written.
+const csvHeaderSampleSize = 1000
+
+// csvWriter writes records as CSV with the columns timestamp, name, value followed
+// by one column per meta key in sorted order. Pivoted records are instead written
+// with the columns timestamp, one column per meta key and one column per
+// measurement name. Aggregated records have an additional aggregation column
+// following the value.
+//
+// Since the header must be written before any rows, the columns are taken from
+// the first csvHeaderSampleSize records and any set by SetColumns. Records with
+// keys which first appear after that fail with an error, as they can't be written
+// without losing data.
+type csvWriter struct {
+	w            *csv.Writer
+	sample       []*Record
+	wide         bool
+	agg          bool
+	metaKeys     []string
+	valueKeys    []string
+	header       bool
+	expectMeta   []string
+	expectValues []string
+}
+
+func newCSVWriter(w io.Writer) recordWriter {
+	return &csvWriter{w: csv.NewWriter(w)}
+}
+
+func (w *csvWriter) SetColumns(metaKeys, valueKeys []string) {
+	w.expectMeta = metaKeys
+	w.expectValues = valueKeys
+}
+
+func (w *csvWriter) WriteRecord(rec *Record) error {
+	if !w.header {
+		w.sample = append(w.sample, rec)
+		if len(w.sample) < csvHeaderSampleSize {
+			return nil
+		}
+		return w.writeSample()
+	}
+	return w.writeRow(rec)
+}
+
+func (w *csvWriter) Close() error {
+	if !w.header {
+		if err := w.writeSample(); err != nil {
+			return err
+		}
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *csvWriter) writeSample() error {
+	metaKeys := make(map[string]bool)
+	valueKeys := make(map[string]bool)
+	for _, k := range w.expectMeta {
+		metaKeys[k] = true
+	}
+	for _, k := range w.expectValues {
+		valueKeys[k] = true
+	}
+	for _, rec := range w.sample {
+		for k := range rec.Meta {
+			metaKeys[k] = true
+		}
+		for k := range rec.Values {
+			valueKeys[k] = true
+		}
+	}
+	w.wide = len(w.sample) > 0 && w.sample[0].Values != nil
+	w.agg = len(w.sample) > 0 && w.sample[0].Aggregation != ""
+	w.metaKeys = sortedKeys(metaKeys)
+	w.valueKeys = sortedKeys(valueKeys)
+
+	header := []string{"timestamp"}
+	if !w.wide {
+		header = append(header, "name", "value")
+	}
+	if w.agg {
+		header = append(header, "aggregation")
+	}
+	header = append(header, w.metaKeys...)
+	header = append(header, w.valueKeys...)
+	if err := w.w.Write(header); err != nil {
+		return err
+	}
+	w.header = true
+
+	for _, rec := range w.sample {
+		if err := w.writeRow(rec); err != nil {
+			return err
+		}
+	}
+	w.sample = nil
+	return nil
+}
+
+func (w *csvWriter) writeRow(rec *Record) error {
+	if k, ok := missingKey(w.metaKeys, rec.Meta); ok {
+		return fmt.Errorf("meta key %q first appeared after the csv header was written", k)
+	}
+	if k, ok := missingKey(w.valueKeys, rec.Values); ok {
+		return fmt.Errorf("name %q first appeared after the csv header was written", k)
+	}
+
+	row := make([]string, 0, 4+len(w.metaKeys)+len(w.valueKeys))
+	row = append(row, rec.Timestamp.Format(time.RFC3339Nano))
+	if !w.wide {
+		row = append(row, rec.Name, formatCSVValue(rec.Value))
+	}
+	if w.agg {
+		row = append(row, rec.Aggregation)
+	}
+	for _, k := range w.metaKeys {
+		row = append(row, rec.Meta[k])
+	}
+	for _, k := range w.valueKeys {
+		row = append(row, formatCSVValue(rec.Values[k]))
+	}
+	return w.w.Write(row)
+}
+
+// missingKey returns a key of m which is missing from the sorted column keys.
+func missingKey[V any](keys []string, m map[string]V) (string, bool) {
+	for k := range m {
+		i := sort.SearchStrings(keys, k)
+		if i == len(keys) || keys[i] != k {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+func formatCSVValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// toFloat64 converts numeric values to float64.
+func toFloat64(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
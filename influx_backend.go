@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api"
@@ -17,34 +21,347 @@ type InfluxBackend struct {
 	Client influxdb2.Client
 	Org    string
 	Bucket string
+	// BucketAliases maps names which may be used in queries to one or more buckets.
+	BucketAliases map[string][]string
+	// SplitSpan optionally splits paged queries with longer ranges into
+	// consecutive sub-ranges, which are queried separately. Other queries aren't
+	// split. See isSplittableQuery.
+	SplitSpan time.Duration
+	// SplitParallelism is the number of sub-range queries made at once.
+	SplitParallelism int
 }
 
-// Query converts and makes a query to an Influx backend.
+// Query converts and makes a query to an Influx backend. Queries over multiple
+// buckets are made concurrently and their results are merged by timestamp.
+// Paged queries over long ranges may be split into consecutive sub-ranges, whose
+// results are returned in order.
 func (backend *InfluxBackend) Query(ctx context.Context, query *Query) (Results, error) {
-	fluxQuery, err := buildFluxQuery(backend.Bucket, query)
+	if ranges := splitQueryRanges(query, backend.SplitSpan, time.Now()); ranges != nil {
+		return newSplitResults(ctx, query, ranges, backend.SplitParallelism, func(ctx context.Context, q *Query) (Results, error) {
+			return backend.queryBuckets(ctx, q, buildSortedFluxQuery)
+		})
+	}
+	fluxQueries, err := backend.buildBucketQueries(query, buildSortedFluxQuery)
+	if err != nil {
+		return nil, err
+	}
+	if query.Limit != nil && len(fluxQueries) == 1 {
+		return backend.queryPage(ctx, fluxQueries[0])
+	}
+	return backend.queryFluxQueries(ctx, fluxQueries)
+}
+
+// queryPage makes a paged query with its limit pushed down to InfluxDB, so only
+// a page's worth of records is sorted and returned. If those records can't fill
+// the page, the query is made again without the limit.
+func (backend *InfluxBackend) queryPage(ctx context.Context, fq *bucketFluxQuery) (Results, error) {
+	n := pageFetchLimit(*fq.query.Limit)
+	results, err := backend.query(ctx, fq.query, buildLimitedFluxQuery(fq.flux, n))
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var records []*Record
+	for results.Next() {
+		records = append(records, results.Record())
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+
+	var cursor *queryCursor
+	if fq.query.Cursor != "" {
+		if cursor, err = decodeCursor(fq.query.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	if records, ok := truncatePage(records, n, cursor, *fq.query.Limit); ok {
+		return &recordResults{records: records}, nil
+	}
+	return backend.query(ctx, fq.query, fq.flux)
+}
+
+// Latest queries the most recent record of each series matching a query. Series
+// found in multiple buckets are returned once.
+func (backend *InfluxBackend) Latest(ctx context.Context, query *Query) (Results, error) {
+	// the order of the latest records doesn't matter, as they're collected below
+	results, err := backend.queryBuckets(ctx, query, func(bucket string, query *Query, byTime bool) (string, error) {
+		return buildLatestFluxQuery(bucket, query)
+	})
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := results.(*mergedResults); !ok {
+		return results, nil
+	}
+	defer results.Close()
+
+	var records []*Record
+	for results.Next() {
+		records = append(records, results.Record())
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	return &recordResults{records: latestRecords(records)}, nil
+}
+
+// fluxBuilder builds the Flux query for a bucket. Its results must be sorted by
+// time if byTime is true.
+type fluxBuilder func(bucket string, query *Query, byTime bool) (string, error)
 
-	queryAPI := backend.Client.QueryAPI(backend.Org)
+// bucketFluxQuery is a Flux query made for a query and the query its results
+// are converted for.
+type bucketFluxQuery struct {
+	bucket string
+	query  *Query
+	flux   string
+}
 
-	results, err := queryAPI.Query(ctx, fluxQuery)
+// queryBuckets makes the Flux queries built by build for each bucket of a query
+// concurrently and merges the results.
+func (backend *InfluxBackend) queryBuckets(ctx context.Context, query *Query, build fluxBuilder) (Results, error) {
+	fluxQueries, err := backend.buildBucketQueries(query, build)
 	if err != nil {
 		return nil, err
 	}
+	return backend.queryFluxQueries(ctx, fluxQueries)
+}
 
-	return &influxResults{results: results, useStartTimestamp: query.Func != nil && query.Window == nil}, nil
+// queryFluxQueries makes Flux queries concurrently and merges the results.
+func (backend *InfluxBackend) queryFluxQueries(ctx context.Context, fluxQueries []*bucketFluxQuery) (Results, error) {
+	results := make([]Results, len(fluxQueries))
+	errs := make([]error, len(fluxQueries))
+
+	var wg sync.WaitGroup
+	for i := range fluxQueries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = backend.query(ctx, fluxQueries[i].query, fluxQueries[i].flux)
+		}(i)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		for _, r := range results {
+			if r != nil {
+				r.Close()
+			}
+		}
+		return nil, err
+	}
+
+	if len(results) == 1 {
+		return results[0], nil
+	}
+	return mergeResults(results), nil
+}
+
+// buildBucketQueries resolves the buckets of a query and builds a Flux query
+// for each of them with build. Results are merged by timestamp when there are
+// multiple buckets and paged by timestamp when there's a limit, so each query
+// must then be sorted by time. Flux sorts the results of multiple aggregations
+// separately, so they are made as separate queries in that case.
+func (backend *InfluxBackend) buildBucketQueries(query *Query, build fluxBuilder) ([]*bucketFluxQuery, error) {
+	buckets, err := resolveBuckets(backend.Bucket, backend.BucketAliases, query)
+	if err != nil {
+		return nil, err
+	}
+
+	byTime := len(buckets) > 1 || query.Limit != nil
+
+	queries := []*Query{query}
+	if byTime && len(query.Func) > 1 {
+		queries = nil
+		for _, fn := range query.Func {
+			q := *query
+			q.Func = StringList{fn}
+			queries = append(queries, &q)
+		}
+	}
+
+	var fluxQueries []*bucketFluxQuery
+	for _, bucket := range buckets {
+		for _, q := range queries {
+			flux, err := build(bucket, bucketQuery(q), byTime)
+			if err != nil {
+				return nil, err
+			}
+			fluxQueries = append(fluxQueries, &bucketFluxQuery{bucket: bucket, query: q, flux: flux})
+		}
+	}
+	return fluxQueries, nil
+}
+
+// Explain returns the Flux queries Query would make without running them.
+func (backend *InfluxBackend) Explain(ctx context.Context, query *Query) (*QueryPlan, error) {
+	queries := []*Query{query}
+	ranges := splitQueryRanges(query, backend.SplitSpan, time.Now())
+	if ranges != nil {
+		queries = splitSubqueries(query, ranges)
+	}
+
+	plan := &QueryPlan{}
+	for _, q := range queries {
+		fluxQueries, err := backend.buildBucketQueries(q, buildSortedFluxQuery)
+		if err != nil {
+			return nil, err
+		}
+		for _, fq := range fluxQueries {
+			flux := fq.flux
+			if q.Limit != nil && ranges == nil && len(fluxQueries) == 1 {
+				flux = buildLimitedFluxQuery(flux, pageFetchLimit(*q.Limit))
+			}
+			plan.Queries = append(plan.Queries, &PlannedQuery{
+				Bucket: fq.bucket,
+				Start:  q.Start,
+				End:    q.End,
+				Flux:   flux,
+			})
+		}
+	}
+	return plan, nil
+}
+
+func (backend *InfluxBackend) query(ctx context.Context, query *Query, fluxQuery string) (Results, error) {
+	results, err := backend.Client.QueryAPI(backend.Org).Query(ctx, fluxQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	ir := &influxResults{results: results, query: query, useStartTimestamp: make(map[string]bool)}
+	for _, fn := range query.Func {
+		ir.useStartTimestamp[fn] = useStartTimestamp(query, fn)
+	}
+	return ir, nil
+}
+
+// Names lists the measurement names matching a query.
+func (backend *InfluxBackend) Names(ctx context.Context, query *Query) ([]string, error) {
+	return backend.querySchema(ctx, query, "tagValues", "_measurement")
+}
+
+// MetaKeys lists the meta keys of the series matching a query.
+func (backend *InfluxBackend) MetaKeys(ctx context.Context, query *Query) ([]string, error) {
+	keys, err := backend.querySchema(ctx, query, "tagKeys", "")
+	if err != nil {
+		return nil, err
+	}
+	// skip influxdb internal tags like _measurement and _field
+	var metaKeys []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k, "_") {
+			metaKeys = append(metaKeys, k)
+		}
+	}
+	return metaKeys, nil
+}
+
+// MetaValues lists the values of a meta key in the series matching a query.
+func (backend *InfluxBackend) MetaValues(ctx context.Context, query *Query, key string) ([]string, error) {
+	if !metaRE.MatchString(key) {
+		return nil, fmt.Errorf("invalid meta key %q", key)
+	}
+	if s, ok := fieldRenameMap[key]; ok {
+		key = s
+	}
+	return backend.querySchema(ctx, query, "tagValues", key)
+}
+
+// Cardinality counts the series matching a query's filter in each of its
+// buckets. Value filters aren't applied, so the count may be higher than the
+// number of series with matching records.
+func (backend *InfluxBackend) Cardinality(ctx context.Context, query *Query) (int, error) {
+	buckets, err := resolveBuckets(backend.Bucket, backend.BucketAliases, query)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, bucket := range buckets {
+		fluxQuery, err := buildCardinalityQuery(bucket, bucketQuery(query))
+		if err != nil {
+			return 0, err
+		}
+		results, err := backend.Client.QueryAPI(backend.Org).Query(ctx, fluxQuery)
+		if err != nil {
+			return 0, err
+		}
+		for results.Next() {
+			if n, ok := results.Record().Value().(int64); ok {
+				total += int(n)
+			}
+		}
+		err = results.Err()
+		results.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+// querySchema calls a schema function for each bucket of a query and returns the
+// sorted distinct values.
+func (backend *InfluxBackend) querySchema(ctx context.Context, query *Query, fn string, tag string) ([]string, error) {
+	buckets, err := resolveBuckets(backend.Bucket, backend.BucketAliases, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, bucket := range buckets {
+		fluxQuery, err := buildSchemaQuery(bucket, bucketQuery(query), fn, tag)
+		if err != nil {
+			return nil, err
+		}
+		bucketValues, err := backend.queryStrings(ctx, fluxQuery)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, bucketValues...)
+	}
+	sort.Strings(values)
+	return slices.Compact(values), nil
+}
+
+// queryStrings runs a Flux query and returns the sorted string values of its results.
+func (backend *InfluxBackend) queryStrings(ctx context.Context, fluxQuery string) ([]string, error) {
+	results, err := backend.Client.QueryAPI(backend.Org).Query(ctx, fluxQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	var values []string
+	for results.Next() {
+		if s, ok := results.Record().Value().(string); ok {
+			values = append(values, s)
+		}
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(values)
+	return values, nil
 }
 
 type influxResults struct {
-	results           *api.QueryTableResult
-	record            *Record
-	err               error
-	useStartTimestamp bool
+	results *api.QueryTableResult
+	query   *Query
+	record  *Record
+	err     error
+	// useStartTimestamp holds whether to use the start timestamp for each aggregation function
+	useStartTimestamp map[string]bool
 }
 
 func (r *influxResults) Err() error {
-	return r.err
+	if r.err != nil {
+		return r.err
+	}
+	return r.results.Err()
 }
 
 func (r *influxResults) Close() error {
@@ -63,7 +380,23 @@ func (r *influxResults) Next() bool {
 	return r.err == nil
 }
 
+// aggregation returns the name of the aggregation function which produced rec. Multiple
+// aggregations are returned as results named after their function.
+func (r *influxResults) aggregation(rec *influxdb2query.FluxRecord) string {
+	switch len(r.query.Func) {
+	case 0:
+		return ""
+	case 1:
+		return r.query.Func[0]
+	}
+	return rec.Result()
+}
+
 func (r *influxResults) convertToAPIRecord(rec *influxdb2query.FluxRecord) (*Record, error) {
+	if r.query.Pivot != nil {
+		return r.convertToPivotedAPIRecord(rec), nil
+	}
+
 	apirec := &Record{}
 
 	name, ok := rec.Values()["_measurement"].(string)
@@ -72,17 +405,65 @@ func (r *influxResults) convertToAPIRecord(rec *influxdb2query.FluxRecord) (*Rec
 	}
 
 	apirec.Name = name
-	if r.useStartTimestamp {
-		// TODO(sean) Think about the right timestamp to provide for aggregations, particularly if we plan on supporting any windowing.
+	apirec.Aggregation = r.aggregation(rec)
+	if r.useStartTimestamp[apirec.Aggregation] {
+		// un-windowed aggregations drop _time, so use the start of the range. see aggregation.Selector.
 		apirec.Timestamp = rec.Start()
 	} else {
 		apirec.Timestamp = rec.Time()
 	}
 	apirec.Value = rec.Values()["_value"]
 	apirec.Meta = buildMetaFromRecord(rec)
+	if r.query.GroupBy != nil {
+		// selectors keep the meta of the selected row, so drop keys which weren't grouped by
+		for k := range apirec.Meta {
+			if !slices.Contains(r.query.GroupBy, k) {
+				delete(apirec.Meta, k)
+			}
+		}
+	}
 	return apirec, nil
 }
 
+// convertToPivotedAPIRecord converts a row produced by pivot(). The pivot keys
+// become the meta and every other non-internal column is a measurement value.
+func (r *influxResults) convertToPivotedAPIRecord(rec *influxdb2query.FluxRecord) *Record {
+	apirec := &Record{
+		Values:      make(map[string]interface{}),
+		Aggregation: r.aggregation(rec),
+		Meta:        make(map[string]string),
+	}
+
+	if r.useStartTimestamp[apirec.Aggregation] {
+		apirec.Timestamp = rec.Start()
+	} else {
+		apirec.Timestamp = rec.Time()
+	}
+
+	isKey := make(map[string]bool)
+	for _, k := range r.query.Pivot.By {
+		isKey[k] = true
+	}
+
+	for k, v := range rec.Values() {
+		if strings.HasPrefix(k, "_") || k == "table" || k == "result" {
+			continue
+		}
+		if isKey[k] {
+			if s, ok := v.(string); ok {
+				apirec.Meta[k] = s
+			}
+			continue
+		}
+		// measurements without a value at this timestamp are null
+		if v != nil {
+			apirec.Values[k] = v
+		}
+	}
+
+	return apirec
+}
+
 func buildMetaFromRecord(rec *influxdb2query.FluxRecord) map[string]string {
 	meta := make(map[string]string)
 
@@ -109,14 +490,16 @@ func buildMetaFromRecord(rec *influxdb2query.FluxRecord) map[string]string {
 
 // buildFluxQuery builds a Flux query string for InfluxDB from a bucket name and Query
 func buildFluxQuery(bucket string, query *Query) (string, error) {
-	// override bucket if part of query
-	if query.Bucket != nil {
-		bucket = *query.Bucket
-	}
+	return buildSortedFluxQuery(bucket, query, query.Limit != nil)
+}
 
-	// we assume buckets starting with _ are private
-	if strings.HasPrefix(bucket, "_") {
-		return "", fmt.Errorf("not authorized to access bucket %q", bucket)
+// buildSortedFluxQuery builds a Flux query whose results are sorted by time if
+// byTime is true or otherwise returned by series. With multiple aggregations,
+// the results of each aggregation are sorted separately.
+func buildSortedFluxQuery(bucket string, query *Query, byTime bool) (string, error) {
+	bucket, err := resolveBucket(bucket, query)
+	if err != nil {
+		return "", err
 	}
 
 	// start query out with data bucket
@@ -142,6 +525,18 @@ func buildFluxQuery(bucket string, query *Query) (string, error) {
 		parts = append(parts, filterSubquery)
 	}
 
+	// add value filter subquery if included. the types package is needed to
+	// check the type of each value.
+	var imports string
+	if query.ValueFilter != "" {
+		f, err := parseValueFilter(query.ValueFilter)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, fmt.Sprintf("filter(fn: (r) => %s)", f.fluxPredicate()))
+		imports = "import \"types\"\n"
+	}
+
 	if query.Head != nil && query.Tail != nil {
 		return "", fmt.Errorf("head and tail cannot both be specified")
 	}
@@ -156,48 +551,267 @@ func buildFluxQuery(bucket string, query *Query) (string, error) {
 		parts = append(parts, fmt.Sprintf("tail(n:%d)", *query.Tail))
 	}
 
-	// ensure window is not used without aggregation function
-	if query.Window != nil && query.Func == nil {
-		return "", fmt.Errorf("window cannot be used without aggregation function")
+	if err := validateAggregation(query); err != nil {
+		return "", err
 	}
 
-	// add aggregation subqueries if included
-	if query.Func != nil && query.Window != nil {
-		parts = append(parts, fmt.Sprintf("aggregateWindow(every: %s, fn: %s)", *query.Window, *query.Func))
-	} else if query.Func != nil {
-		fn := *query.Func
-		switch fn {
-		case "mean":
-			parts = append(parts, "mean()")
-		case "min":
-			parts = append(parts, "min()")
-		case "max":
-			parts = append(parts, "max()")
-		case "sum":
-			parts = append(parts, "sum()")
-		case "count":
-			parts = append(parts, "count()")
-		default:
-			return "", fmt.Errorf("unsupported function")
+	// add group by subquery if included
+	if query.GroupBy != nil {
+		parts = append(parts, buildGroupBySubquery(query))
+	}
+
+	// multiple aggregations share the data selected above. each aggregation is
+	// returned as its own result named after the function.
+	if len(query.Func) > 1 {
+		lines := []string{"data = " + strings.Join(parts, " |> ")}
+		for _, fn := range query.Func {
+			subqueries, err := buildAggregationSubqueries(query, fn, byTime)
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, fmt.Sprintf(`data |> %s |> yield(name: "%s")`, strings.Join(subqueries, " |> "), fn))
 		}
+		return imports + strings.Join(lines, "\n"), nil
+	}
+
+	var fn string
+	if len(query.Func) == 1 {
+		fn = query.Func[0]
+	}
+	subqueries, err := buildAggregationSubqueries(query, fn, byTime)
+	if err != nil {
+		return "", err
 	}
+	parts = append(parts, subqueries...)
 
-	return strings.Join(parts, " |> "), nil
+	return imports + strings.Join(parts, " |> "), nil
 }
 
-func buildRangeSubquery(query *Query) (string, error) {
+// buildLimitedFluxQuery limits a Flux query sorted by time to its first n records.
+func buildLimitedFluxQuery(fluxQuery string, n int) string {
+	return fmt.Sprintf("%s |> limit(n: %d)", fluxQuery, n)
+}
+
+// buildLatestFluxQuery builds a Flux query for the most recent record of each
+// series matching a query. Tables are grouped by series, so last() selects the
+// last record of each series.
+func buildLatestFluxQuery(bucket string, query *Query) (string, error) {
+	if err := validateLatestQuery(query); err != nil {
+		return "", err
+	}
+	fluxQuery, err := buildFluxQuery(bucket, query)
+	if err != nil {
+		return "", err
+	}
+	return fluxQuery + " |> last()", nil
+}
+
+// buildAggregationSubqueries builds the subqueries which follow selecting the data
+// for an aggregation function fn, which may be empty for no aggregation. The
+// results are sorted by time if byTime is true.
+func buildAggregationSubqueries(query *Query, fn string, byTime bool) ([]string, error) {
 	var parts []string
-	if !isValidFilterString(query.Start) {
-		return "", fmt.Errorf("invalid start timestamp %q", query.Start)
+
+	// add aggregation subquery if included
+	if fn != "" {
+		agg, err := lookupAggregation(fn)
+		if err != nil {
+			return nil, err
+		}
+		if query.Window != nil {
+			parts = append(parts, fmt.Sprintf("aggregateWindow(every: %s, fn: %s)", *query.Window, agg.WindowFn))
+		} else {
+			parts = append(parts, agg.Flux)
+		}
 	}
-	if !isValidFilterString(query.End) {
-		return "", fmt.Errorf("invalid end timestamp %q", query.End)
+
+	// add pivot subquery if included
+	if query.Pivot != nil {
+		pivotSubquery, err := buildPivotSubquery(query, fn)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, pivotSubquery)
 	}
-	if query.Start != "" {
-		parts = append(parts, "start:"+query.Start)
+
+	// order results by time for paging or merging. records sharing a timestamp
+	// are ordered by series when a page is built.
+	if byTime {
+		parts = append(parts, `group() |> sort(columns: ["_time"])`)
 	}
-	if query.End != "" {
-		parts = append(parts, "stop:"+query.End)
+
+	return parts, nil
+}
+
+// buildGroupBySubquery regroups series by the group_by meta keys, so they are
+// aggregated together. Series are always kept apart by measurement name and
+// field, as their values may have different types. The range columns are kept
+// so un-windowed aggregations can still be timestamped with the range start.
+// Regrouped tables are sorted by time for the selectors first and last.
+func buildGroupBySubquery(query *Query) string {
+	columns := []string{`"_start"`, `"_stop"`, `"_measurement"`, `"_field"`}
+	for _, k := range query.GroupBy {
+		columns = append(columns, fmt.Sprintf("%q", k))
+	}
+	return fmt.Sprintf(`group(columns: [%s]) |> sort(columns: ["_time"])`, strings.Join(columns, ", "))
+}
+
+// buildSchemaQuery builds a Flux query which calls one of the schema package
+// functions for the range and filter of a query. Names are listed using
+// tagValues on _measurement, as schema.measurements doesn't accept a predicate.
+func buildSchemaQuery(bucket string, query *Query, fn string, tag string) (string, error) {
+	bucket, err := resolveBucket(bucket, query)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{fmt.Sprintf(`bucket: "%s"`, bucket)}
+
+	if tag != "" {
+		args = append(args, fmt.Sprintf(`tag: "%s"`, tag))
+	}
+
+	predicate, err := buildFilterPredicate(query)
+	if err != nil {
+		return "", err
+	}
+	if predicate != "" {
+		args = append(args, fmt.Sprintf("predicate: (r) => %s", predicate))
+	}
+
+	rangeArgs, err := buildRangeArgs(query)
+	if err != nil {
+		return "", err
+	}
+	args = append(args, rangeArgs...)
+
+	return fmt.Sprintf("import \"influxdata/influxdb/schema\"\nschema.%s(%s)", fn, strings.Join(args, ", ")), nil
+}
+
+// buildCardinalityQuery builds a Flux query counting the series in bucket which
+// match the query filter.
+func buildCardinalityQuery(bucket string, query *Query) (string, error) {
+	bucket, err := resolveBucket(bucket, query)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{fmt.Sprintf(`bucket: "%s"`, bucket)}
+
+	predicate, err := buildFilterPredicate(query)
+	if err != nil {
+		return "", err
+	}
+	if predicate != "" {
+		args = append(args, fmt.Sprintf("predicate: (r) => %s", predicate))
+	}
+
+	rangeArgs, err := buildRangeArgs(query)
+	if err != nil {
+		return "", err
+	}
+	args = append(args, rangeArgs...)
+
+	return fmt.Sprintf("import \"influxdata/influxdb\"\ninfluxdb.cardinality(%s)", strings.Join(args, ", ")), nil
+}
+
+// buildPivotSubquery regroups series by the pivot keys, so measurements from
+// different series end up in the same table, and then pivots measurement names
+// into columns. Un-windowed aggregations which aren't selectors have no _time
+// column, so we pivot on _start instead.
+func buildPivotSubquery(query *Query, fn string) (string, error) {
+	columns := make([]string, len(query.Pivot.By))
+	for i, k := range query.Pivot.By {
+		if !metaRE.MatchString(k) {
+			return "", fmt.Errorf("invalid pivot key %q", k)
+		}
+		columns[i] = fmt.Sprintf("%q", k)
+	}
+
+	rowKey := "_time"
+	if useStartTimestamp(query, fn) {
+		rowKey = "_start"
+	}
+
+	return fmt.Sprintf(`group(columns: [%s]) |> pivot(rowKey: ["%s"], columnKey: ["_measurement"], valueColumn: "_value")`, strings.Join(columns, ", "), rowKey), nil
+}
+
+// resolveBuckets returns the buckets to query, which are either the default
+// bucket or the buckets listed by the query. Aliases are replaced by the buckets
+// they stand for and duplicate buckets are removed.
+func resolveBuckets(bucket string, aliases map[string][]string, query *Query) ([]string, error) {
+	names := query.Buckets
+	if query.Bucket != nil {
+		names = []string{*query.Bucket}
+	}
+	if len(names) == 0 {
+		names = []string{bucket}
+	}
+
+	var buckets []string
+	for _, name := range names {
+		targets, ok := aliases[name]
+		if !ok {
+			targets = []string{name}
+		}
+		for _, b := range targets {
+			// we assume buckets starting with _ are private
+			if strings.HasPrefix(b, "_") {
+				return nil, fmt.Errorf("not authorized to access bucket %q", b)
+			}
+			if !slices.Contains(buckets, b) {
+				buckets = append(buckets, b)
+			}
+		}
+	}
+	return buckets, nil
+}
+
+// parseBucketAliases parses a list of bucket aliases like
+// "all=waggle|downsampled,raw=waggle".
+func parseBucketAliases(s string) (map[string][]string, error) {
+	aliases := make(map[string][]string)
+	if s == "" {
+		return aliases, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		name, buckets, ok := strings.Cut(part, "=")
+		if !ok || name == "" || buckets == "" {
+			return nil, fmt.Errorf("invalid bucket alias %q", part)
+		}
+		aliases[name] = strings.Split(buckets, "|")
+	}
+	return aliases, nil
+}
+
+// bucketQuery returns a copy of query for a single bucket resolved by resolveBuckets.
+func bucketQuery(query *Query) *Query {
+	q := *query
+	q.Bucket = nil
+	q.Buckets = nil
+	return &q
+}
+
+// resolveBucket returns the bucket to query, which is either the default bucket
+// or the bucket overridden by the query.
+func resolveBucket(bucket string, query *Query) (string, error) {
+	// override bucket if part of query
+	if query.Bucket != nil {
+		bucket = *query.Bucket
+	}
+
+	// we assume buckets starting with _ are private
+	if strings.HasPrefix(bucket, "_") {
+		return "", fmt.Errorf("not authorized to access bucket %q", bucket)
+	}
+
+	return bucket, nil
+}
+
+func buildRangeSubquery(query *Query) (string, error) {
+	parts, err := buildRangeArgs(query)
+	if err != nil {
+		return "", err
 	}
 	if len(parts) > 0 {
 		return fmt.Sprintf(`range(%s)`, strings.Join(parts, ",")), nil
@@ -205,6 +819,37 @@ func buildRangeSubquery(query *Query) (string, error) {
 	return "", nil
 }
 
+// buildRangeArgs builds the start and stop arguments used by range() and the
+// schema functions.
+func buildRangeArgs(query *Query) ([]string, error) {
+	var parts []string
+
+	// continue from cursor position, if included. records at the cursor timestamp
+	// which were already returned are skipped when the page is built.
+	start := query.Start
+	if cursorStartsRange(query) {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		start = cursor.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	if !isValidFilterString(start) {
+		return nil, fmt.Errorf("invalid start timestamp %q", start)
+	}
+	if !isValidFilterString(query.End) {
+		return nil, fmt.Errorf("invalid end timestamp %q", query.End)
+	}
+	if start != "" {
+		parts = append(parts, "start:"+start)
+	}
+	if query.End != "" {
+		parts = append(parts, "stop:"+query.End)
+	}
+	return parts, nil
+}
+
 // Waggle and InfluxDB use slightly different field names in at least one case, so
 // we keep a map to document and translate between them when needed.
 var fieldRenameMap = map[string]string{
@@ -212,42 +857,50 @@ var fieldRenameMap = map[string]string{
 }
 
 func buildFilterSubquery(query *Query) (string, error) {
-	var parts []string
+	predicate, err := buildFilterPredicate(query)
+	if err != nil {
+		return "", err
+	}
+	if predicate != "" {
+		return fmt.Sprintf(`filter(fn: (r) => %s)`, predicate), nil
+	}
+	return "", nil
+}
 
-	for field, pattern := range query.Filter {
-		if !isValidFilterString(field) {
+// buildFilterPredicate builds the body of the predicate function which matches
+// the query filter. It returns an empty string if there is no filter.
+func buildFilterPredicate(query *Query) (string, error) {
+	// patterns are escaped when building the predicate, but field names are used as is
+	for field := range query.Filter {
+		if !metaRE.MatchString(field) {
 			return "", fmt.Errorf("invalid filter field name %q", field)
 		}
-		if !isValidFilterString(pattern) {
-			return "", fmt.Errorf("invalid filter field pattern %q", pattern)
-		}
+	}
 
-		// rename field, if needed
-		if s, ok := fieldRenameMap[field]; ok {
-			field = s
-		}
+	terms, err := parseFilter(query.Filter)
+	if err != nil {
+		return "", err
+	}
 
-		// handle wildcard or exact match. (this may not actually be an optimization)
-		// TODO(sean) use regexp.QuoteMeta instead of manually using ReplaceAll.
-		switch {
-		case strings.Contains(pattern, "|"):
-			parts = append(parts, fmt.Sprintf("r.%s =~ /^(%s)$/", field, strings.ReplaceAll(pattern, "/", "\\/")))
-		case strings.Contains(pattern, "*"):
-			parts = append(parts, fmt.Sprintf("r.%s =~ /^%s$/", field, strings.ReplaceAll(pattern, "/", "\\/")))
-		default:
-			parts = append(parts, fmt.Sprintf("r.%s == \"%s\"", field, pattern))
-		}
+	var parts []string
+	for _, term := range terms {
+		parts = append(parts, term.fluxPredicate())
 	}
+	sort.Strings(parts)
 
-	if len(parts) > 0 {
-		sort.Strings(parts)
-		return fmt.Sprintf(`filter(fn: (r) => %s)`, strings.Join(parts, " and ")), nil
+	// add filter expression after the filter terms, if included
+	if query.FilterExpr != nil {
+		expr, err := parseFilterExpr(query.FilterExpr)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, expr.fluxPredicate())
 	}
 
-	return "", nil
+	return strings.Join(parts, " and "), nil
 }
 
-var validQueryStringRE = regexp.MustCompile("^[A-Za-z0-9+-_.*:| ]*$")
+var validQueryStringRE = regexp.MustCompile(`^[A-Za-z0-9+\-_.*:| ]*$`)
 
 func isValidFilterString(s string) bool {
 	return validQueryStringRE.MatchString(s)
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"slices"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api"
 )
 
 func init() {
@@ -118,6 +126,54 @@ func TestBuildFluxQuery(t *testing.T) {
 				}},
 			Expect: `from(bucket:"mybucket") |> range(start:-4h,stop:-2h) |> filter(fn: (r) => r.plugin =~ /^docker.io\/waggle\/plugin-iio.*$/)`,
 		},
+		"QuotedFilter": {
+			Query: &Query{
+				Start: "-4h",
+				Filter: map[string]string{
+					"name":   `"); drop bucket`,
+					"plugin": `${x}/*`,
+				}},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement == "\"); drop bucket" and r.plugin =~ /^\$\{x\}\/.*$/)`,
+		},
+		"RegexFilter": {
+			Query: &Query{
+				Start: "-4h",
+				Filter: map[string]string{
+					"plugin": "re:iio|raingauge",
+					"task":   "!re:^test/",
+				}},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => (not exists r.task or r.task !~ /^test\//) and r.plugin =~ /iio|raingauge/)`,
+		},
+		"FilterExpr": {
+			Query: &Query{
+				Start: "-4h",
+				Filter: map[string]string{
+					"name": "env.temperature",
+				},
+				FilterExpr: &FilterExpr{Or: []*FilterExpr{
+					{Match: map[string]string{"vsn": "W01B"}},
+					{Match: map[string]string{"plugin": "*iio*"}},
+				}}},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement == "env.temperature" and (r.vsn == "W01B" or r.plugin =~ /^.*iio.*$/))`,
+		},
+		"NegatedFilter": {
+			Query: &Query{
+				Start: "-4h",
+				Filter: map[string]string{
+					"plugin": "!.*:test.*",
+					"vsn":    "!W001",
+				}},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => (not exists r.plugin or r.plugin !~ /^.*:test.*$/) and (not exists r.vsn or r.vsn != "W001"))`,
+		},
+		"ExistsFilter": {
+			Query: &Query{
+				Start: "-4h",
+				Filter: map[string]string{
+					"sensor": "*",
+					"zone":   "!*",
+				}},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => exists r.sensor and not exists r.zone)`,
+		},
 		"Combined1": {
 			Query: &Query{
 				Start: "-4h",
@@ -142,6 +198,174 @@ func TestBuildFluxQuery(t *testing.T) {
 				}},
 			Expect: `from(bucket:"mybucket") |> range(start:-4h,stop:-2h) |> filter(fn: (r) => r._measurement =~ /^env.temp.*$/ and r.sensor =~ /^es.*$/ and r.vsn =~ /^(V001|W123)$/) |> tail(n:123)`,
 		},
+		"Pivot": {
+			Query: &Query{
+				Start: "-4h",
+				Filter: map[string]string{
+					"name": "env.temp.*",
+				},
+				Pivot: &Pivot{By: []string{"vsn"}},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement =~ /^env.temp.*$/) |> group(columns: ["vsn"]) |> pivot(rowKey: ["_time"], columnKey: ["_measurement"], valueColumn: "_value")`,
+		},
+		"PivotAggregate": {
+			Query: &Query{
+				Start:  "-4h",
+				Func:   StringList{"mean"},
+				Window: strptr("10m"),
+				Pivot:  &Pivot{By: []string{"vsn", "sensor"}},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> aggregateWindow(every: 10m, fn: mean) |> group(columns: ["vsn", "sensor"]) |> pivot(rowKey: ["_time"], columnKey: ["_measurement"], valueColumn: "_value")`,
+		},
+		"PivotNoKeys": {
+			Query: &Query{
+				Start: "-4h",
+				Func:  StringList{"mean"},
+				Pivot: &Pivot{},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> mean() |> group(columns: []) |> pivot(rowKey: ["_start"], columnKey: ["_measurement"], valueColumn: "_value")`,
+		},
+		"Limit": {
+			Query: &Query{
+				Start: "-4h",
+				Limit: intptr(100),
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> group() |> sort(columns: ["_time"])`,
+		},
+		"LimitCursor": {
+			Query: &Query{
+				Start:  "-4h",
+				Limit:  intptr(100),
+				Cursor: encodeCursor(&queryCursor{Timestamp: time.Date(2022, 1, 1, 10, 0, 0, 123, time.UTC), Series: "env.temperature,vsn=W001"}),
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:2022-01-01T10:00:00.000000123Z) |> group() |> sort(columns: ["_time"])`,
+		},
+		"PivotSelector": {
+			Query: &Query{
+				Start: "-4h",
+				Func:  StringList{"max"},
+				Pivot: &Pivot{},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> max() |> group(columns: []) |> pivot(rowKey: ["_time"], columnKey: ["_measurement"], valueColumn: "_value")`,
+		},
+		"Median": {
+			Query: &Query{
+				Start: "-4h",
+				Func:  StringList{"median"},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> median()`,
+		},
+		"Quantile": {
+			Query: &Query{
+				Start: "-4h",
+				Func:  StringList{"p95"},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> quantile(q: 0.95)`,
+		},
+		"MultipleFuncs": {
+			Query: &Query{
+				Start:  "-4h",
+				Func:   StringList{"min", "mean"},
+				Window: strptr("10m"),
+			},
+			Expect: `data = from(bucket:"mybucket") |> range(start:-4h)
+data |> aggregateWindow(every: 10m, fn: min) |> yield(name: "min")
+data |> aggregateWindow(every: 10m, fn: mean) |> yield(name: "mean")`,
+		},
+		"ValueFilter": {
+			Query: &Query{
+				Start:       "-4h",
+				Filter:      map[string]string{"name": "env.temperature"},
+				ValueFilter: ">40",
+				Tail:        intptr(3),
+			},
+			Expect: `import "types"
+from(bucket:"mybucket") |> range(start:-4h) |> filter(fn: (r) => r._measurement == "env.temperature") |> filter(fn: (r) => types.isNumeric(v: r._value) and float(v: r._value) > 40.0) |> tail(n:3)`,
+		},
+		"BadValueFilter": {
+			Query: &Query{
+				Start:       "-4h",
+				ValueFilter: ">forty",
+			},
+			ShouldFail: true,
+		},
+		"GroupBy": {
+			Query: &Query{
+				Start:   "-4h",
+				Func:    StringList{"mean"},
+				Window:  strptr("10m"),
+				GroupBy: []string{"vsn"},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> group(columns: ["_start", "_stop", "_measurement", "_field", "vsn"]) |> sort(columns: ["_time"]) |> aggregateWindow(every: 10m, fn: mean)`,
+		},
+		"GroupByGlobal": {
+			Query: &Query{
+				Start:   "-4h",
+				Func:    StringList{"mean"},
+				GroupBy: []string{},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> group(columns: ["_start", "_stop", "_measurement", "_field"]) |> sort(columns: ["_time"]) |> mean()`,
+		},
+		"GroupByNoFunc": {
+			Query: &Query{
+				Start:   "-4h",
+				GroupBy: []string{"vsn"},
+			},
+			ShouldFail: true,
+		},
+		"QuantileWindow": {
+			Query: &Query{
+				Start:  "-4h",
+				Func:   StringList{"p99.9"},
+				Window: strptr("1h"),
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> aggregateWindow(every: 1h, fn: (column, tables=<-) => tables |> quantile(q: 0.999, column: column))`,
+		},
+		"QuantileZero": {
+			Query: &Query{
+				Start: "-4h",
+				Func:  StringList{"p0"},
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> quantile(q: 0.0)`,
+		},
+		"StddevWindow": {
+			Query: &Query{
+				Start:  "-4h",
+				Func:   StringList{"stddev"},
+				Window: strptr("1h30m"),
+			},
+			Expect: `from(bucket:"mybucket") |> range(start:-4h) |> aggregateWindow(every: 1h30m, fn: stddev)`,
+		},
+		"UnsupportedFunc": {
+			Query: &Query{
+				Start: "-4h",
+				Func:  StringList{"mode"},
+			},
+			ShouldFail: true,
+		},
+		"UnsupportedWindowFunc": {
+			Query: &Query{
+				Start:  "-4h",
+				Func:   StringList{"(r) => r"},
+				Window: strptr("1h"),
+			},
+			ShouldFail: true,
+		},
+		"InvalidWindow": {
+			Query: &Query{
+				Start:  "-4h",
+				Func:   StringList{"mean"},
+				Window: strptr("1h, fn: drop"),
+			},
+			ShouldFail: true,
+		},
+		"PivotBadKey": {
+			Query: &Query{
+				Start: "-4h",
+				Pivot: &Pivot{By: []string{`vsn"])`}},
+			},
+			ShouldFail: true,
+		},
 	}
 
 	for name, tc := range testcases {
@@ -164,12 +388,90 @@ func TestBuildFluxQuery(t *testing.T) {
 	}
 }
 
+func TestBuildSchemaQuery(t *testing.T) {
+	query := &Query{
+		Start: "-4h",
+		End:   "-2h",
+		Filter: map[string]string{
+			"vsn": "W001",
+		},
+	}
+
+	s, err := buildSchemaQuery("mybucket", query, "tagValues", "_measurement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `import "influxdata/influxdb/schema"
+schema.tagValues(bucket: "mybucket", tag: "_measurement", predicate: (r) => r.vsn == "W001", start:-4h, stop:-2h)`
+	if s != expect {
+		t.Fatalf("flux query expected:\nexpect: %s\noutput: %s", expect, s)
+	}
+
+	s, err = buildSchemaQuery("mybucket", &Query{Start: "-4h"}, "tagKeys", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect = `import "influxdata/influxdb/schema"
+schema.tagKeys(bucket: "mybucket", start:-4h)`
+	if s != expect {
+		t.Fatalf("flux query expected:\nexpect: %s\noutput: %s", expect, s)
+	}
+
+	if _, err := buildSchemaQuery("mybucket", &Query{Start: "-4h", Bucket: strptr("_private")}, "tagKeys", ""); err == nil {
+		t.Fatalf("expected error for private bucket")
+	}
+}
+
+func TestBuildCardinalityQuery(t *testing.T) {
+	query := &Query{
+		Start: "-5y",
+		Filter: map[string]string{
+			"vsn": "W001",
+		},
+	}
+
+	s, err := buildCardinalityQuery("mybucket", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `import "influxdata/influxdb"
+influxdb.cardinality(bucket: "mybucket", predicate: (r) => r.vsn == "W001", start:-5y)`
+	if s != expect {
+		t.Fatalf("flux query expected:\nexpect: %s\noutput: %s", expect, s)
+	}
+}
+
+func TestBuildLatestFluxQuery(t *testing.T) {
+	query := &Query{
+		Start:  "-1h",
+		Filter: map[string]string{"name": "env.temperature"},
+	}
+	s, err := buildLatestFluxQuery("mybucket", query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := `from(bucket:"mybucket") |> range(start:-1h) |> filter(fn: (r) => r._measurement == "env.temperature") |> last()`
+	if s != expect {
+		t.Fatalf("flux query expected:\nexpect: %s\noutput: %s", expect, s)
+	}
+
+	if _, err := buildLatestFluxQuery("mybucket", &Query{Start: "-1h", Tail: intptr(1)}); err == nil {
+		t.Fatalf("expected error for tail")
+	}
+}
+
 func TestBuildFluxBadQuery(t *testing.T) {
 	testcases := []*Query{
 		{
 			Start: "-4h",
 			Filter: map[string]string{
-				"name": "); drop bucket",
+				"name": "re:env.(temp",
+			},
+		},
+		{
+			Start: "-4h",
+			Filter: map[string]string{
+				"meta.vsn": "W001",
 			},
 		},
 		{
@@ -191,3 +493,139 @@ func TestBuildFluxBadQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveBuckets(t *testing.T) {
+	aliases := map[string][]string{
+		"all":     {"waggle", "downsampled"},
+		"raw":     {"waggle"},
+		"private": {"_monitoring"},
+	}
+
+	testcases := map[string]struct {
+		Query      *Query
+		Expect     []string
+		ShouldFail bool
+	}{
+		"Default":      {Query: &Query{}, Expect: []string{"waggle"}},
+		"Bucket":       {Query: &Query{Bucket: strptr("downsampled")}, Expect: []string{"downsampled"}},
+		"Buckets":      {Query: &Query{Buckets: []string{"downsampled", "waggle"}}, Expect: []string{"downsampled", "waggle"}},
+		"Alias":        {Query: &Query{Buckets: []string{"all"}}, Expect: []string{"waggle", "downsampled"}},
+		"Duplicate":    {Query: &Query{Buckets: []string{"raw", "all"}}, Expect: []string{"waggle", "downsampled"}},
+		"Private":      {Query: &Query{Buckets: []string{"waggle", "_monitoring"}}, ShouldFail: true},
+		"PrivateAlias": {Query: &Query{Bucket: strptr("private")}, ShouldFail: true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			buckets, err := resolveBuckets("waggle", aliases, tc.Query)
+			if tc.ShouldFail {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(buckets, tc.Expect) {
+				t.Fatalf("expected buckets %v. got %v", tc.Expect, buckets)
+			}
+		})
+	}
+}
+
+func TestBuildBucketQueries(t *testing.T) {
+	backend := &InfluxBackend{
+		Bucket:        "waggle",
+		BucketAliases: map[string][]string{"all": {"waggle", "downsampled"}},
+	}
+
+	testcases := map[string]struct {
+		Query   *Query
+		Buckets []string
+		Funcs   []string
+		Sorted  bool
+	}{
+		"Single":         {&Query{Start: "-4h"}, []string{"waggle"}, []string{""}, false},
+		"SingleFuncs":    {&Query{Start: "-4h", Func: StringList{"min", "max"}}, []string{"waggle"}, []string{"min,max"}, false},
+		"Limit":          {&Query{Start: "-4h", Func: StringList{"min", "max"}, Limit: intptr(10)}, []string{"waggle", "waggle"}, []string{"min", "max"}, true},
+		"Multiple":       {&Query{Start: "-4h", Bucket: strptr("all")}, []string{"waggle", "downsampled"}, []string{"", ""}, true},
+		"MultipleFuncs":  {&Query{Start: "-4h", Bucket: strptr("all"), Func: StringList{"min", "max"}}, []string{"waggle", "waggle", "downsampled", "downsampled"}, []string{"min", "max", "min", "max"}, true},
+		"MultipleWindow": {&Query{Start: "-4h", Bucket: strptr("all"), Func: StringList{"mean"}, Window: strptr("1h")}, []string{"waggle", "downsampled"}, []string{"mean", "mean"}, true},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			fluxQueries, err := backend.buildBucketQueries(tc.Query, buildSortedFluxQuery)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fluxQueries) != len(tc.Buckets) {
+				t.Fatalf("expected %d queries. got %d", len(tc.Buckets), len(fluxQueries))
+			}
+			for i, fq := range fluxQueries {
+				if fq.bucket != tc.Buckets[i] || strings.Join(fq.query.Func, ",") != tc.Funcs[i] {
+					t.Errorf("query %d: expected %s %s. got %s %s", i, tc.Buckets[i], tc.Funcs[i], fq.bucket, fq.query.Func)
+				}
+				// every merged query must be sorted by time, as tables are otherwise returned by series
+				if sorted := strings.HasSuffix(fq.flux, `group() |> sort(columns: ["_time"])`); sorted != tc.Sorted {
+					t.Errorf("query %d: expected sorted %v. got %s", i, tc.Sorted, fq.flux)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBucketAliases(t *testing.T) {
+	aliases, err := parseBucketAliases("all=waggle|downsampled,raw=waggle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(aliases["all"], []string{"waggle", "downsampled"}) || !slices.Equal(aliases["raw"], []string{"waggle"}) {
+		t.Fatalf("unexpected aliases %v", aliases)
+	}
+	if _, err := parseBucketAliases("all"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+// influxStreamCSV is an annotated CSV response from InfluxDB with two records.
+const influxStreamCSV = `#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string
+#group,false,false,true,true,false,false,true,true,true
+#default,_result,,,,,,,,
+,result,table,_start,_stop,_time,_value,_field,_measurement,vsn
+,,0,2022-01-01T00:00:00Z,2022-01-02T00:00:00Z,2022-01-01T10:00:00Z,21.5,value,env.temperature,W001
+,,0,2022-01-01T00:00:00Z,2022-01-02T00:00:00Z,2022-01-01T10:05:00Z,21.7,value,env.temperature,W001
+`
+
+// influxStreamBackend returns influxResults reading a response which fails
+// after influxStreamCSV with err.
+type influxStreamBackend struct {
+	err error
+}
+
+func (backend *influxStreamBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	body := io.MultiReader(strings.NewReader(influxStreamCSV), iotest.ErrReader(backend.err))
+	results := api.NewQueryTableResult(io.NopCloser(body))
+	return &influxResults{results: results, query: query, useStartTimestamp: make(map[string]bool)}, nil
+}
+
+func TestInfluxResultsStreamError(t *testing.T) {
+	backend := &influxStreamBackend{err: errors.New("connection reset")}
+	results, err := backend.Query(context.Background(), &Query{Start: "-4h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer results.Close()
+
+	n := 0
+	for results.Next() {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 records before error. got %d", n)
+	}
+	if err := results.Err(); err == nil || !strings.Contains(err.Error(), "connection reset") {
+		t.Fatalf("expected stream error. got %v", err)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	latestCacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "latest_cache_requests_total",
+		Help:      "The total number of latest requests by whether they were answered by the cache.",
+	}, []string{"result"})
+	latestCacheSeries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "latest_cache_series",
+		Help:      "The number of series held by the latest cache.",
+	})
+	latestCacheEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "latest_cache_evictions_total",
+		Help:      "The total number of series evicted from the latest cache.",
+	})
+)
+
+// latestCachePruneInterval is how often records older than the max age are
+// evicted from the latest cache.
+const latestCachePruneInterval = time.Minute
+
+// LatestService returns the most recent record of each series matching a query.
+// It accepts the same query body as Service, but only uses the bucket, start,
+// end, filter, filter_expr, value_filter and format fields.
+type LatestService struct {
+	Backend Backend
+	// Cache optionally answers queries without using the backend.
+	Cache *LatestCache
+	// Queue optionally limits concurrent backend queries. Queries answered by
+	// the cache don't wait in it.
+	Queue *RequestQueue
+	// Cost optionally limits the estimated cost of backend queries, as for Service.
+	Cost *costLimits
+}
+
+func (svc *LatestService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := getRemoteAddr(r)
+
+	query, queryBody, ok := readQuery(w, r, remoteAddr)
+	if !ok {
+		return
+	}
+
+	if err := validateLatestQuery(query); err != nil {
+		log.Printf("%s error: failed to parse query: %s", remoteAddr, err.Error())
+		http.Error(w, fmt.Sprintf("error: failed to parse query: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	format, err := negotiateOutputFormat(r, query)
+	if err != nil {
+		log.Printf("%s error: failed to parse query: %s", remoteAddr, err.Error())
+		http.Error(w, fmt.Sprintf("error: failed to parse query: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("%s latest query: %q", remoteAddr, queryBody)
+
+	results, ok := svc.cached(query)
+	if !ok {
+		backend, ok := svc.Backend.(LatestBackend)
+		if !ok {
+			http.Error(w, "error: latest is not supported by backend", http.StatusNotImplemented)
+			return
+		}
+		leave, ok := enterQueue(w, r, svc.Queue, remoteAddr)
+		if !ok {
+			return
+		}
+		defer leave()
+		if !checkQueryCost(w, r, svc.Cost, query, remoteAddr) {
+			return
+		}
+		results, err = backend.Latest(r.Context(), query)
+	}
+	if err != nil {
+		log.Printf("%s error: failed to query backend: %s", remoteAddr, err.Error())
+		http.Error(w, fmt.Sprintf("error: failed to query backend: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	defer results.Close()
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", format.ContentType)
+	writeContentDispositionHeader(w, format)
+	w.WriteHeader(http.StatusOK)
+
+	writer := format.NewWriter(w)
+
+	for results.Next() {
+		if err := writer.WriteRecord(results.Record()); err != nil {
+			break
+		}
+	}
+
+	if err := results.Err(); err != nil {
+		log.Printf("%s error: %s", remoteAddr, err)
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Printf("%s error: failed to write results: %s", remoteAddr, err)
+	}
+}
+
+// cached answers a query using the cache, if possible.
+func (svc *LatestService) cached(query *Query) (Results, bool) {
+	if svc.Cache == nil {
+		return nil, false
+	}
+	if records, ok := svc.Cache.Latest(query, time.Now()); ok {
+		latestCacheRequestsTotal.WithLabelValues("hit").Inc()
+		return &recordResults{records: records}, true
+	}
+	latestCacheRequestsTotal.WithLabelValues("miss").Inc()
+	return nil, false
+}
+
+// validateLatestQuery checks that a query only uses fields supported by latest queries.
+func validateLatestQuery(query *Query) error {
+	unsupported := map[string]bool{
+		"head":                query.Head != nil,
+		"tail":                query.Tail != nil,
+		"experimental_func":   len(query.Func) > 0,
+		"experimental_window": query.Window != nil,
+		"pivot":               query.Pivot != nil,
+		"limit":               query.Limit != nil,
+		"cursor":              query.Cursor != "",
+		"group_by":            query.GroupBy != nil,
+	}
+	for _, k := range sortedKeys(unsupported) {
+		if unsupported[k] {
+			return fmt.Errorf("%s cannot be used with latest", k)
+		}
+	}
+	return nil
+}
+
+// latestRecords returns the most recent record of each series sorted by series key.
+func latestRecords(records []*Record) []*Record {
+	latest := make(map[string]*Record)
+	for _, rec := range records {
+		k := seriesKey(rec)
+		if prev, ok := latest[k]; !ok || rec.Timestamp.After(prev.Timestamp) {
+			latest[k] = rec
+		}
+	}
+
+	results := make([]*Record, 0, len(latest))
+	for _, k := range sortedKeys(latest) {
+		results = append(results, latest[k])
+	}
+	return results
+}
+
+// LatestCache keeps the most recent record of each series seen on the message
+// stream. As records are published after they are measured, the cache holds
+// every record timestamped after it started consuming, so it can answer latest
+// queries whose range starts after that.
+//
+// Records older than the max age are evicted, as are the oldest records once
+// there are more than max series. Queries whose range includes an evicted record
+// aren't answered by the cache.
+type LatestCache struct {
+	mu      sync.RWMutex
+	records map[string]*Record
+	// since is when the cache started consuming without interruption. it is zero
+	// while the cache isn't consuming.
+	since time.Time
+	// floor is the timestamp of the newest evicted record.
+	floor     time.Time
+	maxAge    time.Duration
+	maxSeries int
+}
+
+// NewLatestCache creates a LatestCache which evicts records older than maxAge
+// and keeps at most maxSeries series. Zero disables either limit.
+func NewLatestCache(maxAge time.Duration, maxSeries int) *LatestCache {
+	return &LatestCache{
+		records:   make(map[string]*Record),
+		maxAge:    maxAge,
+		maxSeries: maxSeries,
+	}
+}
+
+// Update adds a record to the cache if it is the most recent of its series.
+func (c *LatestCache) Update(rec *Record) {
+	k := seriesKey(rec)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if prev, ok := c.records[k]; ok && !rec.Timestamp.After(prev.Timestamp) {
+		return
+	}
+	if !rec.Timestamp.After(c.floor) {
+		// the record would be evicted anyway
+		return
+	}
+	c.records[k] = rec
+	if c.maxSeries > 0 && len(c.records) > c.maxSeries {
+		// evict a tenth of the series at once, so they aren't sorted on every update
+		c.evictOldest(len(c.records) - c.maxSeries + c.maxSeries/10)
+	}
+	latestCacheSeries.Set(float64(len(c.records)))
+}
+
+// Prune evicts the records older than the max age.
+func (c *LatestCache) Prune(now time.Time) {
+	if c.maxAge <= 0 {
+		return
+	}
+	cutoff := now.Add(-c.maxAge)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, rec := range c.records {
+		if rec.Timestamp.Before(cutoff) {
+			c.evict(k)
+		}
+	}
+	// records up to the cutoff are evicted as they arrive
+	if cutoff.After(c.floor) {
+		c.floor = cutoff
+	}
+	latestCacheSeries.Set(float64(len(c.records)))
+}
+
+// evictOldest evicts the n oldest records. c.mu must be held.
+func (c *LatestCache) evictOldest(n int) {
+	keys := make([]string, 0, len(c.records))
+	for k := range c.records {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return c.records[keys[i]].Timestamp.Before(c.records[keys[j]].Timestamp)
+	})
+	for _, k := range keys[:min(n, len(keys))] {
+		c.evict(k)
+	}
+}
+
+// evict removes the record of a series and raises the floor to its timestamp.
+// c.mu must be held.
+func (c *LatestCache) evict(k string) {
+	if ts := c.records[k].Timestamp; ts.After(c.floor) {
+		c.floor = ts
+	}
+	delete(c.records, k)
+	latestCacheEvictionsTotal.Inc()
+}
+
+// Latest returns the most recent record of each series matching a query sorted
+// by series key. It returns false if the cache can't answer the query.
+func (c *LatestCache) Latest(query *Query, now time.Time) ([]*Record, bool) {
+	// value filters select the most recent matching record, which the cache may
+	// not hold. the cache only holds records from the message stream, so it
+	// can't answer queries for other buckets.
+	if query.Bucket != nil || len(query.Buckets) > 0 || query.End != "" || query.ValueFilter != "" {
+		return nil, false
+	}
+	start, ok := parseQueryTime(query.Start, now)
+	if !ok {
+		return nil, false
+	}
+	matcher, err := newQueryMatcher(query)
+	if err != nil {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.since.IsZero() || start.Before(c.since) || !start.After(c.floor) {
+		return nil, false
+	}
+
+	var records []*Record
+	for _, rec := range c.records {
+		if rec.Timestamp.Before(start) || !matcher.match(rec.Name, rec.Meta, rec.Value) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return seriesKey(records[i]) < seriesKey(records[j])
+	})
+	return records, true
+}
+
+func (c *LatestCache) setSince(t time.Time) {
+	c.mu.Lock()
+	c.since = t
+	c.mu.Unlock()
+}
+
+// Run consumes all messages from RabbitMQ into the cache until ctx is done. It
+// reconnects after connection failures. Without a RabbitMQ URL, it returns
+// immediately and the cache never answers queries.
+func (c *LatestCache) Run(ctx context.Context, rabbitmqURL string, retryInterval time.Duration) {
+	if rabbitmqURL == "" {
+		log.Printf("latest cache disabled: no rabbitmq url")
+		return
+	}
+	for {
+		if err := c.consume(ctx, rabbitmqURL); err != nil {
+			log.Printf("latest cache error: %s", err)
+		}
+		// records may be missed until we reconnect
+		c.setSince(time.Time{})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (c *LatestCache) consume(ctx context.Context, rabbitmqURL string) error {
+	conn, err := amqp.Dial(rabbitmqURL)
+	if err != nil {
+		return fmt.Errorf("failed dial rabbitmq: %w", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open rabbitmq channel: %w", err)
+	}
+	defer ch.Close()
+
+	queue, err := ch.QueueDeclare("", false, false, true, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue: %w", err)
+	}
+
+	if err := ch.QueueBind(queue.Name, "#", "waggle.msg", false, nil); err != nil {
+		return fmt.Errorf("failed to bind queue %s to exchange: %w", queue.Name, err)
+	}
+
+	messages, err := ch.Consume(queue.Name, "", true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to consume queue %s: %w", queue.Name, err)
+	}
+
+	c.setSince(time.Now())
+	log.Printf("latest cache consuming messages")
+
+	prune := time.NewTicker(latestCachePruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-prune.C:
+			c.Prune(now)
+		case amqpMsg, ok := <-messages:
+			if !ok {
+				return fmt.Errorf("rabbitmq channel closed")
+			}
+			var msg Message
+			if err := unmarshalMessage(amqpMsg.Body, &msg); err != nil {
+				continue
+			}
+			if msg.Meta == nil {
+				msg.Meta = make(map[string]string)
+			}
+			c.Update(&Record{
+				Timestamp: msg.Timestamp,
+				Name:      msg.Name,
+				Value:     msg.Value,
+				Meta:      msg.Meta,
+			})
+		}
+	}
+}
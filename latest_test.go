@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLatestService(t *testing.T) {
+	t1 := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	t2 := time.Date(2022, 1, 1, 10, 5, 0, 0, time.UTC)
+
+	records := []*Record{
+		{Timestamp: t2, Name: "env.temperature", Value: 21.7, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: t1, Name: "env.temperature", Value: 21.5, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: t1, Name: "env.temperature", Value: 18.2, Meta: map[string]string{"vsn": "W002"}},
+		{Timestamp: t2, Name: "env.humidity", Value: 40.1, Meta: map[string]string{"vsn": "W001"}},
+	}
+
+	svc := &LatestService{Backend: &DummyBackend{records}}
+
+	testcases := map[string]struct {
+		body   string
+		status int
+		resp   string
+	}{
+		"Latest": {`{"start": "-1h", "filter": {"name": "env.temperature"}}`, http.StatusOK,
+			`{"timestamp":"2022-01-01T10:05:00Z","name":"env.temperature","value":21.7,"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":18.2,"meta":{"vsn":"W002"}}
+`},
+		"Tail":         {`{"start": "-1h", "tail": 1}`, http.StatusBadRequest, "error: failed to parse query: tail cannot be used with latest\n"},
+		"MissingStart": {`{}`, http.StatusBadRequest, "error: failed to parse query: missing start field\n"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/latest", bytes.NewBufferString(tc.body))
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			resp := w.Result()
+			assertStatusCode(t, resp, tc.status)
+			assertReadBody(t, resp, []byte(tc.resp))
+		})
+	}
+}
+
+func TestLatestNotSupported(t *testing.T) {
+	svc := &LatestService{Backend: &queryOnlyBackend{}}
+	r := httptest.NewRequest("POST", "/api/v1/latest", bytes.NewBufferString(`{"start": "-1h"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusNotImplemented)
+}
+
+func TestLatestCache(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cache := NewLatestCache(0, 0)
+	cache.Update(&Record{Timestamp: now.Add(-10 * time.Minute), Name: "env.temperature", Value: 21.5, Meta: map[string]string{"vsn": "W001"}})
+	cache.Update(&Record{Timestamp: now.Add(-5 * time.Minute), Name: "env.temperature", Value: 21.7, Meta: map[string]string{"vsn": "W001"}})
+	// older records don't replace newer ones
+	cache.Update(&Record{Timestamp: now.Add(-20 * time.Minute), Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": "W001"}})
+	cache.Update(&Record{Timestamp: now.Add(-50 * time.Minute), Name: "env.temperature", Value: 18.2, Meta: map[string]string{"vsn": "W002"}})
+
+	// cache can't answer anything until it is consuming
+	if _, ok := cache.Latest(&Query{Start: "-30m"}, now); ok {
+		t.Fatalf("expected cache miss before consuming")
+	}
+
+	cache.setSince(now.Add(-time.Hour))
+
+	records, ok := cache.Latest(&Query{Start: "-30m"}, now)
+	if !ok {
+		t.Fatalf("expected cache hit")
+	}
+	if len(records) != 1 || records[0].Value != 21.7 {
+		t.Fatalf("unexpected records %v", records)
+	}
+
+	records, ok = cache.Latest(&Query{Start: "-1h", Filter: map[string]string{"vsn": "W002"}}, now)
+	if !ok {
+		t.Fatalf("expected cache hit")
+	}
+	if len(records) != 1 || records[0].Value != 18.2 {
+		t.Fatalf("unexpected records %v", records)
+	}
+
+	misses := map[string]*Query{
+		"BeforeSince": {Start: "-2h"},
+		"Months":      {Start: "-1mo"},
+		"End":         {Start: "-30m", End: "-10m"},
+		"ValueFilter": {Start: "-30m", ValueFilter: ">20"},
+		"Bucket":      {Start: "-30m", Bucket: strptr("downsampled")},
+		"Buckets":     {Start: "-30m", Buckets: []string{"downsampled"}},
+	}
+	for name, query := range misses {
+		if _, ok := cache.Latest(query, now); ok {
+			t.Errorf("%s: expected cache miss", name)
+		}
+	}
+}
+
+func TestLatestCacheEviction(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	update := func(cache *LatestCache, vsn string, ago time.Duration) {
+		cache.Update(&Record{Timestamp: now.Add(-ago), Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": vsn}})
+	}
+
+	t.Run("MaxAge", func(t *testing.T) {
+		cache := NewLatestCache(time.Hour, 0)
+		cache.setSince(now.Add(-3 * time.Hour))
+		update(cache, "W001", 2*time.Hour)
+		update(cache, "W002", 10*time.Minute)
+
+		cache.Prune(now)
+
+		if n := len(cache.records); n != 1 {
+			t.Fatalf("expected 1 series. got %d", n)
+		}
+		// the evicted series may be the latest in range
+		if _, ok := cache.Latest(&Query{Start: "-3h"}, now); ok {
+			t.Fatalf("expected cache miss for range including evicted record")
+		}
+		if records, ok := cache.Latest(&Query{Start: "-30m"}, now); !ok || len(records) != 1 {
+			t.Fatalf("expected cache hit with 1 record. got %v %v", records, ok)
+		}
+		// records older than the max age aren't added back
+		update(cache, "W001", 2*time.Hour)
+		if n := len(cache.records); n != 1 {
+			t.Fatalf("expected 1 series. got %d", n)
+		}
+	})
+
+	t.Run("MaxSeries", func(t *testing.T) {
+		cache := NewLatestCache(0, 2)
+		cache.setSince(now.Add(-3 * time.Hour))
+		update(cache, "W001", 30*time.Minute)
+		update(cache, "W002", 20*time.Minute)
+		update(cache, "W003", 10*time.Minute)
+
+		if _, ok := cache.records[seriesKey(&Record{Name: "env.temperature", Meta: map[string]string{"vsn": "W001"}})]; ok {
+			t.Fatalf("expected oldest series to be evicted")
+		}
+		if _, ok := cache.Latest(&Query{Start: "-1h"}, now); ok {
+			t.Fatalf("expected cache miss for range including evicted record")
+		}
+		if records, ok := cache.Latest(&Query{Start: "-25m"}, now); !ok || len(records) != 2 {
+			t.Fatalf("expected cache hit with 2 records. got %v %v", records, ok)
+		}
+	})
+}
+
+func TestLatestCacheRunWithoutURL(t *testing.T) {
+	cache := NewLatestCache(0, 0)
+	done := make(chan struct{})
+	go func() {
+		cache.Run(context.Background(), "", time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected run to return without rabbitmq url")
+	}
+}
+
+func TestLatestServiceQueue(t *testing.T) {
+	now := time.Now()
+	records := []*Record{
+		{Timestamp: now.Add(-time.Minute), Name: "env.temperature", Value: 21.7, Meta: map[string]string{"vsn": "W001"}},
+	}
+
+	cache := NewLatestCache(0, 0)
+	cache.setSince(now.Add(-time.Hour))
+	cache.Update(records[0])
+
+	svc := &LatestService{
+		Backend: &DummyBackend{records},
+		Cache:   cache,
+		Queue:   NewRequestQueue(1, 10*time.Millisecond),
+	}
+
+	// occupy the only slot in the queue
+	if err := svc.Queue.Enter(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Queue.Leave()
+
+	latest := func(body string) *http.Response {
+		r := httptest.NewRequest("POST", "/api/v1/latest", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	// cached queries don't wait in the queue
+	assertStatusCode(t, latest(`{"start": "-30m"}`), http.StatusOK)
+	assertStatusCode(t, latest(`{"start": "-2h"}`), http.StatusServiceUnavailable)
+}
+
+func TestParseQueryTime(t *testing.T) {
+	now := time.Date(2022, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	testcases := map[string]struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		"Hours":     {"-4h", now.Add(-4 * time.Hour), true},
+		"Combined":  {"-1d2h30m", now.Add(-26*time.Hour - 30*time.Minute), true},
+		"Weeks":     {"-1w", now.Add(-7 * 24 * time.Hour), true},
+		"Timestamp": {"2022-01-01T00:00:00Z", time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		"Months":    {"-1mo", time.Time{}, false},
+		"Positive":  {"4h", time.Time{}, false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got, ok := parseQueryTime(tc.s, now)
+			if ok != tc.ok || !got.Equal(tc.want) {
+				t.Fatalf("expected %s %v. got %s %v", tc.want, tc.ok, got, ok)
+			}
+		})
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
@@ -13,29 +15,117 @@ import (
 
 func main() {
 	addr := flag.String("addr", ":10000", "service addr")
+	backendType := flag.String("backend", getenv("BACKEND", "influxdb"), "query backend (influxdb or file)")
+	fileDir := flag.String("file.dir", getenv("FILE_DIR", ""), "directory of archived records used by file backend")
+	fileMaxRecords := flag.Int("file.max-records", mustParseInt(getenv("FILE_MAX_RECORDS", "10000000")), "max number of archived records a query may match with file backend (0 disables limit)")
 	influxdbURL := flag.String("influxdb.url", getenv("INFLUXDB_URL", "http://localhost:8086"), "influxdb url")
 	influxdbToken := flag.String("influxdb.token", getenv("INFLUXDB_TOKEN", ""), "influxdb token")
 	influxdbBucket := flag.String("influxdb.bucket", getenv("INFLUXDB_BUCKET", ""), "influxdb bucket")
+	influxdbBucketAliases := flag.String("influxdb.bucket-aliases", getenv("INFLUXDB_BUCKET_ALIASES", ""), "bucket aliases like all=bucket1|bucket2,raw=bucket1")
 	influxdbTimeout := flag.Duration("influxdb.timeout", mustParseDuration(getenv("INFLUXDB_TIMEOUT", "15m")), "influxdb client timeout")
+	influxdbSplitSpan := flag.Duration("influxdb.split-span", mustParseDuration(getenv("INFLUXDB_SPLIT_SPAN", "0s")), "split paged queries with longer ranges into sub-range queries (0 disables splitting)")
+	influxdbSplitParallelism := flag.Int("influxdb.split-parallelism", mustParseInt(getenv("INFLUXDB_SPLIT_PARALLELISM", "1")), "max number of sub-range queries made at once")
+	queueSize := flag.Int("queue.size", mustParseInt(getenv("QUEUE_SIZE", "0")), "max number of concurrent queries (0 disables queue)")
+	queueTimeout := flag.Duration("queue.timeout", mustParseDuration(getenv("QUEUE_TIMEOUT", "30s")), "max time a query waits in the queue")
 	rabbitmqURL := flag.String("rabbitmq.url", getenv("RABBITMQ_URL", ""), "rabbitmq url")
+	latestCache := flag.Bool("latest.cache", mustParseBool(getenv("LATEST_CACHE", "false")), "answer latest queries from messages cached from rabbitmq")
+	latestCacheMaxAge := flag.Duration("latest.cache-max-age", mustParseDuration(getenv("LATEST_CACHE_MAX_AGE", "24h")), "max age of records held by the latest cache (0 disables limit)")
+	latestCacheMaxSeries := flag.Int("latest.cache-max-series", mustParseInt(getenv("LATEST_CACHE_MAX_SERIES", "1000000")), "max number of series held by the latest cache (0 disables limit)")
+	coalesceBuffer := flag.Int("query.coalesce-buffer", mustParseInt(getenv("QUERY_COALESCE_BUFFER", "10000")), "max records buffered for each query sharing results of an identical query (0 disables coalescing)")
+	costLimit := flag.Float64("query.cost-limit", mustParseFloat(getenv("QUERY_COST_LIMIT", "0")), "estimated query cost above which queries must set allow_expensive (0 disables limit)")
+	maxCost := flag.Float64("query.max-cost", mustParseFloat(getenv("QUERY_MAX_COST", "0")), "estimated query cost above which queries are rejected. queries which can't be estimated are also rejected (0 disables limit)")
+	cacheDir := flag.String("cache.dir", getenv("CACHE_DIR", ""), "directory to cache historical query results in (empty disables cache)")
+	cacheMaxSize := flag.Int64("cache.max-size", int64(mustParseInt(getenv("CACHE_MAX_SIZE", "1073741824"))), "max total size of cached query results in bytes")
+	cacheTTL := flag.Duration("cache.ttl", mustParseDuration(getenv("CACHE_TTL", "24h")), "max time query results are cached")
+	cacheGrace := flag.Duration("cache.grace", mustParseDuration(getenv("CACHE_GRACE", "1h")), "time after the end of a query range before its results are cached, to allow for late records")
 	streamHeartbeatDuration := flag.Duration("stream.heartbeat-duration", mustParseDuration(getenv("STREAM_HEARTBEAT_DURATION", "15s")), "stream heartbeat duration")
 	flag.Parse()
 
-	log.Printf("connecting to influxdb at %s", *influxdbURL)
-	client := influxdb2.NewClient(*influxdbURL, *influxdbToken)
-	defer client.Close()
+	var backend Backend
 
-	// TODO figure out reasonable timeout on potentially large result sets
-	client.Options().HTTPClient().Timeout = *influxdbTimeout
+	switch *backendType {
+	case "influxdb":
+		aliases, err := parseBucketAliases(*influxdbBucketAliases)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("connecting to influxdb at %s", *influxdbURL)
+		client := influxdb2.NewClient(*influxdbURL, *influxdbToken)
+		defer client.Close()
+
+		// TODO figure out reasonable timeout on potentially large result sets
+		client.Options().HTTPClient().Timeout = *influxdbTimeout
+
+		backend = &InfluxBackend{
+			Client:           client,
+			Org:              "waggle",
+			Bucket:           *influxdbBucket,
+			BucketAliases:    aliases,
+			SplitSpan:        *influxdbSplitSpan,
+			SplitParallelism: *influxdbSplitParallelism,
+		}
+	case "file":
+		log.Printf("serving archived records from %s", *fileDir)
+		backend = &FileBackend{Dir: *fileDir, MaxRecords: *fileMaxRecords}
+	default:
+		log.Fatalf("unknown backend %q", *backendType)
+	}
+
+	// only queries are cached. latest and metadata queries use the backend directly.
+	queryBackend := backend
+
+	if *cacheDir != "" {
+		cache, err := NewCacheBackend(&CacheConfig{
+			Backend: backend,
+			Dir:     *cacheDir,
+			MaxSize: *cacheMaxSize,
+			TTL:     *cacheTTL,
+			Grace:   *cacheGrace,
+		})
+		if err != nil {
+			log.Fatalf("failed to create query cache: %s", err)
+		}
+		queryBackend = cache
+	}
+
+	if *coalesceBuffer > 0 {
+		queryBackend = NewCoalescingBackend(queryBackend, *coalesceBuffer)
+	}
+
+	// costs are only estimated when a limit is set, as it takes an extra backend query
+	var cardinality CardinalityBackend
+	if *costLimit > 0 || *maxCost > 0 {
+		var ok bool
+		if cardinality, ok = backend.(CardinalityBackend); !ok {
+			log.Fatalf("%s backend does not support query cost limits", *backendType)
+		}
+	}
+
+	// result columns are listed up front by backends which support it
+	metadata, _ := backend.(MetadataBackend)
 
 	querySvc := NewService(&ServiceConfig{
-		Backend: &InfluxBackend{
-			Client: client,
-			Org:    "waggle",
-			Bucket: *influxdbBucket,
-		},
+		Backend:      queryBackend,
+		QueueSize:    *queueSize,
+		QueueTimeout: *queueTimeout,
+		Cardinality:  cardinality,
+		CostLimit:    *costLimit,
+		MaxCost:      *maxCost,
+		Metadata:     metadata,
 	})
 
+	latestSvc := &LatestService{
+		Backend: backend,
+		Queue:   querySvc.queue,
+		Cost:    querySvc.cost,
+	}
+
+	if *latestCache {
+		latestSvc.Cache = NewLatestCache(*latestCacheMaxAge, *latestCacheMaxSeries)
+		go latestSvc.Cache.Run(context.Background(), *rabbitmqURL, 10*time.Second)
+	}
+
 	streamSvc := &StreamService{
 		RabbitMQURL:       *rabbitmqURL,
 		HeartbeatDuration: *streamHeartbeatDuration,
@@ -45,6 +135,14 @@ func main() {
 	http.Handle("/", http.RedirectHandler("https://docs.waggle-edge.ai/docs/tutorials/accessing-data", http.StatusTemporaryRedirect))
 	http.Handle("/metrics", promhttp.Handler())
 	http.Handle("/api/v1/query", querySvc)
+	// explained queries only estimate their cost on request, so it's available
+	// without a cost limit
+	explainCardinality, _ := backend.(CardinalityBackend)
+	http.Handle("/api/v1/query/explain", &ExplainService{Backend: backend, Cardinality: explainCardinality, Queue: querySvc.queue})
+	http.Handle("/api/v1/latest", latestSvc)
+	http.Handle("/api/v1/names", &MetadataService{Backend: backend, Kind: MetadataNames, Queue: querySvc.queue, Cost: querySvc.cost})
+	http.Handle("/api/v1/meta/keys", &MetadataService{Backend: backend, Kind: MetadataKeys, Queue: querySvc.queue, Cost: querySvc.cost})
+	http.Handle("/api/v1/meta/{key}/values", &MetadataService{Backend: backend, Kind: MetadataValues, Queue: querySvc.queue, Cost: querySvc.cost})
 	http.Handle("/api/v0/stream", streamSvc)
 
 	log.Printf("service listening on %s", *addr)
@@ -67,3 +165,27 @@ func mustParseDuration(s string) time.Duration {
 	}
 	return d
 }
+
+func mustParseInt(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func mustParseFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func mustParseBool(s string) bool {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
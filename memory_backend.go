@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryBackend implements a backend which holds records in memory and evaluates
+// queries against them in process. Unlike DummyBackend, it honours the full
+// query with the same semantics as InfluxBackend, so it can stand in for
+// InfluxDB in tests.
+type MemoryBackend struct {
+	// Now returns the time relative query times are resolved against. It defaults to time.Now.
+	Now func() time.Time
+
+	mu      sync.RWMutex
+	records []*Record
+}
+
+// NewMemoryBackend creates a MemoryBackend holding records.
+func NewMemoryBackend(records []*Record) *MemoryBackend {
+	backend := &MemoryBackend{}
+	backend.Add(records...)
+	return backend
+}
+
+// Add adds records to the backend.
+func (backend *MemoryBackend) Add(records ...*Record) {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	for _, rec := range records {
+		if rec.Meta == nil {
+			rec.Meta = make(map[string]string)
+		}
+		backend.records = append(backend.records, rec)
+	}
+}
+
+// Query provides the records matching a query through Results.
+func (backend *MemoryBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	records, err := evaluateQuery(backend.snapshot(), query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return &recordResults{records: records}, nil
+}
+
+// Latest provides the most recent record of each series matching a query through Results.
+func (backend *MemoryBackend) Latest(ctx context.Context, query *Query) (Results, error) {
+	if err := validateLatestQuery(query); err != nil {
+		return nil, err
+	}
+	records, err := selectRecords(backend.snapshot(), query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return &recordResults{records: latestRecords(records)}, nil
+}
+
+// Names lists the names of the records matching a query.
+func (backend *MemoryBackend) Names(ctx context.Context, query *Query) ([]string, error) {
+	records, err := selectRecords(backend.snapshot(), query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return distinctNames(records), nil
+}
+
+// MetaKeys lists the meta keys of the records matching a query.
+func (backend *MemoryBackend) MetaKeys(ctx context.Context, query *Query) ([]string, error) {
+	records, err := selectRecords(backend.snapshot(), query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return distinctMetaKeys(records), nil
+}
+
+// MetaValues lists the values of a meta key in the records matching a query.
+func (backend *MemoryBackend) MetaValues(ctx context.Context, query *Query, key string) ([]string, error) {
+	records, err := selectRecords(backend.snapshot(), query, backend.now())
+	if err != nil {
+		return nil, err
+	}
+	return distinctMetaValues(records, key), nil
+}
+
+// Cardinality counts the series of the records matching a query.
+func (backend *MemoryBackend) Cardinality(ctx context.Context, query *Query) (int, error) {
+	records, err := selectRecords(backend.snapshot(), query, backend.now())
+	if err != nil {
+		return 0, err
+	}
+	return countSeries(records), nil
+}
+
+// snapshot returns the records held when called. Records added later aren't included.
+func (backend *MemoryBackend) snapshot() []*Record {
+	backend.mu.RLock()
+	defer backend.mu.RUnlock()
+	return backend.records[:len(backend.records):len(backend.records)]
+}
+
+func (backend *MemoryBackend) now() time.Time {
+	if backend.Now != nil {
+		return backend.Now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// mergeResults merges multiple results into one, always taking the record with
+// the earliest timestamp next. When each of results is ordered by timestamp, so
+// is the merged output. Records sharing a timestamp are taken in the order of
+// results.
+func mergeResults(results []Results) Results {
+	return &mergedResults{results: results}
+}
+
+type mergedResults struct {
+	results []Results
+	heap    mergeHeap
+	started bool
+	// last is the index of the results the current record was taken from
+	last   int
+	record *Record
+	err    error
+}
+
+func (r *mergedResults) Err() error {
+	return r.err
+}
+
+func (r *mergedResults) Close() error {
+	var errs []error
+	for _, results := range r.results {
+		errs = append(errs, results.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (r *mergedResults) Record() *Record {
+	return r.record
+}
+
+func (r *mergedResults) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if !r.started {
+		r.started = true
+		for i := range r.results {
+			if !r.advance(i) {
+				return false
+			}
+		}
+	} else if !r.advance(r.last) {
+		return false
+	}
+	if len(r.heap) == 0 {
+		return false
+	}
+	item := heap.Pop(&r.heap).(mergeItem)
+	r.record = item.record
+	r.last = item.index
+	return true
+}
+
+// advance pushes the next record of results i onto the heap. It returns false
+// if results i failed.
+func (r *mergedResults) advance(i int) bool {
+	if r.results[i].Next() {
+		heap.Push(&r.heap, mergeItem{record: r.results[i].Record(), index: i})
+		return true
+	}
+	if err := r.results[i].Err(); err != nil {
+		r.err = err
+		return false
+	}
+	return true
+}
+
+type mergeItem struct {
+	record *Record
+	index  int
+}
+
+// mergeHeap orders the next record of each results by timestamp and then by index.
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int {
+	return len(h)
+}
+
+func (h mergeHeap) Less(i, j int) bool {
+	if !h[i].record.Timestamp.Equal(h[j].record.Timestamp) {
+		return h[i].record.Timestamp.Before(h[j].record.Timestamp)
+	}
+	return h[i].index < h[j].index
+}
+
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	*h = append(*h, x.(mergeItem))
+}
+
+func (h *mergeHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
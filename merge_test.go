@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMergeResults(t *testing.T) {
+	ts := func(minute int) time.Time {
+		return time.Date(2022, 1, 1, 10, minute, 0, 0, time.UTC)
+	}
+
+	raw := []*Record{
+		{Timestamp: ts(0), Name: "raw"},
+		{Timestamp: ts(2), Name: "raw"},
+		{Timestamp: ts(4), Name: "raw"},
+	}
+	downsampled := []*Record{
+		{Timestamp: ts(1), Name: "downsampled"},
+		{Timestamp: ts(2), Name: "downsampled"},
+		{Timestamp: ts(5), Name: "downsampled"},
+	}
+
+	results := mergeResults([]Results{
+		&recordResults{records: raw},
+		&recordResults{},
+		&recordResults{records: downsampled},
+	})
+
+	want := []*Record{raw[0], downsampled[0], raw[1], downsampled[1], raw[2], downsampled[2]}
+
+	var got []*Record
+	for results.Next() {
+		got = append(got, results.Record())
+	}
+	if err := results.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d records. got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("record %d: expected %s at %s. got %s at %s", i, want[i].Name, want[i].Timestamp, got[i].Name, got[i].Timestamp)
+		}
+	}
+}
+
+func TestMergeResultsSeries(t *testing.T) {
+	ts := func(minute int) time.Time {
+		return time.Date(2022, 1, 1, 10, minute, 0, 0, time.UTC)
+	}
+
+	// each bucket holds multiple series, sorted by time as by buildSortedFluxQuery
+	raw := []*Record{
+		{Timestamp: ts(0), Name: "env.temperature", Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: ts(1), Name: "env.temperature", Meta: map[string]string{"vsn": "W002"}},
+		{Timestamp: ts(3), Name: "env.temperature", Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: ts(4), Name: "env.temperature", Meta: map[string]string{"vsn": "W002"}},
+	}
+	downsampled := []*Record{
+		{Timestamp: ts(2), Name: "env.humidity", Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: ts(2), Name: "env.temperature", Meta: map[string]string{"vsn": "W003"}},
+		{Timestamp: ts(5), Name: "env.humidity", Meta: map[string]string{"vsn": "W001"}},
+	}
+
+	results := mergeResults([]Results{&recordResults{records: raw}, &recordResults{records: downsampled}})
+
+	var got []*Record
+	for results.Next() {
+		got = append(got, results.Record())
+	}
+	if len(got) != len(raw)+len(downsampled) {
+		t.Fatalf("expected %d records. got %d", len(raw)+len(downsampled), len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if got[i].Timestamp.Before(got[i-1].Timestamp) {
+			t.Fatalf("record %d at %s is before record %d at %s", i, got[i].Timestamp, i-1, got[i-1].Timestamp)
+		}
+	}
+}
+
+func TestMergeResultsError(t *testing.T) {
+	results := mergeResults([]Results{
+		&recordResults{records: []*Record{{Name: "raw"}}},
+		&failingResults{err: errors.New("bucket failed")},
+	})
+	for results.Next() {
+	}
+	if err := results.Err(); err == nil || err.Error() != "bucket failed" {
+		t.Fatalf("expected bucket failed error. got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// MetadataKind selects which metadata a MetadataService lists.
+type MetadataKind int
+
+const (
+	// MetadataNames lists distinct measurement names.
+	MetadataNames MetadataKind = iota
+	// MetadataKeys lists distinct meta keys.
+	MetadataKeys
+	// MetadataValues lists distinct values of the meta key in the {key} path value.
+	MetadataValues
+)
+
+// MetadataService lists the names, meta keys or meta values of records matching
+// a query. It accepts the same query body as Service, but only uses the bucket,
+// range and filter fields.
+type MetadataService struct {
+	Backend Backend
+	Kind    MetadataKind
+	// Queue optionally limits concurrent backend queries.
+	Queue *RequestQueue
+	// Cost optionally limits the estimated cost of backend queries, as for Service.
+	Cost *costLimits
+}
+
+func (svc *MetadataService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := getRemoteAddr(r)
+
+	backend, ok := svc.Backend.(MetadataBackend)
+	if !ok {
+		http.Error(w, "error: metadata is not supported by backend", http.StatusNotImplemented)
+		return
+	}
+
+	query, _, ok := readQuery(w, r, remoteAddr)
+	if !ok {
+		return
+	}
+
+	key := r.PathValue("key")
+	if svc.Kind == MetadataValues && !metaRE.MatchString(key) {
+		http.Error(w, fmt.Sprintf("error: invalid meta key: %q", key), http.StatusBadRequest)
+		return
+	}
+
+	leave, ok := enterQueue(w, r, svc.Queue, remoteAddr)
+	if !ok {
+		return
+	}
+	defer leave()
+
+	if !checkQueryCost(w, r, svc.Cost, query, remoteAddr) {
+		return
+	}
+
+	var values []string
+	var err error
+
+	switch svc.Kind {
+	case MetadataNames:
+		values, err = backend.Names(r.Context(), query)
+	case MetadataKeys:
+		values, err = backend.MetaKeys(r.Context(), query)
+	case MetadataValues:
+		values, err = backend.MetaValues(r.Context(), query, key)
+	}
+
+	if err != nil {
+		log.Printf("%s error: failed to query backend: %s", remoteAddr, err.Error())
+		http.Error(w, fmt.Sprintf("error: failed to query backend: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	// always return a list, even if nothing matched
+	if values == nil {
+		values = []string{}
+	}
+
+	w.Header().Add("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
+
+// distinctNames returns the sorted distinct names of records.
+func distinctNames(records []*Record) []string {
+	names := make(map[string]bool)
+	for _, rec := range records {
+		names[rec.Name] = true
+	}
+	return sortedKeys(names)
+}
+
+// distinctMetaKeys returns the sorted distinct meta keys of records.
+func distinctMetaKeys(records []*Record) []string {
+	keys := make(map[string]bool)
+	for _, rec := range records {
+		for k := range rec.Meta {
+			keys[k] = true
+		}
+	}
+	return sortedKeys(keys)
+}
+
+// distinctMetaValues returns the sorted distinct values of a meta key in records.
+// The key "name" refers to the record name.
+func distinctMetaValues(records []*Record, key string) []string {
+	if key == "name" {
+		return distinctNames(records)
+	}
+	values := make(map[string]bool)
+	for _, rec := range records {
+		if v, ok := rec.Meta[key]; ok {
+			values[v] = true
+		}
+	}
+	return sortedKeys(values)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetadataService(t *testing.T) {
+	backend := &DummyBackend{
+		Records: []*Record{
+			{
+				Timestamp: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC),
+				Name:      "env.temperature",
+				Value:     21.5,
+				Meta:      map[string]string{"vsn": "W001", "sensor": "bme680"},
+			},
+			{
+				Timestamp: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC),
+				Name:      "sys.uptime",
+				Value:     1234,
+				Meta:      map[string]string{"vsn": "W002"},
+			},
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/names", &MetadataService{Backend: backend, Kind: MetadataNames})
+	mux.Handle("/api/v1/meta/keys", &MetadataService{Backend: backend, Kind: MetadataKeys})
+	mux.Handle("/api/v1/meta/{key}/values", &MetadataService{Backend: backend, Kind: MetadataValues})
+
+	testcases := map[string]struct {
+		path   string
+		body   string
+		status int
+		resp   string
+	}{
+		"Names":        {"/api/v1/names", `{"start": "-4h"}`, http.StatusOK, `["env.temperature","sys.uptime"]` + "\n"},
+		"Keys":         {"/api/v1/meta/keys", `{"start": "-4h"}`, http.StatusOK, `["sensor","vsn"]` + "\n"},
+		"Values":       {"/api/v1/meta/vsn/values", `{"start": "-4h"}`, http.StatusOK, `["W001","W002"]` + "\n"},
+		"EmptyValues":  {"/api/v1/meta/plugin/values", `{"start": "-4h"}`, http.StatusOK, `[]` + "\n"},
+		"BadKey":       {"/api/v1/meta/1vsn/values", `{"start": "-4h"}`, http.StatusBadRequest, "error: invalid meta key: \"1vsn\"\n"},
+		"MissingStart": {"/api/v1/names", `{}`, http.StatusBadRequest, "error: failed to parse query: missing start field\n"},
+		"GetValues":    {"/api/v1/meta/vsn/values?start=-4h", "", http.StatusOK, `["W001","W002"]` + "\n"},
+		"GetNoStart":   {"/api/v1/names?vsn=W001", "", http.StatusBadRequest, "error: failed to parse query: missing start field\n"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			// queries without a body are sent as url parameters
+			r := httptest.NewRequest("GET", tc.path, nil)
+			if tc.body != "" {
+				r = httptest.NewRequest("POST", tc.path, bytes.NewBufferString(tc.body))
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			resp := w.Result()
+			assertStatusCode(t, resp, tc.status)
+			assertReadBody(t, resp, []byte(tc.resp))
+		})
+	}
+}
+
+func TestMetadataNotSupported(t *testing.T) {
+	svc := &MetadataService{Backend: &queryOnlyBackend{}, Kind: MetadataNames}
+	r := httptest.NewRequest("POST", "/api/v1/names", bytes.NewBufferString(`{"start": "-4h"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusNotImplemented)
+}
+
+func TestMetadataServiceQueue(t *testing.T) {
+	svc := &MetadataService{Backend: &DummyBackend{}, Kind: MetadataNames, Queue: NewRequestQueue(1, 10*time.Millisecond)}
+
+	// occupy the only slot in the queue
+	if err := svc.Queue.Enter(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/api/v1/names", bytes.NewBufferString(`{"start": "-4h"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusServiceUnavailable)
+
+	svc.Queue.Leave()
+	w = httptest.NewRecorder()
+	svc.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/names", bytes.NewBufferString(`{"start": "-4h"}`)))
+	assertStatusCode(t, w.Result(), http.StatusOK)
+}
+
+// queryOnlyBackend implements only the required Backend interface.
+type queryOnlyBackend struct{}
+
+func (backend *queryOnlyBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	return &recordResults{}, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/parquet-go/parquet-go/encoding"
+)
+
+// parquetRowGroupSize is the number of records buffered into each row group.
+// Row groups are written to the client as soon as they fill up, so only one
+// row group of records is ever held in memory.
+const parquetRowGroupSize = 65536
+
+// parquetWriter writes records as a Parquet file with the columns timestamp
+// (int64 nanoseconds), name, one of value_double, value_int, value_string or
+// value_bool depending on the value type and one column per meta key in sorted
+// order. Pivoted records are instead written with the columns timestamp, one
+// column per meta key and one column per measurement name, which is a double
+// column if all values are numeric or a string column otherwise. Aggregated
+// records have an additional aggregation column.
+//
+// As with the CSV writer, the columns are taken from the records in the first row
+// group and any set by SetColumns. Records with keys which first appear after
+// that fail with an error, as do keys with the same name as another column.
+// Value columns without any values in the first row group are string columns.
+type parquetWriter struct {
+	out          io.Writer
+	w            *parquet.Writer
+	sample       []*Record
+	row          parquet.Row
+	expectMeta   []string
+	expectValues []string
+	// known holds the meta and value keys which have columns.
+	known map[string]bool
+
+	// wide is true when writing pivoted records.
+	wide      bool
+	agg       bool
+	metaKeys  []string
+	valueKeys []string
+	numeric   map[string]bool
+}
+
+func newParquetWriter(w io.Writer) recordWriter {
+	return &parquetWriter{out: w, known: make(map[string]bool)}
+}
+
+func (w *parquetWriter) SetColumns(metaKeys, valueKeys []string) {
+	w.expectMeta = metaKeys
+	w.expectValues = valueKeys
+}
+
+func (w *parquetWriter) WriteRecord(rec *Record) error {
+	if w.w == nil {
+		w.sample = append(w.sample, rec)
+		if len(w.sample) < parquetRowGroupSize {
+			return nil
+		}
+		return w.writeSample()
+	}
+	return w.writeRecord(rec)
+}
+
+func (w *parquetWriter) Close() error {
+	if w.w == nil {
+		if err := w.writeSample(); err != nil {
+			return err
+		}
+	}
+	return w.w.Close()
+}
+
+// writeSample builds the schema from the sampled records and writes them.
+func (w *parquetWriter) writeSample() error {
+	metaKeys := make(map[string]bool)
+	valueKeys := make(map[string]bool)
+	w.numeric = make(map[string]bool)
+
+	for _, k := range w.expectMeta {
+		metaKeys[k] = true
+	}
+	for _, k := range w.expectValues {
+		valueKeys[k] = true
+	}
+	for _, rec := range w.sample {
+		for k := range rec.Meta {
+			metaKeys[k] = true
+		}
+		for k, v := range rec.Values {
+			_, isNumeric := toFloat64(v)
+			if !valueKeys[k] {
+				valueKeys[k] = true
+				w.numeric[k] = isNumeric
+			} else {
+				w.numeric[k] = w.numeric[k] && isNumeric
+			}
+		}
+	}
+
+	w.wide = len(w.sample) > 0 && w.sample[0].Values != nil
+	w.agg = len(w.sample) > 0 && w.sample[0].Aggregation != ""
+
+	schema := parquetGroup{parquetField("timestamp", parquet.Timestamp(parquet.Nanosecond))}
+	if !w.wide {
+		schema = append(schema,
+			parquetField("name", parquetString()),
+			parquetField("value_double", parquet.Optional(parquet.Leaf(parquet.DoubleType))),
+			parquetField("value_int", parquet.Optional(parquet.Int(64))),
+			parquetField("value_string", parquet.Optional(parquetString())),
+			parquetField("value_bool", parquet.Optional(parquet.Leaf(parquet.BooleanType))),
+		)
+	}
+	if w.agg {
+		schema = append(schema, parquetField("aggregation", parquetString()))
+	}
+
+	for _, k := range sortedKeys(metaKeys) {
+		if schema.has(k) {
+			return fmt.Errorf("meta key %q conflicts with a parquet column of the same name", k)
+		}
+		w.known[k] = true
+		w.metaKeys = append(w.metaKeys, k)
+		schema = append(schema, parquetField(k, parquet.Optional(parquetString())))
+	}
+
+	for _, k := range sortedKeys(valueKeys) {
+		if schema.has(k) {
+			return fmt.Errorf("name %q conflicts with a parquet column of the same name", k)
+		}
+		w.known[k] = true
+		w.valueKeys = append(w.valueKeys, k)
+		if w.numeric[k] {
+			schema = append(schema, parquetField(k, parquet.Optional(parquet.Leaf(parquet.DoubleType))))
+		} else {
+			schema = append(schema, parquetField(k, parquet.Optional(parquetString())))
+		}
+	}
+
+	w.w = parquet.NewWriter(w.out,
+		parquet.NewSchema("record", schema),
+		parquet.Compression(&parquet.Gzip),
+		parquet.MaxRowsPerRowGroup(parquetRowGroupSize),
+	)
+
+	for _, rec := range w.sample {
+		if err := w.writeRecord(rec); err != nil {
+			return err
+		}
+	}
+	w.sample = nil
+	return nil
+}
+
+// writeRecord writes a record as a row with a value for each column in schema order.
+func (w *parquetWriter) writeRecord(rec *Record) error {
+	for k := range rec.Meta {
+		if !w.known[k] {
+			return fmt.Errorf("meta key %q first appeared after the parquet schema was written", k)
+		}
+	}
+	for k := range rec.Values {
+		if !w.known[k] {
+			return fmt.Errorf("name %q first appeared after the parquet schema was written", k)
+		}
+	}
+
+	row := appendRequired(w.row[:0], parquet.Int64Value(rec.Timestamp.UnixNano()))
+
+	if !w.wide {
+		row = appendRequired(row, parquet.ByteArrayValue([]byte(rec.Name)))
+		row = appendUnionValue(row, rec.Value)
+	}
+
+	if w.agg {
+		row = appendRequired(row, parquet.ByteArrayValue([]byte(rec.Aggregation)))
+	}
+
+	for _, k := range w.metaKeys {
+		if v, ok := rec.Meta[k]; ok {
+			row = appendOptional(row, parquet.ByteArrayValue([]byte(v)))
+		} else {
+			row = appendNull(row)
+		}
+	}
+
+	if w.wide {
+		for _, k := range w.valueKeys {
+			row = appendWideValue(row, rec.Values[k], w.numeric[k])
+		}
+	}
+
+	w.row = row
+	_, err := w.w.WriteRows([]parquet.Row{row})
+	return err
+}
+
+// appendRequired appends v as the value of the next column, which is required.
+func appendRequired(row parquet.Row, v parquet.Value) parquet.Row {
+	return append(row, v.Level(0, 0, len(row)))
+}
+
+// appendOptional appends v as the value of the next column, which is optional.
+func appendOptional(row parquet.Row, v parquet.Value) parquet.Row {
+	return append(row, v.Level(0, 1, len(row)))
+}
+
+// appendNull appends null as the value of the next column, which is optional.
+func appendNull(row parquet.Row) parquet.Row {
+	return append(row, parquet.NullValue().Level(0, 0, len(row)))
+}
+
+// appendUnionValue appends v to the value column matching its type and appends
+// null to the others.
+func appendUnionValue(row parquet.Row, v interface{}) parquet.Row {
+	var column int
+	var value parquet.Value
+	switch v := v.(type) {
+	case float64:
+		value = parquet.DoubleValue(v)
+	case float32:
+		value = parquet.DoubleValue(float64(v))
+	case int:
+		column, value = 1, parquet.Int64Value(int64(v))
+	case int64:
+		column, value = 1, parquet.Int64Value(v)
+	case int32:
+		column, value = 1, parquet.Int64Value(int64(v))
+	case uint64:
+		if v > math.MaxInt64 {
+			value = parquet.DoubleValue(float64(v))
+		} else {
+			column, value = 1, parquet.Int64Value(int64(v))
+		}
+	case string:
+		column, value = 2, parquet.ByteArrayValue([]byte(v))
+	case bool:
+		column, value = 3, parquet.BooleanValue(v)
+	case nil:
+		column = -1
+	default:
+		column, value = 2, parquet.ByteArrayValue([]byte(fmt.Sprint(v)))
+	}
+	for i := 0; i < 4; i++ {
+		if i == column {
+			row = appendOptional(row, value)
+		} else {
+			row = appendNull(row)
+		}
+	}
+	return row
+}
+
+// appendWideValue appends v to a pivoted value column. Values which can't be
+// represented in a numeric column are written as null.
+func appendWideValue(row parquet.Row, v interface{}, numeric bool) parquet.Row {
+	if v == nil {
+		return appendNull(row)
+	}
+	if numeric {
+		if f, ok := toFloat64(v); ok {
+			return appendOptional(row, parquet.DoubleValue(f))
+		}
+		return appendNull(row)
+	}
+	if s, ok := v.(string); ok {
+		return appendOptional(row, parquet.ByteArrayValue([]byte(s)))
+	}
+	return appendOptional(row, parquet.ByteArrayValue([]byte(fmt.Sprint(v))))
+}
+
+// parquetString is a dictionary encoded string column.
+func parquetString() parquet.Node {
+	return parquet.Encoded(parquet.String(), &parquet.RLEDictionary)
+}
+
+// parquetGroup is a group of columns which keeps them in order, unlike
+// parquet.Group which sorts them by name.
+type parquetGroup []parquet.Field
+
+func (g parquetGroup) has(name string) bool {
+	for _, f := range g {
+		if f.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (g parquetGroup) group() parquet.Group {
+	group := make(parquet.Group, len(g))
+	for _, f := range g {
+		group[f.Name()] = f
+	}
+	return group
+}
+
+func (g parquetGroup) ID() int                     { return 0 }
+func (g parquetGroup) String() string              { return g.group().String() }
+func (g parquetGroup) Type() parquet.Type          { return g.group().Type() }
+func (g parquetGroup) Optional() bool              { return false }
+func (g parquetGroup) Repeated() bool              { return false }
+func (g parquetGroup) Required() bool              { return true }
+func (g parquetGroup) Leaf() bool                  { return false }
+func (g parquetGroup) Fields() []parquet.Field     { return g }
+func (g parquetGroup) Encoding() encoding.Encoding { return nil }
+func (g parquetGroup) Compression() compress.Codec { return nil }
+func (g parquetGroup) GoType() reflect.Type        { return g.group().GoType() }
+
+// groupField names a column of a parquetGroup.
+type groupField struct {
+	parquet.Node
+	name string
+}
+
+func parquetField(name string, node parquet.Node) parquet.Field {
+	return &groupField{Node: node, name: name}
+}
+
+func (f *groupField) Name() string { return f.name }
+
+func (f *groupField) Value(base reflect.Value) reflect.Value {
+	return base.MapIndex(reflect.ValueOf(f.name))
+}
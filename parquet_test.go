@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestParquetWriter(t *testing.T) {
+	records := []*Record{
+		{
+			Timestamp: time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC),
+			Name:      "sys.uptime",
+			Value:     100321,
+			Meta:      map[string]string{"node": "0000000000000001"},
+		},
+		{
+			Timestamp: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC),
+			Name:      "env.temp.htu21d",
+			Value:     2.3,
+			Meta:      map[string]string{"node": "0000000000000001", "sensor": "htu21d"},
+		},
+		{
+			Timestamp: time.Date(2023, 2, 1, 10, 45, 0, 0, time.UTC),
+			Name:      "sys.uptime",
+			Value:     "234124123",
+			Meta:      map[string]string{"node": "0000000000000002"},
+		},
+	}
+
+	file, rows := writeParquet(t, records)
+
+	var names []string
+	for _, field := range file.Schema().Fields() {
+		names = append(names, field.Name())
+	}
+	wantNames := []string{"timestamp", "name", "value_double", "value_int", "value_string", "value_bool", "node", "sensor"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("schema columns don't match\nexpect: %v\noutput: %v", wantNames, names)
+	}
+
+	want := [][]interface{}{
+		{records[0].Timestamp.UnixNano(), "sys.uptime", nil, int64(100321), nil, nil, "0000000000000001", nil},
+		{records[1].Timestamp.UnixNano(), "env.temp.htu21d", 2.3, nil, nil, nil, "0000000000000001", "htu21d"},
+		{records[2].Timestamp.UnixNano(), "sys.uptime", nil, nil, "234124123", nil, "0000000000000002", nil},
+	}
+	assertParquetRows(t, rows, want)
+}
+
+func TestParquetWriterPivot(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	records := []*Record{
+		{Timestamp: ts, Values: map[string]interface{}{"env.temperature": 20.5, "sys.status": "ok"}, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: ts, Values: map[string]interface{}{"env.temperature": int64(21)}, Meta: map[string]string{"vsn": "W002"}},
+	}
+
+	file, rows := writeParquet(t, records)
+
+	var names []string
+	for _, field := range file.Schema().Fields() {
+		names = append(names, field.Name())
+	}
+	if wantNames := []string{"timestamp", "vsn", "env.temperature", "sys.status"}; !reflect.DeepEqual(names, wantNames) {
+		t.Fatalf("schema columns don't match\nexpect: %v\noutput: %v", wantNames, names)
+	}
+
+	want := [][]interface{}{
+		{ts.UnixNano(), "W001", 20.5, "ok"},
+		{ts.UnixNano(), "W002", 21.0, nil},
+	}
+	assertParquetRows(t, rows, want)
+}
+
+func TestParquetWriterLateColumns(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	late := &Record{Timestamp: ts, Name: "upload", Value: "sample.jpg", Meta: map[string]string{"vsn": "W001", "camera": "top"}}
+
+	write := func(w recordWriter) error {
+		// the camera key first appears after the first row group
+		for i := 0; i < parquetRowGroupSize; i++ {
+			if err := w.WriteRecord(&Record{Timestamp: ts, Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": "W001"}}); err != nil {
+				return err
+			}
+		}
+		return w.WriteRecord(late)
+	}
+
+	if err := write(newParquetWriter(io.Discard)); err == nil {
+		t.Fatalf("expected error for meta key missing from schema")
+	}
+
+	var buf bytes.Buffer
+	w := newParquetWriter(&buf)
+	w.(columnWriter).SetColumns([]string{"camera", "vsn"}, nil)
+	if err := write(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := file.Schema().Lookup("camera"); !ok {
+		t.Fatalf("expected camera column")
+	}
+	if n := file.NumRows(); n != parquetRowGroupSize+1 {
+		t.Fatalf("expected %d rows. got %d", parquetRowGroupSize+1, n)
+	}
+}
+
+func TestParquetWriterConflictingColumns(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	testcases := map[string]*Record{
+		"Name":        {Timestamp: ts, Name: "env.temperature", Value: 20.0, Meta: map[string]string{"name": "W001"}},
+		"Value":       {Timestamp: ts, Name: "env.temperature", Value: 20.0, Meta: map[string]string{"value_double": "1"}},
+		"Aggregation": {Timestamp: ts, Name: "env.temperature", Value: 20.0, Aggregation: "mean", Meta: map[string]string{"aggregation": "max"}},
+		"Pivot":       {Timestamp: ts, Values: map[string]interface{}{"vsn": 20.0}, Meta: map[string]string{"vsn": "W001"}},
+	}
+
+	for name, rec := range testcases {
+		t.Run(name, func(t *testing.T) {
+			w := newParquetWriter(io.Discard)
+			if err := w.WriteRecord(rec); err != nil {
+				return
+			}
+			if err := w.Close(); err == nil {
+				t.Fatalf("expected error for key conflicting with column")
+			}
+		})
+	}
+}
+
+func TestParquetWriterEmpty(t *testing.T) {
+	file, rows := writeParquet(t, nil)
+	if file.NumRows() != 0 || len(rows) != 0 {
+		t.Fatalf("expected 0 rows. got %d", file.NumRows())
+	}
+}
+
+// writeParquet writes records with a parquetWriter and reads them back.
+func writeParquet(t *testing.T, records []*Record) (*parquet.File, []parquet.Row) {
+	var buf bytes.Buffer
+	w := newParquetWriter(&buf)
+	for _, rec := range records {
+		if err := w.WriteRecord(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.NumRows() != int64(len(records)) {
+		t.Fatalf("expected %d rows. got %d", len(records), file.NumRows())
+	}
+
+	reader := parquet.NewReader(file)
+	defer reader.Close()
+	rows := make([]parquet.Row, len(records))
+	n, err := reader.ReadRows(rows)
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	return file, rows[:n]
+}
+
+func assertParquetRows(t *testing.T, rows []parquet.Row, want [][]interface{}) {
+	t.Helper()
+	if len(rows) != len(want) {
+		t.Fatalf("expected %d rows. got %d", len(want), len(rows))
+	}
+	for i, row := range rows {
+		var got []interface{}
+		for _, v := range row {
+			switch {
+			case v.IsNull():
+				got = append(got, nil)
+			case v.Kind() == parquet.Int64:
+				got = append(got, v.Int64())
+			case v.Kind() == parquet.Double:
+				got = append(got, v.Double())
+			case v.Kind() == parquet.Boolean:
+				got = append(got, v.Boolean())
+			default:
+				got = append(got, string(v.ByteArray()))
+			}
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("row %d doesn't match\nexpect: %v\noutput: %v", i, want[i], got)
+		}
+	}
+}
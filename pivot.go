@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// pivotResults pivots the records of results in process, matching the
+// group(columns: keys) |> pivot(...) Flux query used by the InfluxBackend.
+// Records are combined into wide records per group and timestamp. Output is
+// ordered by group and then by timestamp.
+//
+// Since pivoting needs to see every record, all results are read into memory
+// on the first call to Next.
+func pivotResults(results Results, keys []string) Results {
+	return &pivotedResults{results: results, keys: keys}
+}
+
+type pivotedResults struct {
+	results Results
+	keys    []string
+	records []*Record
+	record  *Record
+	done    bool
+	err     error
+}
+
+func (r *pivotedResults) Err() error {
+	return r.err
+}
+
+func (r *pivotedResults) Close() error {
+	return r.results.Close()
+}
+
+func (r *pivotedResults) Record() *Record {
+	return r.record
+}
+
+func (r *pivotedResults) Next() bool {
+	if !r.done {
+		r.done = true
+		r.records, r.err = pivotRecords(r.results, r.keys)
+		if r.err != nil {
+			return false
+		}
+	}
+	if len(r.records) == 0 {
+		return false
+	}
+	r.record = r.records[0]
+	r.records = r.records[1:]
+	return true
+}
+
+type pivotGroup struct {
+	key  string
+	rows map[time.Time]*Record
+}
+
+func pivotRecords(results Results, keys []string) ([]*Record, error) {
+	groups := make(map[string]*pivotGroup)
+
+	for results.Next() {
+		rec := results.Record()
+
+		meta := make(map[string]string)
+		for _, k := range keys {
+			if v, ok := rec.Meta[k]; ok {
+				meta[k] = v
+			}
+		}
+
+		key := pivotGroupKey(keys, meta)
+		group, ok := groups[key]
+		if !ok {
+			group = &pivotGroup{key: key, rows: make(map[time.Time]*Record)}
+			groups[key] = group
+		}
+
+		ts := rec.Timestamp.UTC()
+		row, ok := group.rows[ts]
+		if !ok {
+			row = &Record{Timestamp: rec.Timestamp, Values: make(map[string]interface{}), Meta: meta}
+			group.rows[ts] = row
+		}
+		row.Values[rec.Name] = rec.Value
+	}
+
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+
+	var records []*Record
+	for _, key := range sortedKeys(groups) {
+		group := groups[key]
+		rows := make([]*Record, 0, len(group.rows))
+		for _, row := range group.rows {
+			rows = append(rows, row)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			return rows[i].Timestamp.Before(rows[j].Timestamp)
+		})
+		records = append(records, rows...)
+	}
+	return records, nil
+}
+
+// pivotGroupKey builds a key which uniquely identifies the values of keys in
+// meta. Missing keys are distinguished from empty values.
+func pivotGroupKey(keys []string, meta map[string]string) string {
+	var b strings.Builder
+	for _, k := range keys {
+		if v, ok := meta[k]; ok {
+			b.WriteByte('=')
+			b.WriteString(v)
+		}
+		b.WriteByte(0)
+	}
+	return b.String()
+}
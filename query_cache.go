@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryCacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "query_cache_requests_total",
+		Help:      "The total number of queries by whether they were answered by the cache, missed or bypassed it.",
+	}, []string{"result"})
+	queryCacheEvictionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "query_cache_evictions_total",
+		Help:      "The total number of cached results evicted by reason.",
+	}, []string{"reason"})
+	queryCacheSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "query_cache_size_bytes",
+		Help:      "The total size of cached results on disk.",
+	})
+)
+
+// queryCacheExt is the extension of cached result files.
+const queryCacheExt = ".ndjson.gz"
+
+// CacheConfig holds the options for a CacheBackend.
+type CacheConfig struct {
+	Backend Backend
+	// Dir is the directory cached results are stored in.
+	Dir string
+	// MaxSize is the total size in bytes of cached results. The least recently
+	// used results are evicted past this size. Zero means no limit.
+	MaxSize int64
+	// TTL is how long results are cached. Zero means no limit.
+	TTL time.Duration
+	// Grace is how long after the end of a query's range its results may still
+	// change as late records are written. Queries ending within the grace period
+	// aren't cached.
+	Grace time.Duration
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
+}
+
+// CacheBackend wraps a backend and caches the results of historical queries on
+// disk. Only queries with an absolute start and an absolute end further in the
+// past than the grace period are cached, as the results of other queries may
+// still change. Results are stored once they have been read completely without
+// error, so queries which fail, are cancelled or are only partially read are not
+// cached.
+type CacheBackend struct {
+	backend Backend
+	dir     string
+	maxSize int64
+	ttl     time.Duration
+	grace   time.Duration
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*queryCacheEntry
+	size    int64
+}
+
+type queryCacheEntry struct {
+	size     int64
+	created  time.Time
+	lastUsed time.Time
+}
+
+// NewCacheBackend creates a CacheBackend. Results already cached in the
+// directory are reused.
+func NewCacheBackend(config *CacheConfig) (*CacheBackend, error) {
+	c := &CacheBackend{
+		backend: config.Backend,
+		dir:     config.Dir,
+		maxSize: config.MaxSize,
+		ttl:     config.TTL,
+		grace:   config.Grace,
+		now:     config.Now,
+		entries: make(map[string]*queryCacheEntry),
+	}
+	if c.now == nil {
+		c.now = time.Now
+	}
+
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		key, ok := strings.CutSuffix(file.Name(), queryCacheExt)
+		if !ok {
+			// remove partially written results left behind
+			if strings.HasPrefix(file.Name(), "tmp-") {
+				os.Remove(filepath.Join(c.dir, file.Name()))
+			}
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries[key] = &queryCacheEntry{size: info.Size(), created: info.ModTime(), lastUsed: info.ModTime()}
+		c.size += info.Size()
+	}
+
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Query answers a query from the cache if possible or from the wrapped backend
+// otherwise.
+func (c *CacheBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	key, ok := queryCacheKey(query, c.now().Add(-c.grace))
+	if !ok {
+		queryCacheRequestsTotal.WithLabelValues("bypass").Inc()
+		return c.backend.Query(ctx, query)
+	}
+
+	if results, ok := c.lookup(key); ok {
+		queryCacheRequestsTotal.WithLabelValues("hit").Inc()
+		return results, nil
+	}
+	queryCacheRequestsTotal.WithLabelValues("miss").Inc()
+
+	results, err := c.backend.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(c.dir, "tmp-*")
+	if err != nil {
+		log.Printf("query cache error: %s", err)
+		return results, nil
+	}
+	zw := gzip.NewWriter(f)
+	return &cachingResults{
+		Results: results,
+		ctx:     ctx,
+		cache:   c,
+		key:     key,
+		f:       f,
+		zw:      zw,
+		encoder: json.NewEncoder(zw),
+	}, nil
+}
+
+// lookup opens the cached results for key, if present and not expired.
+func (c *CacheBackend) lookup(key string) (Results, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	now := c.now()
+	if c.ttl > 0 && now.Sub(entry.created) > c.ttl {
+		c.remove(key)
+		queryCacheEvictionsTotal.WithLabelValues("ttl").Inc()
+		return nil, false
+	}
+
+	// an open file can still be read after it is evicted
+	results, err := openCachedResults(c.path(key))
+	if err != nil {
+		log.Printf("query cache error: %s", err)
+		c.remove(key)
+		return nil, false
+	}
+	entry.lastUsed = now
+	return results, true
+}
+
+// store moves a completely written result file into the cache.
+func (c *CacheBackend) store(key string, tmpPath string) error {
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	}
+	if c.maxSize > 0 && info.Size() > c.maxSize {
+		return os.Remove(tmpPath)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(tmpPath, c.path(key)); err != nil {
+		return err
+	}
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.size
+	}
+	now := c.now()
+	c.entries[key] = &queryCacheEntry{size: info.Size(), created: now, lastUsed: now}
+	c.size += info.Size()
+	c.evict()
+	return nil
+}
+
+// evict removes expired results and then the least recently used results until
+// the cache fits in its max size. c.mu must be held.
+func (c *CacheBackend) evict() {
+	now := c.now()
+	if c.ttl > 0 {
+		for key, entry := range c.entries {
+			if now.Sub(entry.created) > c.ttl {
+				c.remove(key)
+				queryCacheEvictionsTotal.WithLabelValues("ttl").Inc()
+			}
+		}
+	}
+
+	if c.maxSize > 0 && c.size > c.maxSize {
+		keys := sortedKeys(c.entries)
+		sort.SliceStable(keys, func(i, j int) bool {
+			return c.entries[keys[i]].lastUsed.Before(c.entries[keys[j]].lastUsed)
+		})
+		for _, key := range keys {
+			if c.size <= c.maxSize {
+				break
+			}
+			c.remove(key)
+			queryCacheEvictionsTotal.WithLabelValues("size").Inc()
+		}
+	}
+
+	queryCacheSizeBytes.Set(float64(c.size))
+}
+
+// remove deletes the results for key. c.mu must be held.
+func (c *CacheBackend) remove(key string) {
+	if entry, ok := c.entries[key]; ok {
+		c.size -= entry.size
+		delete(c.entries, key)
+	}
+	os.Remove(c.path(key))
+	queryCacheSizeBytes.Set(float64(c.size))
+}
+
+func (c *CacheBackend) path(key string) string {
+	return filepath.Join(c.dir, key+queryCacheExt)
+}
+
+// queryCacheKey returns the cache key for a query. It returns false if the
+// query's results may still change, which is the case unless the query has an
+// absolute start and an absolute end before closed, the time before which
+// ranges are considered closed.
+func queryCacheKey(query *Query, closed time.Time) (string, bool) {
+	if _, err := time.Parse(time.RFC3339Nano, query.Start); err != nil {
+		return "", false
+	}
+	end, err := time.Parse(time.RFC3339Nano, query.End)
+	if err != nil || !end.Before(closed) {
+		return "", false
+	}
+	return queryKey(query), true
+}
+
+// queryKey returns a key which is the same for queries with the same results
+// from a backend. Absolute times are normalized to UTC and the output format and
+// cost override are ignored.
+func queryKey(query *Query) string {
+	q := *query
+	q.Format = ""
+	q.Summary = false
+	q.AllowExpensive = false
+	if t, err := time.Parse(time.RFC3339Nano, q.Start); err == nil {
+		q.Start = t.UTC().Format(time.RFC3339Nano)
+	}
+	if t, err := time.Parse(time.RFC3339Nano, q.End); err == nil {
+		q.End = t.UTC().Format(time.RFC3339Nano)
+	}
+	if q.Bucket != nil {
+		q.Buckets = []string{*q.Bucket}
+		q.Bucket = nil
+	}
+
+	// maps are marshaled with sorted keys, so equal queries have equal encodings
+	b, _ := json.Marshal(&q)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachingResults passes through results from a backend while writing them to a
+// temporary file, which is added to the cache once every result has been read.
+type cachingResults struct {
+	Results
+	ctx     context.Context
+	cache   *CacheBackend
+	key     string
+	f       *os.File
+	zw      *gzip.Writer
+	encoder *json.Encoder
+	failed  bool
+	done    bool
+}
+
+func (r *cachingResults) Next() bool {
+	if !r.Results.Next() {
+		// results which ended early look complete to some backends, so a
+		// cancelled request is never cached either
+		if !r.done && !r.failed && r.Results.Err() == nil && r.ctx.Err() == nil {
+			r.done = true
+			r.finish()
+		}
+		return false
+	}
+	if !r.failed {
+		if err := r.encoder.Encode(newCachedRecord(r.Results.Record())); err != nil {
+			log.Printf("query cache error: %s", err)
+			r.failed = true
+		}
+	}
+	return true
+}
+
+// finish stores the result file in the cache.
+func (r *cachingResults) finish() {
+	err := r.zw.Close()
+	if err == nil {
+		err = r.f.Close()
+	}
+	if err == nil {
+		err = r.cache.store(r.key, r.f.Name())
+	}
+	if err != nil {
+		log.Printf("query cache error: %s", err)
+		r.failed = true
+		os.Remove(r.f.Name())
+	}
+}
+
+func (r *cachingResults) Close() error {
+	if !r.done {
+		r.f.Close()
+		os.Remove(r.f.Name())
+	}
+	return r.Results.Close()
+}
+
+// cachedResults reads results from a cache file.
+type cachedResults struct {
+	f       *os.File
+	zr      *gzip.Reader
+	decoder *json.Decoder
+	record  *Record
+	err     error
+}
+
+func openCachedResults(path string) (*cachedResults, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	decoder := json.NewDecoder(zr)
+	decoder.UseNumber()
+	return &cachedResults{f: f, zr: zr, decoder: decoder}, nil
+}
+
+func (r *cachedResults) Err() error {
+	return r.err
+}
+
+func (r *cachedResults) Close() error {
+	r.zr.Close()
+	return r.f.Close()
+}
+
+func (r *cachedResults) Record() *Record {
+	return r.record
+}
+
+func (r *cachedResults) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	cached := &cachedRecord{}
+	if err := r.decoder.Decode(cached); err != nil {
+		if err != io.EOF {
+			r.err = err
+		}
+		return false
+	}
+	rec, err := cached.decode()
+	if err != nil {
+		r.err = err
+		return false
+	}
+	r.record = rec
+	return true
+}
+
+// cachedRecord is how a record is stored in the cache. JSON doesn't tell
+// integers from floats, so the types of integer values are stored along with
+// them. Output formats like Parquet depend on them.
+type cachedRecord struct {
+	// records are always cached with their name and value, so the methods of
+	// Record aren't promoted
+	*JSONRecord
+	ValueType  string            `json:"value_type,omitempty"`
+	ValueTypes map[string]string `json:"value_types,omitempty"`
+}
+
+func newCachedRecord(rec *Record) *cachedRecord {
+	cached := &cachedRecord{JSONRecord: (*JSONRecord)(rec), ValueType: cachedValueType(rec.Value)}
+	for k, v := range rec.Values {
+		if t := cachedValueType(v); t != "" {
+			if cached.ValueTypes == nil {
+				cached.ValueTypes = make(map[string]string)
+			}
+			cached.ValueTypes[k] = t
+		}
+	}
+	return cached
+}
+
+// decode returns the record with numbers converted back to their types. The
+// record must have been decoded with json.Decoder.UseNumber.
+func (cached *cachedRecord) decode() (*Record, error) {
+	rec := (*Record)(cached.JSONRecord)
+	if rec == nil {
+		return nil, fmt.Errorf("invalid cached record")
+	}
+	var err error
+	if rec.Value, err = decodeCachedValue(rec.Value, cached.ValueType); err != nil {
+		return nil, err
+	}
+	for k, v := range rec.Values {
+		if rec.Values[k], err = decodeCachedValue(v, cached.ValueTypes[k]); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// cachedValueType returns the type stored for an integer value or an empty
+// string for other values.
+func cachedValueType(v interface{}) string {
+	switch v.(type) {
+	case int, int8, int16, int32, int64:
+		return "int"
+	case uint, uint8, uint16, uint32, uint64:
+		return "uint"
+	}
+	return ""
+}
+
+// decodeCachedValue converts a json.Number to an int64, uint64 or float64 by its stored type.
+func decodeCachedValue(v interface{}, t string) (interface{}, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v, nil
+	}
+	switch t {
+	case "int":
+		return strconv.ParseInt(string(n), 10, 64)
+	case "uint":
+		return strconv.ParseUint(string(n), 10, 64)
+	}
+	return n.Float64()
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// countingBackend counts the queries made to a backend.
+type countingBackend struct {
+	Backend
+	queries int
+}
+
+func (backend *countingBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	backend.queries++
+	return backend.Backend.Query(ctx, query)
+}
+
+func readAllRecords(t *testing.T, results Results) []*Record {
+	t.Helper()
+	defer results.Close()
+	var records []*Record
+	for results.Next() {
+		records = append(records, results.Record())
+	}
+	if err := results.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestQueryCacheKey(t *testing.T) {
+	now := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	base := &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z", Filter: map[string]string{"vsn": "W001", "name": "env.temperature"}}
+	key, ok := queryCacheKey(base, now)
+	if !ok {
+		t.Fatalf("expected query to be cacheable")
+	}
+
+	same := map[string]*Query{
+		"Format":   {Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z", Filter: map[string]string{"name": "env.temperature", "vsn": "W001"}, Format: "csv"},
+		"TimeZone": {Start: "2022-01-01T01:00:00+01:00", End: "2022-01-01T12:00:00Z", Filter: map[string]string{"name": "env.temperature", "vsn": "W001"}},
+	}
+	for name, query := range same {
+		if k, _ := queryCacheKey(query, now); k != key {
+			t.Errorf("%s: expected same key", name)
+		}
+	}
+
+	different := map[string]*Query{
+		"Filter": {Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z", Filter: map[string]string{"vsn": "W002", "name": "env.temperature"}},
+		"Func":   {Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z", Filter: map[string]string{"vsn": "W001", "name": "env.temperature"}, Func: StringList{"mean"}},
+		"Bucket": {Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z", Filter: map[string]string{"vsn": "W001", "name": "env.temperature"}, Bucket: strptr("downsampled")},
+	}
+	for name, query := range different {
+		if k, _ := queryCacheKey(query, now); k == key {
+			t.Errorf("%s: expected different key", name)
+		}
+	}
+
+	bypass := map[string]*Query{
+		"RelativeStart": {Start: "-4h", End: "2022-01-01T12:00:00Z"},
+		"RelativeEnd":   {Start: "2022-01-01T00:00:00Z", End: "-1h"},
+		"NoEnd":         {Start: "2022-01-01T00:00:00Z"},
+		"OpenEnd":       {Start: "2022-01-01T00:00:00Z", End: "2022-01-02T12:00:00Z"},
+	}
+	for name, query := range bypass {
+		if _, ok := queryCacheKey(query, now); ok {
+			t.Errorf("%s: expected query to bypass cache", name)
+		}
+	}
+}
+
+func TestCacheBackend(t *testing.T) {
+	now := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	memory := NewMemoryBackend([]*Record{
+		{Timestamp: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC), Name: "env.temperature", Value: 20.5, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: time.Date(2022, 1, 1, 11, 0, 0, 0, time.UTC), Name: "env.temperature", Value: 21.5, Meta: map[string]string{"vsn": "W001"}},
+	})
+	memory.Now = func() time.Time { return now }
+	backend := &countingBackend{Backend: memory}
+
+	cache, err := NewCacheBackend(&CacheConfig{
+		Backend: backend,
+		Dir:     t.TempDir(),
+		TTL:     time.Hour,
+		Now:     func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z"}
+
+	// partially read results aren't cached
+	results, err := cache.Query(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results.Next()
+	results.Close()
+
+	for i := 0; i < 3; i++ {
+		results, err := cache.Query(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := readAllRecords(t, results)
+		if len(records) != 2 || records[1].Value != 21.5 || records[1].Meta["vsn"] != "W001" {
+			t.Fatalf("unexpected records %v", records)
+		}
+	}
+	if backend.queries != 2 {
+		t.Fatalf("expected 2 backend queries. got %d", backend.queries)
+	}
+
+	// expired results are queried again
+	now = now.Add(2 * time.Hour)
+	readAllRecords(t, mustQuery(t, cache, query))
+	if backend.queries != 3 {
+		t.Fatalf("expected 3 backend queries. got %d", backend.queries)
+	}
+
+	// relative queries always use the backend
+	readAllRecords(t, mustQuery(t, cache, &Query{Start: "-2d"}))
+	readAllRecords(t, mustQuery(t, cache, &Query{Start: "-2d"}))
+	if backend.queries != 5 {
+		t.Fatalf("expected 5 backend queries. got %d", backend.queries)
+	}
+}
+
+func TestCacheBackendEviction(t *testing.T) {
+	now := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	memory := NewMemoryBackend([]*Record{
+		{Timestamp: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC), Name: "env.temperature", Value: 20.5, Meta: map[string]string{"vsn": "W001"}},
+	})
+	memory.Now = func() time.Time { return now }
+	backend := &countingBackend{Backend: memory}
+
+	dir := t.TempDir()
+
+	cache, err := NewCacheBackend(&CacheConfig{Backend: backend, Dir: dir, Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q1 := &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z"}
+	q2 := &Query{Start: "2022-01-01T01:00:00Z", End: "2022-01-01T12:00:00Z"}
+	readAllRecords(t, mustQuery(t, cache, q1))
+	entrySize := cache.size
+
+	// reopen the cache with room for a single result
+	cache, err = NewCacheBackend(&CacheConfig{Backend: backend, Dir: dir, MaxSize: entrySize, Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readAllRecords(t, mustQuery(t, cache, q1))
+	if backend.queries != 1 {
+		t.Fatalf("expected cached result to be reused after reopening")
+	}
+
+	now = now.Add(time.Minute)
+	readAllRecords(t, mustQuery(t, cache, q2))
+	readAllRecords(t, mustQuery(t, cache, q1))
+	if backend.queries != 3 {
+		t.Fatalf("expected 3 backend queries. got %d", backend.queries)
+	}
+	if len(cache.entries) != 1 || cache.size > entrySize {
+		t.Fatalf("expected cache to hold a single result")
+	}
+}
+
+func TestCacheBackendGrace(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	memory := NewMemoryBackend(nil)
+	memory.Now = func() time.Time { return now }
+	backend := &countingBackend{Backend: memory}
+
+	cache, err := NewCacheBackend(&CacheConfig{Backend: backend, Dir: t.TempDir(), Grace: time.Hour, Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the range ended within the grace period, so late records may still arrive
+	query := &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z"}
+	readAllRecords(t, mustQuery(t, cache, query))
+	readAllRecords(t, mustQuery(t, cache, query))
+	if backend.queries != 2 {
+		t.Fatalf("expected 2 backend queries. got %d", backend.queries)
+	}
+
+	now = now.Add(time.Hour)
+	readAllRecords(t, mustQuery(t, cache, query))
+	readAllRecords(t, mustQuery(t, cache, query))
+	if backend.queries != 3 {
+		t.Fatalf("expected 3 backend queries. got %d", backend.queries)
+	}
+}
+
+func TestCacheBackendIncompleteResults(t *testing.T) {
+	now := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	query := &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z"}
+
+	// a stream which fails partway
+	backend := &countingBackend{Backend: &influxStreamBackend{err: errors.New("connection reset")}}
+	cache, err := NewCacheBackend(&CacheConfig{Backend: backend, Dir: t.TempDir(), Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		results := mustQuery(t, cache, query)
+		for results.Next() {
+		}
+		if results.Err() == nil {
+			t.Fatalf("expected stream error")
+		}
+		results.Close()
+	}
+	if backend.queries != 2 {
+		t.Fatalf("expected failed results not to be cached")
+	}
+
+	// results read by a cancelled request
+	backend = &countingBackend{Backend: &DummyBackend{}}
+	cache, err = NewCacheBackend(&CacheConfig{Backend: backend, Dir: t.TempDir(), Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := cache.Query(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	readAllRecords(t, results)
+	readAllRecords(t, mustQuery(t, cache, query))
+	if backend.queries != 2 {
+		t.Fatalf("expected cancelled results not to be cached")
+	}
+}
+
+func TestCacheBackendValueTypes(t *testing.T) {
+	now := time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC)
+	ts := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	values := []interface{}{int64(1<<53 + 1), uint64(1<<64 - 1), 20.0, 20.5, "ok", true, nil}
+	var records []*Record
+	for _, v := range values {
+		records = append(records, &Record{Timestamp: ts, Name: "sys.value", Value: v, Meta: map[string]string{}})
+	}
+	records = append(records, &Record{Timestamp: ts, Values: map[string]interface{}{"sys.count": int64(-3), "sys.temp": 20.0}, Meta: map[string]string{}})
+
+	backend := &countingBackend{Backend: &DummyBackend{records}}
+	cache, err := NewCacheBackend(&CacheConfig{Backend: backend, Dir: t.TempDir(), Now: func() time.Time { return now }})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-01T12:00:00Z"}
+	readAllRecords(t, mustQuery(t, cache, query))
+	cached := readAllRecords(t, mustQuery(t, cache, query))
+	if backend.queries != 1 {
+		t.Fatalf("expected results to be cached")
+	}
+
+	if !reflect.DeepEqual(cached, records) {
+		for i := range records {
+			t.Errorf("expected %#v. got %#v", records[i], cached[i])
+		}
+	}
+}
+
+func mustQuery(t *testing.T, backend Backend, query *Query) Results {
+	t.Helper()
+	results, err := backend.Query(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
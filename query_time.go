@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// fixedDurationRE matches Flux durations using units with a fixed length.
+var fixedDurationRE = regexp.MustCompile(`^([0-9]+(ns|us|µs|ms|s|m|h|d|w))+$`)
+
+var fixedDurationPartRE = regexp.MustCompile(`([0-9]+)(ns|us|µs|ms|s|m|h|d|w)`)
+
+var fixedDurationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+}
+
+// parseFixedDuration parses a Flux duration like 10m or 1h30m. It returns false
+// for durations using units without a fixed length, like months.
+func parseFixedDuration(s string) (time.Duration, bool) {
+	if !fixedDurationRE.MatchString(s) {
+		return 0, false
+	}
+	var d time.Duration
+	for _, m := range fixedDurationPartRE.FindAllStringSubmatch(s, -1) {
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		d += time.Duration(n) * fixedDurationUnits[m[2]]
+	}
+	return d, true
+}
+
+// parseQueryTime resolves a query start or end time relative to now. It returns
+// false if the time can't be resolved, such as for durations in months.
+func parseQueryTime(s string, now time.Time) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, true
+	}
+	if len(s) == 0 || s[0] != '-' {
+		return time.Time{}, false
+	}
+	d, ok := parseFixedDuration(s[1:])
+	if !ok {
+		return time.Time{}, false
+	}
+	return now.Add(-d), true
+}
+
+// resolveQueryRange resolves the range of a query to absolute times. As with the
+// Flux range used by InfluxBackend, the start is inclusive and the end is
+// exclusive. A cursor overrides the start, as in cursorStartsRange, and a missing
+// end defaults to now.
+func resolveQueryRange(query *Query, now time.Time) (time.Time, time.Time, error) {
+	var start time.Time
+	if cursorStartsRange(query) {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start = cursor.Timestamp
+	} else {
+		var ok bool
+		if start, ok = parseQueryTime(query.Start, now); !ok {
+			return time.Time{}, time.Time{}, fmt.Errorf("unsupported start time %q", query.Start)
+		}
+	}
+	end := now
+	if query.End != "" {
+		var ok bool
+		if end, ok = parseQueryTime(query.End, now); !ok {
+			return time.Time{}, time.Time{}, fmt.Errorf("unsupported end time %q", query.End)
+		}
+	}
+	return start, end, nil
+}
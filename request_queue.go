@@ -1,7 +1,15 @@
 package main
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
+var errQueueTimeout = errors.New("timed out waiting for request queue")
+
+// RequestQueue limits the number of requests which may be served concurrently.
+// Requests wait for a free slot up to the queue timeout.
 type RequestQueue struct {
 	ch      chan struct{}
 	timeout time.Duration
@@ -14,13 +22,21 @@ func NewRequestQueue(size int, timeout time.Duration) *RequestQueue {
 	}
 }
 
-func (q *RequestQueue) Enter() bool {
+// Enter waits for a free slot in the queue. It returns errQueueTimeout if no slot
+// became free within the queue timeout or the context error if ctx is done first.
+// Leave must be called once for each successful Enter.
+func (q *RequestQueue) Enter(ctx context.Context) error {
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+
 	select {
 	case q.ch <- struct{}{}:
-		return true
-	case <-time.After(q.timeout):
+		return nil
+	case <-timer.C:
+		return errQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return false
 }
 
 func (q *RequestQueue) Leave() {
@@ -6,8 +6,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,25 +21,80 @@ import (
 
 const metricNamespace = "dataapi"
 
+// maxQuerySize is the largest query accepted, either as a request body or as
+// URL parameters.
+const maxQuerySize = 4096
+
 var (
 	responseLatencySeconds = promauto.NewHistogram(prometheus.HistogramOpts{
 		Namespace: metricNamespace,
 		Name:      "response_latency_seconds",
 		Help:      "A histogram of backend latency duration.",
 	})
+	requestQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricNamespace,
+		Name:      "request_queue_depth",
+		Help:      "The number of requests waiting in the request queue.",
+	})
+	requestQueueWaitSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricNamespace,
+		Name:      "request_queue_wait_seconds",
+		Help:      "A histogram of time spent waiting in the request queue.",
+	})
+	requestQueueRejectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricNamespace,
+		Name:      "request_queue_rejections_total",
+		Help:      "The total number of requests rejected after timing out in the request queue.",
+	})
 )
 
 type ServiceConfig struct {
 	Backend Backend
+	// QueueSize is the maximum number of queries served concurrently. Zero disables the request queue.
+	QueueSize int
+	// QueueTimeout is how long a query may wait for a free slot before it is rejected.
+	QueueTimeout time.Duration
+	// Cardinality counts the series matching a query to estimate its cost. Costs
+	// aren't estimated when nil.
+	Cardinality CardinalityBackend
+	// CostLimit is the estimated cost above which queries must set allow_expensive. Zero disables the limit.
+	CostLimit float64
+	// MaxCost is the estimated cost above which queries are always rejected. Queries
+	// whose cost can't be estimated are then rejected too. Zero disables the limit.
+	MaxCost float64
+	// Metadata lists the columns of CSV and Parquet results before they're
+	// written. Without it, the columns are only taken from the first records.
+	Metadata MetadataBackend
+	// Now returns the current time. It defaults to time.Now.
+	Now func() time.Time
 }
 
 // Service keeps the service configuration for the SDR API service.
 type Service struct {
-	backend Backend
+	backend  Backend
+	queue    *RequestQueue
+	cost     *costLimits
+	metadata MetadataBackend
 }
 
 func NewService(config *ServiceConfig) *Service {
-	return &Service{backend: config.Backend}
+	svc := &Service{
+		backend: config.Backend,
+		cost: &costLimits{
+			cardinality: config.Cardinality,
+			costLimit:   config.CostLimit,
+			maxCost:     config.MaxCost,
+			now:         config.Now,
+		},
+		metadata: config.Metadata,
+	}
+	if svc.cost.now == nil {
+		svc.cost.now = time.Now
+	}
+	if config.QueueSize > 0 {
+		svc.queue = NewRequestQueue(config.QueueSize, config.QueueTimeout)
+	}
+	return svc
 }
 
 // ServeHTTP parses a query request, translates and forwards it to InfluxDB
@@ -45,27 +105,15 @@ func (svc *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	remoteAddr := getRemoteAddr(r)
 	log.Printf("received request from %s", remoteAddr)
 
-	r.Body = http.MaxBytesReader(w, r.Body, 4096)
-	defer r.Body.Close()
-
-	queryBody, err := io.ReadAll(r.Body)
-	if err == io.EOF || len(queryBody) == 0 {
-		log.Printf("%s error: no query provided", remoteAddr)
-		http.Error(w, "error: no query provided", http.StatusBadRequest)
-		return
-	}
-	if _, ok := err.(*http.MaxBytesError); ok {
-		log.Printf("%s error: rejected large request", remoteAddr)
-		http.Error(w, "error: query is too large - must be <1KB", http.StatusBadRequest)
-		return
-	}
-	if err != nil {
-		log.Printf("%s error: failed to read query body: %s", remoteAddr, err.Error())
-		http.Error(w, "error: failed to read query body", http.StatusBadRequest)
+	query, queryBody, ok := readQuery(w, r, remoteAddr)
+	if !ok {
 		return
 	}
 
-	query, err := parseQuery(queryBody)
+	format, err := negotiateOutputFormat(r, query)
+	if err == nil && query.Summary && format.Name != "ndjson" {
+		err = fmt.Errorf("summary is only supported by ndjson format")
+	}
 	if err != nil {
 		log.Printf("%s error: failed to parse query: %s", remoteAddr, err.Error())
 		http.Error(w, fmt.Sprintf("error: failed to parse query: %s", err.Error()), http.StatusBadRequest)
@@ -74,6 +122,16 @@ func (svc *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("%s query: %q", remoteAddr, queryBody)
 
+	leave, ok := enterQueue(w, r, svc.queue, remoteAddr)
+	if !ok {
+		return
+	}
+	defer leave()
+
+	if !checkQueryCost(w, r, svc.cost, query, remoteAddr) {
+		return
+	}
+
 	queryCount := 0
 	queryStart := time.Now()
 
@@ -85,10 +143,58 @@ func (svc *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	defer results.Close()
 
+	// the query status is only known after the results are written, so it is
+	// sent in trailers
+	trailers := []string{"X-Query-Status", "X-Record-Count", "X-Query-Error"}
+
+	var paged *pagedResults
+	if query.Limit != nil {
+		var cursor *queryCursor
+		if query.Cursor != "" {
+			// cursor was already validated by parseQuery
+			cursor, _ = decodeCursor(query.Cursor)
+		}
+		paged = pageResults(results, cursor, *query.Limit)
+		results = paged
+		trailers = append(trailers, "X-Next-Cursor")
+	}
+	w.Header().Set("Trailer", strings.Join(trailers, ", "))
+
+	encoding := negotiateEncoding(r, format)
+
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	writeContentDispositionHeader(w)
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Vary", "Accept-Encoding")
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	writeContentDispositionHeader(w, format)
 	w.WriteHeader(http.StatusOK)
 
+	var out io.Writer = w
+	var compressed *compressWriter
+	if encoding != "" {
+		compressed, err = newCompressWriter(w, encoding)
+		if err != nil {
+			log.Printf("%s error: failed to create %s writer: %s", remoteAddr, encoding, err)
+			return
+		}
+		out = compressed
+	}
+
+	writer := format.NewWriter(out)
+	if cw, ok := writer.(columnWriter); ok && svc.metadata != nil {
+		// records with keys outside these columns fail, so a failed lookup only
+		// makes that more likely
+		if metaKeys, valueKeys, err := queryColumns(r.Context(), svc.metadata, query); err != nil {
+			log.Printf("%s error: failed to list result columns: %s", remoteAddr, err.Error())
+		} else {
+			cw.SetColumns(metaKeys, valueKeys)
+		}
+	}
+
+	var queryErr error
+
 	startedWritingResults := false
 	for results.Next() {
 		record := results.Record()
@@ -97,7 +203,8 @@ func (svc *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			responseLatencySeconds.Observe(time.Since(requestStartTime).Seconds())
 			startedWritingResults = true
 		}
-		if err := writeRecord(w, record); err != nil {
+		if err := writer.WriteRecord(record); err != nil {
+			queryErr = fmt.Errorf("failed to write results: %w", err)
 			break
 		}
 		queryCount++
@@ -105,6 +212,48 @@ func (svc *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if err := results.Err(); err != nil {
 		log.Printf("%s error: %s", remoteAddr, err)
+		queryErr = err
+	}
+
+	if err := writer.Close(); err != nil {
+		log.Printf("%s error: failed to write results: %s", remoteAddr, err)
+		if queryErr == nil {
+			queryErr = fmt.Errorf("failed to write results: %w", err)
+		}
+	}
+
+	summary := &querySummary{
+		Status:          "complete",
+		Count:           queryCount,
+		DurationSeconds: time.Since(queryStart).Seconds(),
+	}
+	if queryErr != nil {
+		summary.Status = "error"
+		summary.Error = queryErr.Error()
+	}
+	if paged != nil {
+		summary.NextCursor = paged.NextCursor()
+	}
+
+	if query.Summary {
+		if err := json.NewEncoder(out).Encode(map[string]*querySummary{"summary": summary}); err != nil {
+			log.Printf("%s error: failed to write summary: %s", remoteAddr, err)
+		}
+	}
+
+	if compressed != nil {
+		if err := compressed.Close(); err != nil {
+			log.Printf("%s error: failed to write results: %s", remoteAddr, err)
+		}
+	}
+
+	w.Header().Set("X-Query-Status", summary.Status)
+	w.Header().Set("X-Record-Count", strconv.Itoa(summary.Count))
+	if summary.Error != "" {
+		w.Header().Set("X-Query-Error", headerSafeString(summary.Error))
+	}
+	if summary.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", summary.NextCursor)
 	}
 
 	queryDuration := time.Since(queryStart)
@@ -112,6 +261,114 @@ func (svc *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s served %d records in %s - %f records/s", remoteAddr, queryCount, queryDuration, responseRate)
 }
 
+// querySummary describes the outcome of a query. It is sent in the response
+// trailers and optionally as the last line of NDJSON output.
+type querySummary struct {
+	// Status is complete if all results were written or error otherwise.
+	Status          string  `json:"status"`
+	Count           int     `json:"count"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Error           string  `json:"error,omitempty"`
+	NextCursor      string  `json:"next_cursor,omitempty"`
+}
+
+// headerSafeString replaces control characters, which aren't allowed in header values, with spaces.
+func headerSafeString(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// enterQueue waits for a request to be admitted by queue. If the request times
+// out or the client goes away first, the error response is written and ok is
+// false. Otherwise leave must be called once the request is served. A nil queue
+// admits every request.
+func enterQueue(w http.ResponseWriter, r *http.Request, queue *RequestQueue, remoteAddr string) (leave func(), ok bool) {
+	if queue == nil {
+		return func() {}, true
+	}
+
+	requestQueueDepth.Inc()
+	waitStart := time.Now()
+	err := queue.Enter(r.Context())
+	requestQueueWaitSeconds.Observe(time.Since(waitStart).Seconds())
+	requestQueueDepth.Dec()
+
+	if err == errQueueTimeout {
+		requestQueueRejectionsTotal.Inc()
+		log.Printf("%s error: rejected request after waiting in queue", remoteAddr)
+		w.Header().Set("Retry-After", retryAfterSeconds(queue.timeout))
+		http.Error(w, "error: service is busy - try again later", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("%s error: client went away while waiting in queue: %s", remoteAddr, err.Error())
+		return nil, false
+	}
+	return queue.Leave, true
+}
+
+// retryAfterSeconds formats d as a Retry-After header value, rounded up to a whole second.
+func retryAfterSeconds(d time.Duration) string {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
+// readQuery reads and parses the query body of a request. GET requests provide
+// the query as URL parameters instead. If the query can't be read or is invalid,
+// an error response is written and ok is false.
+func readQuery(w http.ResponseWriter, r *http.Request, remoteAddr string) (query *Query, queryBody []byte, ok bool) {
+	if r.Method == http.MethodGet {
+		if len(r.URL.RawQuery) > maxQuerySize {
+			log.Printf("%s error: rejected large request", remoteAddr)
+			http.Error(w, "error: query is too large - must be <1KB", http.StatusBadRequest)
+			return nil, nil, false
+		}
+		query, queryBody, err := parseQueryValues(r.URL.Query())
+		if err != nil {
+			log.Printf("%s error: failed to parse query: %s", remoteAddr, err.Error())
+			http.Error(w, fmt.Sprintf("error: failed to parse query: %s", err.Error()), http.StatusBadRequest)
+			return nil, nil, false
+		}
+		return query, queryBody, true
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxQuerySize)
+	defer r.Body.Close()
+
+	queryBody, err := io.ReadAll(r.Body)
+	if err == io.EOF || len(queryBody) == 0 {
+		log.Printf("%s error: no query provided", remoteAddr)
+		http.Error(w, "error: no query provided", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if _, ok := err.(*http.MaxBytesError); ok {
+		log.Printf("%s error: rejected large request", remoteAddr)
+		http.Error(w, "error: query is too large - must be <1KB", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Printf("%s error: failed to read query body: %s", remoteAddr, err.Error())
+		http.Error(w, "error: failed to read query body", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	query, err = parseQuery(queryBody)
+	if err != nil {
+		log.Printf("%s error: failed to parse query: %s", remoteAddr, err.Error())
+		http.Error(w, fmt.Sprintf("error: failed to parse query: %s", err.Error()), http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	return query, queryBody, true
+}
+
 var metaRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
 
 func parseQuery(data []byte) (*Query, error) {
@@ -124,20 +381,144 @@ func parseQuery(data []byte) (*Query, error) {
 	if query.Start == "" {
 		return nil, fmt.Errorf("missing start field")
 	}
+	if query.Bucket != nil && query.Buckets != nil {
+		return nil, fmt.Errorf("bucket and buckets cannot both be specified")
+	}
+	for _, bucket := range query.Buckets {
+		if bucket == "" {
+			return nil, fmt.Errorf("invalid bucket %q", bucket)
+		}
+	}
 	for k := range query.Filter {
 		if !metaRE.MatchString(k) {
 			return nil, fmt.Errorf("invalid filter key: %q", k)
 		}
 	}
+	if _, err := newQueryMatcher(query); err != nil {
+		return nil, err
+	}
+	if err := validateAggregation(query); err != nil {
+		return nil, err
+	}
+	if query.Limit != nil {
+		if *query.Limit <= 0 {
+			return nil, fmt.Errorf("limit must be positive")
+		}
+		if query.Head != nil {
+			return nil, fmt.Errorf("limit and head cannot both be specified")
+		}
+		if len(query.Func) > 0 && query.Window == nil {
+			return nil, fmt.Errorf("limit cannot be used with un-windowed aggregation function")
+		}
+		if len(query.Func) > 1 {
+			return nil, fmt.Errorf("limit cannot be used with multiple aggregation functions")
+		}
+	}
+	if query.Cursor != "" {
+		if query.Limit == nil {
+			return nil, fmt.Errorf("cursor cannot be used without limit")
+		}
+		if _, err := decodeCursor(query.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	if query.Pivot != nil {
+		for _, k := range query.Pivot.By {
+			if !metaRE.MatchString(k) {
+				return nil, fmt.Errorf("invalid pivot key: %q", k)
+			}
+			// meta keys which aren't grouped by are dropped by the aggregation
+			if query.GroupBy != nil && !slices.Contains(query.GroupBy, k) {
+				return nil, fmt.Errorf("pivot key %q must be included in group_by", k)
+			}
+		}
+	}
 	return query, nil
 }
 
-func writeRecord(w io.Writer, rec *Record) error {
-	return json.NewEncoder(w).Encode(rec)
+// queryValueFields lists the URL parameters which map onto query fields. All
+// other parameters are filters.
+var queryValueFields = map[string]string{
+	"bucket":              "string",
+	"buckets":             "list",
+	"start":               "string",
+	"end":                 "string",
+	"head":                "int",
+	"tail":                "int",
+	"experimental_func":   "list",
+	"experimental_window": "string",
+	"format":              "string",
+	"pivot":               "list",
+	"limit":               "int",
+	"cursor":              "string",
+	"group_by":            "list",
+	"value_filter":        "string",
+	"filter_expr":         "json",
+	"summary":             "bool",
+	"allow_expensive":     "bool",
+}
+
+// parseQueryValues parses a query from URL parameters. Query fields use the same
+// names as in a query body. Lists may be repeated or comma separated and pivot
+// holds the pivot keys. All other parameters are added to the filter. The query
+// is converted to a query body, so it is validated the same way.
+func parseQueryValues(values url.Values) (*Query, []byte, error) {
+	obj := make(map[string]interface{})
+	filter := make(map[string]string)
+
+	for k, v := range values {
+		switch queryValueFields[k] {
+		case "string":
+			obj[k] = v[0]
+		case "int":
+			n, err := strconv.Atoi(v[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s: %q", k, v[0])
+			}
+			obj[k] = n
+		case "list":
+			list := []string{}
+			for _, s := range v {
+				if s != "" {
+					list = append(list, strings.Split(s, ",")...)
+				}
+			}
+			if k == "pivot" {
+				obj[k] = map[string][]string{"by": list}
+			} else {
+				obj[k] = list
+			}
+		case "bool":
+			b, err := strconv.ParseBool(v[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s: %q", k, v[0])
+			}
+			obj[k] = b
+		case "json":
+			obj[k] = json.RawMessage(v[0])
+		default:
+			filter[k] = v[0]
+		}
+	}
+
+	if len(filter) > 0 {
+		obj["filter"] = filter
+	}
+
+	queryBody, err := json.Marshal(obj)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid filter_expr")
+	}
+
+	query, err := parseQuery(queryBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	return query, queryBody, nil
 }
 
-func writeContentDispositionHeader(w http.ResponseWriter) {
-	filename := time.Now().Format("sage-download-20060102150405.ndjson")
+func writeContentDispositionHeader(w http.ResponseWriter, format *outputFormat) {
+	filename := time.Now().Format("sage-download-20060102150405") + "." + format.Extension
 	w.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
 }
 
@@ -3,11 +3,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
@@ -81,21 +84,45 @@ func TestValidQuery(t *testing.T) {
 		valid bool
 		resp  string
 	}{
-		"Valid1":         {`{"start": "-4h"}`, true, ""},
-		"Valid2":         {`{"start": "-4h", "filter": {"node": "node123", "vsn": "W123"}}`, true, ""},
-		"Empty":          {``, false, "error: no query provided\n"},
-		"NoStart":        {`{}`, false, "error: failed to parse query: missing start field\n"},
-		"GoodFilterKey1": {`{"start": "-4h", "filter": {"meta": "W123"}}`, true, ""},
-		"GoodFilterKey2": {`{"start": "-4h", "filter": {"meta_tag": "W123"}}`, true, ""},
-		"GoodFilterKey3": {`{"start": "-4h", "filter": {"meta2": "W123"}}`, true, ""},
-		"GoodFilterKey4": {`{"start": "-4h", "filter": {"_meta": "W123"}}`, true, ""},
-		"BadFilterKey1":  {`{"start": "-4h", "filter": {"meta.vsn": "W123"}}`, false, "error: failed to parse query: invalid filter key: \"meta.vsn\"\n"},
-		"BadFilterKey2":  {`{"start": "-4h", "filter": {"meta-vsn": "W123"}}`, false, "error: failed to parse query: invalid filter key: \"meta-vsn\"\n"},
-		"BadFilterKey3":  {`{"start": "-4h", "filter": {"1meta": "W123"}}`, false, "error: failed to parse query: invalid filter key: \"1meta\"\n"},
-		"BadField":       {`{"start": "-4h", "unknown": "val"}`, false, "error: failed to parse query: json: unknown field \"unknown\"\n"},
-		"EOF":            {`{"start": "-4h",`, false, "error: failed to parse query: unexpected EOF\n"},
-		"BadJSON":        {`{"start": "-4h",}`, false, "error: failed to parse query: invalid character '}' looking for beginning of object key string\n"},
-		"Wildcard1":      {`{"start": "-4h", "filter": {"host": ".*nxcore.*"}}`, true, ""},
+		"Valid1":           {`{"start": "-4h"}`, true, ""},
+		"Valid2":           {`{"start": "-4h", "filter": {"node": "node123", "vsn": "W123"}}`, true, ""},
+		"Empty":            {``, false, "error: no query provided\n"},
+		"NoStart":          {`{}`, false, "error: failed to parse query: missing start field\n"},
+		"Buckets":          {`{"start": "-4h", "buckets": ["waggle", "downsampled"]}`, true, ""},
+		"BucketAndBuckets": {`{"start": "-4h", "bucket": "waggle", "buckets": ["downsampled"]}`, false, "error: failed to parse query: bucket and buckets cannot both be specified\n"},
+		"GoodFilterKey1":   {`{"start": "-4h", "filter": {"meta": "W123"}}`, true, ""},
+		"GoodFilterKey2":   {`{"start": "-4h", "filter": {"meta_tag": "W123"}}`, true, ""},
+		"GoodFilterKey3":   {`{"start": "-4h", "filter": {"meta2": "W123"}}`, true, ""},
+		"GoodFilterKey4":   {`{"start": "-4h", "filter": {"_meta": "W123"}}`, true, ""},
+		"NegatedFilter":    {`{"start": "-4h", "filter": {"vsn": "!W001", "sensor": "!*"}}`, true, ""},
+		"BadFilterPattern": {`{"start": "-4h", "filter": {"vsn": "re:W0(1|2"}}`, false, "error: failed to parse query: invalid filter pattern \"re:W0(1|2\" for key \"vsn\": error parsing regexp: missing closing ): `W0(1|2`\n"},
+		"FilterExpr":       {`{"start": "-4h", "filter_expr": {"or": [{"vsn": "W01B"}, {"not": {"plugin": "*iio*"}}]}}`, true, ""},
+		"BadFilterExpr":    {`{"start": "-4h", "filter_expr": {"or": []}}`, false, "error: failed to parse query: or requires at least one filter expression\n"},
+		"BadFilterKey1":    {`{"start": "-4h", "filter": {"meta.vsn": "W123"}}`, false, "error: failed to parse query: invalid filter key: \"meta.vsn\"\n"},
+		"BadFilterKey2":    {`{"start": "-4h", "filter": {"meta-vsn": "W123"}}`, false, "error: failed to parse query: invalid filter key: \"meta-vsn\"\n"},
+		"BadFilterKey3":    {`{"start": "-4h", "filter": {"1meta": "W123"}}`, false, "error: failed to parse query: invalid filter key: \"1meta\"\n"},
+		"GoodFunc":         {`{"start": "-4h", "experimental_func": "p95", "experimental_window": "10m"}`, true, ""},
+		"BadFunc":          {`{"start": "-4h", "experimental_func": "mode"}`, false, "error: failed to parse query: unsupported function \"mode\"\n"},
+		"FuncList":         {`{"start": "-4h", "experimental_func": ["min", "max"], "experimental_window": "10m"}`, true, ""},
+		"DuplicateFunc":    {`{"start": "-4h", "experimental_func": ["min", "min"]}`, false, "error: failed to parse query: duplicate function \"min\"\n"},
+		"LimitFuncList":    {`{"start": "-4h", "experimental_func": ["min", "max"], "experimental_window": "10m", "limit": 10}`, false, "error: failed to parse query: limit cannot be used with multiple aggregation functions\n"},
+		"GroupBy":          {`{"start": "-4h", "experimental_func": "mean", "group_by": ["vsn"]}`, true, ""},
+		"GroupByGlobal":    {`{"start": "-4h", "experimental_func": "mean", "group_by": []}`, true, ""},
+		"GroupByNoFunc":    {`{"start": "-4h", "group_by": ["vsn"]}`, false, "error: failed to parse query: group_by cannot be used without aggregation function\n"},
+		"BadGroupByKey":    {`{"start": "-4h", "experimental_func": "mean", "group_by": ["meta.vsn"]}`, false, "error: failed to parse query: invalid group_by key: \"meta.vsn\"\n"},
+		"PivotNotGrouped":  {`{"start": "-4h", "experimental_func": "mean", "group_by": ["vsn"], "pivot": {"by": ["node"]}}`, false, "error: failed to parse query: pivot key \"node\" must be included in group_by\n"},
+		"ValueFilter":      {`{"start": "-4h", "value_filter": "10..20"}`, true, ""},
+		"BadValueFilter":   {`{"start": "-4h", "value_filter": "~40"}`, false, "error: failed to parse query: invalid value_filter \"~40\"\n"},
+		"NaNValueFilter":   {`{"start": "-4h", "value_filter": ">NaN"}`, false, "error: failed to parse query: invalid value_filter \">NaN\": \"NaN\" is not a finite number\n"},
+		"BadWindow":        {`{"start": "-4h", "experimental_func": "mean", "experimental_window": "ten"}`, false, "error: failed to parse query: invalid window \"ten\"\n"},
+		"BadLimit":         {`{"start": "-4h", "limit": 0}`, false, "error: failed to parse query: limit must be positive\n"},
+		"BadCursor":        {`{"start": "-4h", "limit": 10, "cursor": "???"}`, false, "error: failed to parse query: invalid cursor\n"},
+		"CursorNoLimit":    {`{"start": "-4h", "cursor": "e30"}`, false, "error: failed to parse query: cursor cannot be used without limit\n"},
+		"BadPivotKey":      {`{"start": "-4h", "pivot": {"by": ["meta.vsn"]}}`, false, "error: failed to parse query: invalid pivot key: \"meta.vsn\"\n"},
+		"BadField":         {`{"start": "-4h", "unknown": "val"}`, false, "error: failed to parse query: json: unknown field \"unknown\"\n"},
+		"EOF":              {`{"start": "-4h",`, false, "error: failed to parse query: unexpected EOF\n"},
+		"BadJSON":          {`{"start": "-4h",}`, false, "error: failed to parse query: invalid character '}' looking for beginning of object key string\n"},
+		"Wildcard1":        {`{"start": "-4h", "filter": {"host": ".*nxcore.*"}}`, true, ""},
 		// TODO(sean) since we are mocking out influxdb during testing, we are not detecting the following case
 		// correctly. we should move towards testing against the real services.
 		"Wildcard2": {`{"start": "-4h", "filter": {"plugin": "waggle/plugin-iio.*"}}`, true, ""},
@@ -145,6 +172,448 @@ func TestContentDispositionHeader(t *testing.T) {
 	}
 }
 
+func TestCSVFormat(t *testing.T) {
+	records := []*Record{
+		{
+			Timestamp: time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC),
+			Name:      "sys.uptime",
+			Value:     100321,
+			Meta: map[string]string{
+				"node":   "0000000000000001",
+				"plugin": "status:1.0.2",
+			},
+		},
+		{
+			Timestamp: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC),
+			Name:      "env.temp.htu21d",
+			Value:     2.3,
+			Meta: map[string]string{
+				"node":   "0000000000000001",
+				"sensor": "htu21d",
+			},
+		},
+		{
+			Timestamp: time.Date(2023, 2, 1, 10, 45, 0, 0, time.UTC),
+			Name:      "raw.htu21d",
+			Value:     "a,b",
+			Meta: map[string]string{
+				"node": "0000000000000002",
+			},
+		},
+	}
+
+	want := "timestamp,name,value,node,plugin,sensor\n" +
+		"2021-01-01T10:00:00Z,sys.uptime,100321,0000000000000001,status:1.0.2,\n" +
+		"2022-01-01T10:30:00Z,env.temp.htu21d,2.3,0000000000000001,,htu21d\n" +
+		"2023-02-01T10:45:00Z,raw.htu21d,\"a,b\",0000000000000002,,\n"
+
+	testcases := map[string]struct {
+		body   string
+		accept string
+	}{
+		"FormatField":  {`{"start": "-4h", "format": "csv"}`, ""},
+		"AcceptHeader": {`{"start": "-4h"}`, "application/x-ndjson;q=0.5, text/csv"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			svc := NewService(&ServiceConfig{
+				Backend: &DummyBackend{records},
+			})
+
+			r := httptest.NewRequest("POST", "/", bytes.NewBufferString(tc.body))
+			if tc.accept != "" {
+				r.Header.Set("Accept", tc.accept)
+			}
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			resp := w.Result()
+
+			assertStatusCode(t, resp, http.StatusOK)
+			if s := resp.Header.Get("Content-Type"); s != "text/csv" {
+				t.Fatalf("invalid content type. got %q", s)
+			}
+			pattern := regexp.MustCompile("attachment; filename=\"sage-download-(.+).csv\"")
+			if s := resp.Header.Get("Content-Disposition"); !pattern.MatchString(s) {
+				t.Fatalf("response must have csv Content-Disposition header. got %q", s)
+			}
+			assertReadBody(t, resp, []byte(want))
+		})
+	}
+}
+
+func TestCSVFormatLateColumns(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// the camera key first appears after the records used for the header
+	var records []*Record
+	for i := 0; i < csvHeaderSampleSize; i++ {
+		records = append(records, &Record{Timestamp: now.Add(-time.Hour), Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": "W001"}})
+	}
+	records = append(records, &Record{Timestamp: now.Add(-time.Minute), Name: "upload", Value: "sample.jpg", Meta: map[string]string{"vsn": "W001", "camera": "top"}})
+
+	backend := NewMemoryBackend(records)
+	backend.Now = func() time.Time { return now }
+
+	testcases := map[string]struct {
+		metadata MetadataBackend
+		header   string
+		status   string
+	}{
+		"Metadata":   {backend, "timestamp,name,value,camera,vsn", "complete"},
+		"NoMetadata": {nil, "timestamp,name,value,vsn", "error"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			svc := NewService(&ServiceConfig{
+				Backend:  backend,
+				Metadata: tc.metadata,
+			})
+
+			r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h", "format": "csv"}`))
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			resp := w.Result()
+			assertStatusCode(t, resp, http.StatusOK)
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header, _, _ := strings.Cut(string(body), "\n"); header != tc.header {
+				t.Fatalf("expected header %q. got %q", tc.header, header)
+			}
+			if status := resp.Trailer.Get("X-Query-Status"); status != tc.status {
+				t.Fatalf("expected status %q. got %q: %s", tc.status, status, resp.Trailer.Get("X-Query-Error"))
+			}
+		})
+	}
+}
+
+func TestQueryColumns(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	records := []*Record{
+		{Timestamp: now.Add(-time.Hour), Name: "env.temperature", Value: 20.0, Meta: map[string]string{"vsn": "W001", "sensor": "bme680"}},
+		{Timestamp: now.Add(-time.Hour), Name: "env.humidity", Value: 40.0, Meta: map[string]string{"vsn": "W002"}},
+	}
+	backend := NewMemoryBackend(records)
+	backend.Now = func() time.Time { return now }
+
+	testcases := map[string]struct {
+		query     *Query
+		metaKeys  []string
+		valueKeys []string
+	}{
+		"Plain":         {&Query{Start: "-4h"}, []string{"sensor", "vsn"}, nil},
+		"Pivot":         {&Query{Start: "-4h", Pivot: &Pivot{By: []string{"vsn"}}}, []string{"vsn"}, []string{"env.humidity", "env.temperature"}},
+		"GroupBy":       {&Query{Start: "-4h", Func: StringList{"mean"}, GroupBy: []string{"vsn"}}, []string{"vsn"}, nil},
+		"GroupByGlobal": {&Query{Start: "-4h", Func: StringList{"mean"}, GroupBy: []string{}}, []string{}, nil},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			metaKeys, valueKeys, err := queryColumns(context.Background(), backend, tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(metaKeys, tc.metaKeys) || !reflect.DeepEqual(valueKeys, tc.valueKeys) {
+				t.Fatalf("expected columns %v %v. got %v %v", tc.metaKeys, tc.valueKeys, metaKeys, valueKeys)
+			}
+		})
+	}
+}
+
+func TestPivotQuery(t *testing.T) {
+	t1 := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	t2 := time.Date(2022, 1, 1, 10, 5, 0, 0, time.UTC)
+
+	records := []*Record{
+		{Timestamp: t1, Name: "env.temperature", Value: 21.5, Meta: map[string]string{"vsn": "W001", "sensor": "bme680"}},
+		{Timestamp: t1, Name: "env.humidity", Value: 40.1, Meta: map[string]string{"vsn": "W001", "sensor": "bme680"}},
+		{Timestamp: t2, Name: "env.temperature", Value: 21.7, Meta: map[string]string{"vsn": "W001", "sensor": "bme680"}},
+		{Timestamp: t1, Name: "env.temperature", Value: 18.2, Meta: map[string]string{"vsn": "W002", "sensor": "bme680"}},
+	}
+
+	svc := NewService(&ServiceConfig{
+		Backend: &DummyBackend{records},
+	})
+
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h", "pivot": {"by": ["vsn"]}}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp := w.Result()
+
+	assertStatusCode(t, resp, http.StatusOK)
+	assertReadBody(t, resp, []byte(`{"timestamp":"2022-01-01T10:00:00Z","values":{"env.humidity":40.1,"env.temperature":21.5},"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:05:00Z","values":{"env.temperature":21.7},"meta":{"vsn":"W001"}}
+{"timestamp":"2022-01-01T10:00:00Z","values":{"env.temperature":18.2},"meta":{"vsn":"W002"}}
+`))
+}
+
+func TestGetQuery(t *testing.T) {
+	t1 := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	records := []*Record{
+		{Timestamp: t1, Name: "env.temperature", Value: 21.5, Meta: map[string]string{"vsn": "W01B"}},
+		{Timestamp: t1, Name: "env.humidity", Value: 40.1, Meta: map[string]string{"vsn": "W01B"}},
+		{Timestamp: t1, Name: "env.temperature", Value: 18.2, Meta: map[string]string{"vsn": "W002"}},
+	}
+
+	svc := NewService(&ServiceConfig{
+		Backend: &DummyBackend{records},
+	})
+
+	r := httptest.NewRequest("GET", "/api/v1/query?start=-1h&name=env.temperature&vsn=W01B&tail=1", nil)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp := w.Result()
+
+	assertStatusCode(t, resp, http.StatusOK)
+	assertReadBody(t, resp, []byte(`{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":21.5,"meta":{"vsn":"W01B"}}
+`))
+
+	r = httptest.NewRequest("GET", "/api/v1/query?start=-1h&tail=one", nil)
+	w = httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp = w.Result()
+
+	assertStatusCode(t, resp, http.StatusBadRequest)
+	assertReadBody(t, resp, []byte("error: failed to parse query: invalid tail: \"one\"\n"))
+}
+
+func TestParseQueryValues(t *testing.T) {
+	testcases := map[string]struct {
+		values string
+		query  *Query
+		err    string
+	}{
+		"Filter": {
+			"start=-1h&end=-30m&vsn=W01B&name=env.*",
+			&Query{Start: "-1h", End: "-30m", Filter: map[string]string{"vsn": "W01B", "name": "env.*"}},
+			"",
+		},
+		"Fields": {
+			"start=-1h&bucket=downsampled&tail=5&format=csv&value_filter=%3E40",
+			&Query{Start: "-1h", Bucket: strptr("downsampled"), Tail: intptr(5), Format: "csv", ValueFilter: ">40"},
+			"",
+		},
+		"Lists": {
+			"start=-1h&experimental_func=min,max&experimental_func=mean&experimental_window=10m&group_by=vsn&pivot=vsn",
+			&Query{Start: "-1h", Func: StringList{"min", "max", "mean"}, Window: strptr("10m"), GroupBy: []string{"vsn"}, Pivot: &Pivot{By: []string{"vsn"}}},
+			"",
+		},
+		"GlobalGroupBy": {
+			"start=-1h&experimental_func=mean&group_by=",
+			&Query{Start: "-1h", Func: StringList{"mean"}, GroupBy: []string{}},
+			"",
+		},
+		"FilterExpr": {
+			`start=-1h&filter_expr={"not":{"vsn":"W01B"}}`,
+			&Query{Start: "-1h", FilterExpr: &FilterExpr{Not: &FilterExpr{Match: map[string]string{"vsn": "W01B"}}}},
+			"",
+		},
+		"BadFilterExpr": {"start=-1h&filter_expr={", nil, "invalid filter_expr"},
+		"BadLimit":      {"start=-1h&limit=ten", nil, `invalid limit: "ten"`},
+		"MissingStart":  {"vsn=W01B", nil, "missing start field"},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			values, err := url.ParseQuery(tc.values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query, _, err := parseQueryValues(values)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected error %q. got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(query, tc.query) {
+				t.Fatalf("query mismatch\nexpect: %#v\noutput: %#v", tc.query, query)
+			}
+		})
+	}
+}
+
+func TestQueryPagination(t *testing.T) {
+	t1 := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	t2 := time.Date(2022, 1, 1, 10, 5, 0, 0, time.UTC)
+	t3 := time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC)
+
+	// records sharing a timestamp are returned in series order
+	records := []*Record{
+		{Timestamp: t1, Name: "env.temperature", Value: 1, Meta: map[string]string{"vsn": "W002"}},
+		{Timestamp: t1, Name: "env.temperature", Value: 2, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: t1, Name: "env.humidity", Value: 3, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: t2, Name: "env.temperature", Value: 4, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: t3, Name: "env.temperature", Value: 5, Meta: map[string]string{"vsn": "W001"}},
+	}
+
+	svc := NewService(&ServiceConfig{
+		Backend: &DummyBackend{records},
+	})
+
+	var values []string
+	var pages int
+	cursor := ""
+
+	for {
+		body := `{"start": "-4h", "limit": 2}`
+		if cursor != "" {
+			body = fmt.Sprintf(`{"start": "-4h", "limit": 2, "cursor": %q}`, cursor)
+		}
+		r := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, r)
+		resp := w.Result()
+		assertStatusCode(t, resp, http.StatusOK)
+		pages++
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var rec Record
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, fmt.Sprint(rec.Value))
+		}
+
+		cursor = resp.Trailer.Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+		if pages > len(records) {
+			t.Fatalf("pagination did not terminate")
+		}
+	}
+
+	if pages != 3 {
+		t.Fatalf("expected 3 pages. got %d", pages)
+	}
+	if s := strings.Join(values, ","); s != "3,2,1,4,5" {
+		t.Fatalf("unexpected paged values %s", s)
+	}
+}
+
+func TestQueryPaginationWindowedAggregation(t *testing.T) {
+	now := time.Date(2022, 1, 1, 13, 0, 0, 0, time.UTC)
+
+	// more series than fit on a page, so pages end part way through a timestamp
+	var records []*Record
+	for i := 0; i < 2; i++ {
+		for _, vsn := range []string{"W001", "W002", "W003"} {
+			records = append(records, &Record{
+				Timestamp: time.Date(2022, 1, 1, 10+i, 30, 0, 0, time.UTC),
+				Name:      "env.temperature",
+				Value:     float64(i),
+				Meta:      map[string]string{"vsn": vsn},
+			})
+		}
+	}
+	backend := NewMemoryBackend(records)
+	backend.Now = func() time.Time { return now }
+	svc := NewService(&ServiceConfig{Backend: backend})
+
+	query := func(body string) ([]string, string) {
+		r := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		svc.ServeHTTP(w, r)
+		resp := w.Result()
+		assertStatusCode(t, resp, http.StatusOK)
+		var lines []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		return lines, resp.Trailer.Get("X-Next-Cursor")
+	}
+
+	base := `"start": "2022-01-01T10:00:00Z", "end": "2022-01-01T12:00:00Z", "experimental_func": "mean", "experimental_window": "1h"`
+	whole, _ := query(fmt.Sprintf(`{%s, "limit": 100}`, base))
+	if len(whole) != 6 {
+		t.Fatalf("expected 6 records. got %d", len(whole))
+	}
+
+	var paged []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > len(whole) {
+			t.Fatalf("pagination did not terminate")
+		}
+		body := fmt.Sprintf(`{%s, "limit": 2}`, base)
+		if cursor != "" {
+			body = fmt.Sprintf(`{%s, "limit": 2, "cursor": %q}`, base, cursor)
+		}
+		var lines []string
+		lines, cursor = query(body)
+		paged = append(paged, lines...)
+		if cursor == "" {
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(paged, whole) {
+		t.Fatalf("paged records don't match\nexpect: %v\noutput: %v", whole, paged)
+	}
+}
+
+func TestTruncatePage(t *testing.T) {
+	t1 := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	t2 := time.Date(2022, 1, 1, 10, 5, 0, 0, time.UTC)
+	t3 := time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC)
+
+	records := []*Record{
+		{Timestamp: t1, Name: "env.temperature", Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: t1, Name: "env.temperature", Meta: map[string]string{"vsn": "W002"}},
+		{Timestamp: t2, Name: "env.temperature", Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: t3, Name: "env.temperature", Meta: map[string]string{"vsn": "W002"}},
+		{Timestamp: t3, Name: "env.temperature", Meta: map[string]string{"vsn": "W001"}},
+	}
+
+	testcases := map[string]struct {
+		N      int
+		Cursor *queryCursor
+		Limit  int
+		Count  int
+		OK     bool
+	}{
+		"NotCutOff":         {N: 6, Limit: 4, Count: 5, OK: true},
+		"DropLastTimestamp": {N: 5, Limit: 2, Count: 3, OK: true},
+		"TooFewRecords":     {N: 5, Limit: 3, Count: 3, OK: false},
+		"SkipCursor":        {N: 5, Cursor: &queryCursor{Timestamp: t1, Series: "env.temperature,vsn=W001"}, Limit: 2, Count: 3, OK: false},
+		"OnlyLastTimestamp": {N: 2, Limit: 1, Count: 0, OK: false},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			got, ok := truncatePage(records[:min(tc.N, len(records))], tc.N, tc.Cursor, tc.Limit)
+			if len(got) != tc.Count || ok != tc.OK {
+				t.Fatalf("expected %d records and %v. got %d records and %v", tc.Count, tc.OK, len(got), ok)
+			}
+		})
+	}
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	svc := NewService(&ServiceConfig{
+		Backend: &DummyBackend{},
+	})
+
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h", "format": "xlsx"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp := w.Result()
+
+	assertStatusCode(t, resp, http.StatusBadRequest)
+	assertReadBody(t, resp, []byte("error: failed to parse query: unsupported format \"xlsx\"\n"))
+}
+
 func TestRequestSizeLimit(t *testing.T) {
 	svc := NewService(&ServiceConfig{
 		Backend: &DummyBackend{},
@@ -178,6 +647,76 @@ func TestRequestSizeLimit(t *testing.T) {
 	}
 }
 
+func TestRequestSizeLimitURL(t *testing.T) {
+	svc := NewService(&ServiceConfig{
+		Backend: &DummyBackend{},
+	})
+
+	r := httptest.NewRequest("GET", "/?start=-4h&uhoh="+strings.Repeat("x", 4096), nil)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp := w.Result()
+
+	assertStatusCode(t, resp, http.StatusBadRequest)
+	assertReadBody(t, resp, []byte("error: query is too large - must be <1KB\n"))
+}
+
+func TestRequestQueueTimeout(t *testing.T) {
+	svc := NewService(&ServiceConfig{
+		Backend:      &DummyBackend{},
+		QueueSize:    1,
+		QueueTimeout: 10 * time.Millisecond,
+	})
+
+	// occupy the only slot in the queue
+	if err := svc.queue.Enter(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp := w.Result()
+
+	assertStatusCode(t, resp, http.StatusServiceUnavailable)
+	if s := resp.Header.Get("Retry-After"); s != "1" {
+		t.Fatalf("expected Retry-After header. got %q", s)
+	}
+	assertReadBody(t, resp, []byte("error: service is busy - try again later\n"))
+
+	// request should be served once slot is free again
+	svc.queue.Leave()
+
+	r = httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h"}`))
+	w = httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	assertStatusCode(t, w.Result(), http.StatusOK)
+}
+
+func TestRequestQueueClientDisconnect(t *testing.T) {
+	svc := NewService(&ServiceConfig{
+		Backend:      &DummyBackend{},
+		QueueSize:    1,
+		QueueTimeout: time.Minute,
+	})
+
+	if err := svc.queue.Enter(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.queue.Leave()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h"}`)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+
+	if w.Body.Len() != 0 {
+		t.Fatalf("expected no response to disconnected client. got %q", w.Body.String())
+	}
+}
+
 func assertStatusCode(t *testing.T, resp *http.Response, want int) {
 	if resp.StatusCode != want {
 		t.Fatalf("invalid status code. want: %d got: %d", want, resp.StatusCode)
@@ -193,3 +732,150 @@ func assertReadBody(t *testing.T, resp *http.Response, want []byte) {
 		t.Fatalf("invalid body. want: %q got: %q", want, b)
 	}
 }
+
+func TestQueryTrailers(t *testing.T) {
+	records := []*Record{
+		{Timestamp: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC), Name: "env.temperature", Value: 21.5, Meta: map[string]string{"vsn": "W001"}},
+		{Timestamp: time.Date(2022, 1, 1, 10, 5, 0, 0, time.UTC), Name: "env.temperature", Value: 21.7, Meta: map[string]string{"vsn": "W001"}},
+	}
+
+	testcases := map[string]struct {
+		backend Backend
+		body    string
+		status  string
+		count   string
+		err     string
+		summary string
+	}{
+		"Complete": {
+			backend: &DummyBackend{records},
+			body:    `{"start": "-4h"}`,
+			status:  "complete",
+			count:   "2",
+		},
+		"Error": {
+			backend: &failingBackend{records: records, err: fmt.Errorf("connection reset\nby peer")},
+			body:    `{"start": "-4h"}`,
+			status:  "error",
+			count:   "2",
+			err:     "connection reset by peer",
+		},
+		"StreamError": {
+			backend: &influxStreamBackend{err: fmt.Errorf("connection reset")},
+			body:    `{"start": "-4h"}`,
+			status:  "error",
+			count:   "2",
+			err:     "connection reset",
+		},
+		"Summary": {
+			backend: &failingBackend{records: records, err: fmt.Errorf("connection reset")},
+			body:    `{"start": "-4h", "summary": true}`,
+			status:  "error",
+			count:   "2",
+			err:     "connection reset",
+			summary: `{"count":2,"error":"connection reset","status":"error"}`,
+		},
+		"SummaryPaged": {
+			backend: &DummyBackend{records},
+			body:    `{"start": "-4h", "summary": true, "limit": 1}`,
+			status:  "complete",
+			count:   "1",
+			summary: `{"count":1,"next_cursor":"eyJ0cyI6IjIwMjItMDEtMDFUMTA6MDA6MDBaIiwic2VyaWVzIjoiZW52LnRlbXBlcmF0dXJlLHZzbj1XMDAxIn0","status":"complete"}`,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			svc := NewService(&ServiceConfig{Backend: tc.backend})
+			r := httptest.NewRequest("POST", "/", bytes.NewBufferString(tc.body))
+			w := httptest.NewRecorder()
+			svc.ServeHTTP(w, r)
+			resp := w.Result()
+
+			assertStatusCode(t, resp, http.StatusOK)
+			if s := resp.Trailer.Get("X-Query-Status"); s != tc.status {
+				t.Fatalf("expected status %q. got %q", tc.status, s)
+			}
+			if s := resp.Trailer.Get("X-Record-Count"); s != tc.count {
+				t.Fatalf("expected count %q. got %q", tc.count, s)
+			}
+			if s := resp.Trailer.Get("X-Query-Error"); s != tc.err {
+				t.Fatalf("expected error %q. got %q", tc.err, s)
+			}
+
+			if tc.summary == "" {
+				return
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+			var summary struct {
+				Summary map[string]interface{} `json:"summary"`
+			}
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil {
+				t.Fatal(err)
+			}
+			// duration varies between runs. keys are marshaled in sorted order.
+			delete(summary.Summary, "duration_seconds")
+			b, _ := json.Marshal(summary.Summary)
+			if string(b) != tc.summary {
+				t.Fatalf("unexpected summary\nexpect: %s\noutput: %s", tc.summary, b)
+			}
+		})
+	}
+}
+
+func TestSummaryFormat(t *testing.T) {
+	svc := NewService(&ServiceConfig{Backend: &DummyBackend{}})
+	r := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"start": "-4h", "summary": true, "format": "csv"}`))
+	w := httptest.NewRecorder()
+	svc.ServeHTTP(w, r)
+	resp := w.Result()
+	assertStatusCode(t, resp, http.StatusBadRequest)
+	assertReadBody(t, resp, []byte("error: failed to parse query: summary is only supported by ndjson format\n"))
+}
+
+// failingBackend returns records followed by an error.
+type failingBackend struct {
+	records []*Record
+	err     error
+}
+
+func (backend *failingBackend) Query(ctx context.Context, query *Query) (Results, error) {
+	return &failingResults{recordResults: recordResults{records: backend.records}, err: backend.err}, nil
+}
+
+type failingResults struct {
+	recordResults
+	err error
+}
+
+func (r *failingResults) Err() error {
+	return r.err
+}
+
+func TestRecordJSON(t *testing.T) {
+	ts := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	testcases := map[string]struct {
+		rec  *Record
+		want string
+	}{
+		"Long":      {&Record{Timestamp: ts, Name: "env.temperature", Value: 20.5, Meta: map[string]string{"vsn": "W001"}}, `{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":20.5,"meta":{"vsn":"W001"}}`},
+		"NullValue": {&Record{Timestamp: ts, Name: "env.temperature", Aggregation: "mean", Meta: map[string]string{}}, `{"timestamp":"2022-01-01T10:00:00Z","name":"env.temperature","value":null,"aggregation":"mean","meta":{}}`},
+		"EmptyName": {&Record{Timestamp: ts, Value: 1.0, Meta: map[string]string{}}, `{"timestamp":"2022-01-01T10:00:00Z","name":"","value":1,"meta":{}}`},
+		"Pivoted":   {&Record{Timestamp: ts, Values: map[string]interface{}{"env.temperature": 20.5}, Meta: map[string]string{"vsn": "W001"}}, `{"timestamp":"2022-01-01T10:00:00Z","values":{"env.temperature":20.5},"meta":{"vsn":"W001"}}`},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			b, err := json.Marshal(tc.rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.want {
+				t.Fatalf("expected %s. got %s", tc.want, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// splitQueryRanges returns the consecutive sub-ranges to run a query over when
+// its range is longer than span. It returns nil if the query isn't split.
+//
+// Sub-ranges are aligned to multiples of span since the Unix epoch. Only queries
+// whose results are the same when split are split. See isSplittableQuery.
+func splitQueryRanges(query *Query, span time.Duration, now time.Time) [][2]time.Time {
+	if span <= 0 || !isSplittableQuery(query) {
+		return nil
+	}
+
+	start, end, err := resolveQueryRange(query, now)
+	if err != nil || end.Sub(start) <= span {
+		return nil
+	}
+
+	var ranges [][2]time.Time
+	for t := start; t.Before(end); {
+		next := time.Unix(0, (t.UnixNano()/int64(span)+1)*int64(span)).UTC()
+		if next.After(end) {
+			next = end
+		}
+		ranges = append(ranges, [2]time.Time{t, next})
+		t = next
+	}
+	return ranges
+}
+
+// isSplittableQuery reports whether a query gives the same results when run over
+// consecutive sub-ranges. Only paged queries are split, as their results are
+// sorted by time, so the results of each sub-range follow on from the last.
+// Other results are sorted by series, which concatenated sub-ranges would not
+// be.
+//
+// Unpaged queries over long ranges aren't split, so they may still time out.
+// Clients should page through them instead.
+//
+// Aggregations are never split. Even windowed aggregations differ, as empty
+// windows are only returned for the sub-ranges where a series has records.
+// Tail can be applied across sub-ranges, but not to pivots, which change the
+// records it counts. Head can't be used with limit, so it's never split.
+func isSplittableQuery(query *Query) bool {
+	if query.Limit == nil || query.Head != nil || len(query.Func) > 0 {
+		return false
+	}
+	if query.Tail != nil {
+		return query.Pivot == nil
+	}
+	return true
+}
+
+// splitSubqueries returns a copy of query for each sub-range.
+func splitSubqueries(query *Query, ranges [][2]time.Time) []*Query {
+	queries := make([]*Query, len(ranges))
+	for i, r := range ranges {
+		q := *query
+		q.Start = r[0].UTC().Format(time.RFC3339Nano)
+		q.End = r[1].UTC().Format(time.RFC3339Nano)
+		// the cursor is already applied to the start of the range
+		q.Cursor = ""
+		queries[i] = &q
+	}
+	return queries
+}
+
+// splitResults concatenates the results of queries over consecutive sub-ranges.
+// Sub-queries are made in order with up to parallelism queries in flight, so
+// later sub-ranges can be fetched while earlier ones are read.
+//
+// Tail needs the last sub-ranges before it can tell which records to return, so
+// all records are read into memory first.
+type splitResults struct {
+	ctx         context.Context
+	cancel      context.CancelFunc
+	query       func(context.Context, *Query) (Results, error)
+	queries     []*Query
+	parallelism int
+	tail        *int
+
+	pending []chan splitResult
+	current Results
+	record  *Record
+	err     error
+
+	// buffered holds the records to return for tail queries
+	buffered []*Record
+	drained  bool
+}
+
+type splitResult struct {
+	results Results
+	err     error
+}
+
+// newSplitResults starts querying the sub-ranges of a query. It returns an error
+// if the first sub-query fails.
+func newSplitResults(ctx context.Context, query *Query, ranges [][2]time.Time, parallelism int, fn func(context.Context, *Query) (Results, error)) (*splitResults, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &splitResults{
+		ctx:         ctx,
+		cancel:      cancel,
+		query:       fn,
+		queries:     splitSubqueries(query, ranges),
+		parallelism: parallelism,
+		tail:        query.Tail,
+	}
+	if !r.nextResults() {
+		r.Close()
+		return nil, r.err
+	}
+	return r, nil
+}
+
+// start starts sub-queries until parallelism are in flight.
+func (r *splitResults) start() {
+	for len(r.pending) < r.parallelism && len(r.queries) > 0 {
+		q := r.queries[0]
+		r.queries = r.queries[1:]
+		ch := make(chan splitResult, 1)
+		r.pending = append(r.pending, ch)
+		go func() {
+			results, err := r.query(r.ctx, q)
+			ch <- splitResult{results, err}
+		}()
+	}
+}
+
+// nextResults waits for the next sub-query to start. It returns false once
+// every sub-query has been read or if one failed.
+func (r *splitResults) nextResults() bool {
+	r.start()
+	if len(r.pending) == 0 {
+		return false
+	}
+	result := <-r.pending[0]
+	r.pending = r.pending[1:]
+	if result.err != nil {
+		r.err = result.err
+		return false
+	}
+	r.current = result.results
+	r.start()
+	return true
+}
+
+func (r *splitResults) Err() error {
+	return r.err
+}
+
+func (r *splitResults) Close() error {
+	r.cancel()
+	var err error
+	if r.current != nil {
+		err = r.current.Close()
+	}
+	// close sub-queries which already started in the background
+	for _, ch := range r.pending {
+		go func(ch chan splitResult) {
+			if result := <-ch; result.err == nil {
+				result.results.Close()
+			}
+		}(ch)
+	}
+	r.pending = nil
+	return err
+}
+
+func (r *splitResults) Record() *Record {
+	return r.record
+}
+
+func (r *splitResults) Next() bool {
+	if r.tail != nil {
+		return r.nextBuffered()
+	}
+	return r.nextRecord()
+}
+
+func (r *splitResults) nextRecord() bool {
+	for r.err == nil {
+		if r.current == nil && !r.nextResults() {
+			return false
+		}
+		if !r.current.Next() {
+			r.err = r.current.Err()
+			r.current.Close()
+			r.current = nil
+			continue
+		}
+		r.record = r.current.Record()
+		return true
+	}
+	return false
+}
+
+// nextBuffered reads every record and keeps the last tail records of each
+// series, which are returned by time like a single paged query.
+func (r *splitResults) nextBuffered() bool {
+	if !r.drained {
+		r.drained = true
+		series := make(map[string][]*Record)
+		for r.nextRecord() {
+			k := seriesKey(r.record)
+			series[k] = append(series[k], r.record)
+			if len(series[k]) > *r.tail {
+				series[k] = series[k][1:]
+			}
+		}
+		if r.err != nil {
+			return false
+		}
+		for _, k := range sortedKeys(series) {
+			r.buffered = append(r.buffered, series[k]...)
+		}
+		sortRecordsByTime(r.buffered)
+	}
+	if len(r.buffered) == 0 {
+		return false
+	}
+	r.record = r.buffered[0]
+	r.buffered = r.buffered[1:]
+	return true
+}
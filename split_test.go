@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSplitQueryRanges(t *testing.T) {
+	now := time.Date(2022, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	testcases := map[string]struct {
+		Query  *Query
+		Span   time.Duration
+		Expect []string
+	}{
+		"Short":    {Query: &Query{Start: "-12h", Limit: intptr(100)}, Span: 24 * time.Hour},
+		"Disabled": {Query: &Query{Start: "-3d", Limit: intptr(100)}},
+		"Aligned": {
+			Query:  &Query{Start: "2022-01-01T12:00:00Z", End: "2022-01-03T06:00:00Z", Limit: intptr(100)},
+			Span:   24 * time.Hour,
+			Expect: []string{"2022-01-01T12:00:00Z", "2022-01-02T00:00:00Z", "2022-01-03T00:00:00Z", "2022-01-03T06:00:00Z"},
+		},
+		"Relative": {
+			Query:  &Query{Start: "-36h", Limit: intptr(100)},
+			Span:   24 * time.Hour,
+			Expect: []string{"2022-01-08T12:00:00Z", "2022-01-09T00:00:00Z", "2022-01-10T00:00:00Z"},
+		},
+		// results sorted by series would be reordered
+		"Unpaged":     {Query: &Query{Start: "-3d"}, Span: 24 * time.Hour},
+		"Aggregation": {Query: &Query{Start: "-3d", Func: StringList{"mean"}}, Span: 24 * time.Hour},
+		// empty windows would be missing from sub-ranges without records
+		"Window":    {Query: &Query{Start: "-3d", Func: StringList{"mean"}, Window: strptr("1h"), Limit: intptr(100)}, Span: 24 * time.Hour},
+		"PivotTail": {Query: &Query{Start: "-3d", Pivot: &Pivot{By: []string{"vsn"}}, Tail: intptr(1), Limit: intptr(100)}, Span: 24 * time.Hour},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			ranges := splitQueryRanges(tc.Query, tc.Span, now)
+			if tc.Expect == nil {
+				if ranges != nil {
+					t.Fatalf("expected query not to be split. got %v", ranges)
+				}
+				return
+			}
+			var got []string
+			for _, r := range ranges {
+				got = append(got, r[0].UTC().Format(time.RFC3339))
+			}
+			got = append(got, ranges[len(ranges)-1][1].UTC().Format(time.RFC3339))
+			if len(got) != len(tc.Expect) {
+				t.Fatalf("expected bounds %v. got %v", tc.Expect, got)
+			}
+			for i := range got {
+				if got[i] != tc.Expect[i] {
+					t.Fatalf("expected bounds %v. got %v", tc.Expect, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSplitResults(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	backend := NewMemoryBackend(conformanceRecords)
+	backend.Now = func() time.Time { return now }
+
+	testcases := map[string]*Query{
+		"Limit":  {Start: "2022-01-01T09:00:00Z", End: "2022-01-01T11:00:00Z", Limit: intptr(100)},
+		"Filter": {Start: "2022-01-01T09:00:00Z", End: "2022-01-01T11:00:00Z", Filter: map[string]string{"name": "env.temperature"}, Limit: intptr(100)},
+		"Tail":   {Start: "2022-01-01T09:00:00Z", End: "2022-01-01T11:00:00Z", Tail: intptr(2), Limit: intptr(100)},
+		"Pivot":  {Start: "2022-01-01T09:00:00Z", End: "2022-01-01T11:00:00Z", Pivot: &Pivot{By: []string{"vsn"}}, Limit: intptr(100)},
+	}
+
+	for name, query := range testcases {
+		for _, parallelism := range []int{1, 3} {
+			t.Run(name, func(t *testing.T) {
+				ranges := splitQueryRanges(query, 20*time.Minute, now)
+				if len(ranges) < 2 {
+					t.Fatalf("expected query to be split")
+				}
+				results, err := newSplitResults(context.Background(), query, ranges, parallelism, backend.Query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				split := readAllRecords(t, results)
+				whole := readAllRecords(t, mustQuery(t, backend, query))
+
+				if len(split) != len(whole) {
+					t.Fatalf("expected %d records. got %d", len(whole), len(split))
+				}
+				for i := range whole {
+					if seriesKey(split[i]) != seriesKey(whole[i]) || !split[i].Timestamp.Equal(whole[i].Timestamp) || split[i].Value != whole[i].Value {
+						t.Fatalf("record %d: expected %v. got %v", i, whole[i], split[i])
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSplitResultsError(t *testing.T) {
+	query := &Query{Start: "2022-01-01T00:00:00Z", End: "2022-01-03T00:00:00Z", Limit: intptr(100)}
+	ranges := splitQueryRanges(query, 24*time.Hour, time.Now())
+
+	_, err := newSplitResults(context.Background(), query, ranges, 1, func(ctx context.Context, q *Query) (Results, error) {
+		return nil, context.DeadlineExceeded
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected error from first sub-query. got %v", err)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 	"time"
 
@@ -23,28 +22,20 @@ var (
 	})
 )
 
+// extractFilterTopicsFromName returns the topics to subscribe to for the name
+// filter and deletes it from filter. As before filters were parsed, plain name
+// filters are topic patterns, where * matches a single dot separated word and #
+// matches any number of words. Negated, existence and regular expression
+// filters on name can't be expressed as topics, so they are kept in filter and
+// matched instead.
 func extractFilterTopicsFromName(filter map[string]string) []string {
-	if name, ok := filter["name"]; ok {
+	if name, ok := filter["name"]; ok && !strings.HasPrefix(name, "!") && !isRegexFilter(name) && name != "*" {
 		delete(filter, "name")
 		return strings.Split(name, "|")
 	}
 	return []string{"#"}
 }
 
-func buildMatchers(filter map[string]string) (map[string]*regexp.Regexp, error) {
-	matchers := map[string]*regexp.Regexp{}
-
-	for k, v := range filter {
-		re, err := regexp.Compile(v)
-		if err != nil {
-			return nil, err
-		}
-		matchers[k] = re
-	}
-
-	return matchers, nil
-}
-
 type Message struct {
 	Name      string            `json:"name"`
 	Timestamp time.Time         `json:"timestamp"`
@@ -71,13 +62,76 @@ func unmarshalMessage(b []byte, msg *Message) error {
 	return nil
 }
 
-func matchMessage(matchers map[string]*regexp.Regexp, msg *Message) bool {
-	for key, matcher := range matchers {
-		if !matcher.MatchString(msg.Meta[key]) {
-			return false
+func matchMessage(matcher *queryMatcher, msg *Message) bool {
+	return matcher.match(msg.Name, msg.Meta, msg.Value)
+}
+
+// streamFilterValue converts a stream filter value to query filter syntax. Stream
+// filters have always been regular expressions matching anywhere in the value,
+// so plain values are kept that way, rather than matched as equality or glob
+// filters like query filters. Negated, existence and re: filters are supported
+// as in query filters, so !pattern excludes values matching pattern.
+func streamFilterValue(v string) string {
+	pattern, negate := strings.CutPrefix(v, "!")
+	if pattern == "*" || strings.HasPrefix(pattern, filterRegexPrefix) {
+		return v
+	}
+	if negate {
+		return "!" + filterRegexPrefix + pattern
+	}
+	return filterRegexPrefix + pattern
+}
+
+// parseStreamQuery parses the filters of a stream request from its URL
+// parameters. It returns the query to match messages against and the topics to
+// subscribe to.
+func parseStreamQuery(values url.Values) (*Query, []string, error) {
+	filter := getFilterForQueryValues(values)
+
+	query := &Query{Filter: filter}
+
+	// extract value filter. deletes value_filter field afterwards.
+	if s, ok := filter["value_filter"]; ok {
+		delete(filter, "value_filter")
+		query.ValueFilter = s
+	}
+
+	// extract filter expression. deletes filter_expr field afterwards.
+	if s, ok := filter["filter_expr"]; ok {
+		delete(filter, "filter_expr")
+		if err := json.Unmarshal([]byte(s), &query.FilterExpr); err != nil {
+			return nil, nil, err
 		}
 	}
-	return true
+
+	// special case: vsn is always uppercase
+	if s, ok := filter["vsn"]; ok && !isRegexFilter(s) {
+		filter["vsn"] = strings.ToUpper(s)
+	}
+
+	// special case: node is always lowercase
+	if s, ok := filter["node"]; ok && !isRegexFilter(s) {
+		filter["node"] = strings.ToLower(s)
+	}
+
+	// extract topics from name filter. deletes name field afterwards.
+	topics := extractFilterTopicsFromName(filter)
+
+	for k, v := range filter {
+		filter[k] = streamFilterValue(v)
+	}
+
+	// check the filters up front
+	if _, err := newQueryMatcher(query); err != nil {
+		return nil, nil, err
+	}
+	return query, topics, nil
+}
+
+// isRegexFilter reports whether a filter value is a regular expression, which
+// must not have its case changed.
+func isRegexFilter(s string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(s, "!"), filterRegexPrefix)
 }
 
 func getFilterForQueryValues(values url.Values) map[string]string {
@@ -108,23 +162,15 @@ func (svc *StreamService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer streamConnectionsTotal.Add(-1)
 
 	// TODO need to bound URL size here
-	filter := getFilterForQueryValues(r.URL.Query())
-
-	// special case: vsn is always uppercase
-	if s, ok := filter["vsn"]; ok {
-		filter["vsn"] = strings.ToUpper(s)
-	}
-
-	// special case: node is always lowercase
-	if s, ok := filter["node"]; ok {
-		filter["node"] = strings.ToLower(s)
+	query, topics, err := parseStreamQuery(r.URL.Query())
+	if err != nil {
+		log.Printf("invalid request filter: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
 
-	// extract topics from name filter. deletes name field afterwards.
-	topics := extractFilterTopicsFromName(filter)
-
 	// create matcher
-	matchers, err := buildMatchers(filter)
+	matcher, err := newQueryMatcher(query)
 	if err != nil {
 		log.Printf("invalid request filter: %s", err)
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -192,7 +238,7 @@ func (svc *StreamService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				continue
 			}
 
-			if !matchMessage(matchers, &msg) {
+			if !matchMessage(matcher, &msg) {
 				continue
 			}
 
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -10,6 +12,47 @@ type Backend interface {
 	Query(context.Context, *Query) (Results, error)
 }
 
+// MetadataBackend defines an optional interface for backends which can list the
+// distinct names, meta keys and meta values of the records matching a query.
+type MetadataBackend interface {
+	Names(context.Context, *Query) ([]string, error)
+	MetaKeys(context.Context, *Query) ([]string, error)
+	MetaValues(ctx context.Context, query *Query, key string) ([]string, error)
+}
+
+// LatestBackend defines an optional interface for backends which can find the
+// most recent record of each series matching a query.
+type LatestBackend interface {
+	Latest(context.Context, *Query) (Results, error)
+}
+
+// CardinalityBackend defines an optional interface for backends which can count
+// the series matching a query. It is used to estimate query costs.
+type CardinalityBackend interface {
+	Cardinality(context.Context, *Query) (int, error)
+}
+
+// ExplainBackend defines an optional interface for backends which can describe
+// the queries they would make for a query without running them.
+type ExplainBackend interface {
+	Explain(context.Context, *Query) (*QueryPlan, error)
+}
+
+// QueryPlan describes the backend queries made for a query.
+type QueryPlan struct {
+	// Queries lists the backend queries. Queries over the same range are made
+	// concurrently and merged. Queries over different ranges are returned in order.
+	Queries []*PlannedQuery `json:"queries"`
+}
+
+// PlannedQuery describes a single backend query.
+type PlannedQuery struct {
+	Bucket string `json:"bucket"`
+	Start  string `json:"start"`
+	End    string `json:"end,omitempty"`
+	Flux   string `json:"flux"`
+}
+
 // Results defines an interface for query result sets.
 type Results interface {
 	Err() error
@@ -25,15 +68,154 @@ type Query struct {
 	End    string            `json:"end,omitempty"`
 	Head   *int              `json:"head,omitempty"`
 	Tail   *int              `json:"tail,omitempty"`
-	Func   *string           `json:"experimental_func,omitempty"`
+	Func   StringList        `json:"experimental_func,omitempty"`
 	Window *string           `json:"experimental_window,omitempty"`
 	Filter map[string]string `json:"filter"`
+	Format string            `json:"format,omitempty"`
+	Pivot  *Pivot            `json:"pivot,omitempty"`
+	Limit  *int              `json:"limit,omitempty"`
+	Cursor string            `json:"cursor,omitempty"`
+	// Buckets lists buckets to query instead of a single bucket. Results from
+	// each bucket are merged by timestamp.
+	Buckets []string `json:"buckets,omitempty"`
+	// GroupBy lists the meta keys to aggregate over. Records are aggregated per
+	// series when nil and across all series when empty.
+	GroupBy []string `json:"group_by"`
+	// ValueFilter matches record values. See valueFilter for the syntax.
+	ValueFilter string `json:"value_filter,omitempty"`
+	// FilterExpr is a boolean filter expression which must match in addition to Filter.
+	FilterExpr *FilterExpr `json:"filter_expr,omitempty"`
+	// Summary adds a final summary line to NDJSON output.
+	Summary bool `json:"summary,omitempty"`
+	// AllowExpensive runs a query whose estimated cost exceeds the service's cost limit.
+	AllowExpensive bool `json:"allow_expensive,omitempty"`
+}
+
+// Pivot holds the options for a pivoted query. Records with the same timestamp
+// and values for the By meta keys are combined into a single wide record with
+// one value per measurement name.
+type Pivot struct {
+	By []string `json:"by"`
+}
+
+// StringList holds a list of strings which may also be given as a single string in JSON.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = StringList{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("expected string or list of strings")
+	}
+	*l = list
+	return nil
+}
+
+func (l StringList) MarshalJSON() ([]byte, error) {
+	if len(l) == 1 {
+		return json.Marshal(l[0])
+	}
+	return json.Marshal([]string(l))
 }
 
-// Record holds an SDR API record.
+// FilterExpr holds a boolean filter expression. In JSON, it is either an object
+// with a single and, or or not key or a filter which matches when all of its
+// entries match, using the same syntax as Query.Filter. For example:
+//
+//	{"or": [{"vsn": "W01B"}, {"not": {"plugin": "iio*"}}]}
+type FilterExpr struct {
+	And   []*FilterExpr
+	Or    []*FilterExpr
+	Not   *FilterExpr
+	Match map[string]string
+}
+
+func (e *FilterExpr) UnmarshalJSON(b []byte) error {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil || obj == nil {
+		return fmt.Errorf("filter expression must be an object")
+	}
+
+	if len(obj) == 1 {
+		if v, ok := obj["and"]; ok {
+			if err := json.Unmarshal(v, &e.And); err != nil {
+				return err
+			}
+			if e.And == nil {
+				return fmt.Errorf("and must be a list of filter expressions")
+			}
+			return nil
+		}
+		if v, ok := obj["or"]; ok {
+			if err := json.Unmarshal(v, &e.Or); err != nil {
+				return err
+			}
+			if e.Or == nil {
+				return fmt.Errorf("or must be a list of filter expressions")
+			}
+			return nil
+		}
+		if v, ok := obj["not"]; ok {
+			e.Not = &FilterExpr{}
+			return json.Unmarshal(v, e.Not)
+		}
+	}
+
+	e.Match = make(map[string]string)
+	for k, v := range obj {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return fmt.Errorf("filter expression value for %q must be a string", k)
+		}
+		e.Match[k] = s
+	}
+	return nil
+}
+
+func (e *FilterExpr) MarshalJSON() ([]byte, error) {
+	switch {
+	case e.And != nil:
+		return json.Marshal(map[string][]*FilterExpr{"and": e.And})
+	case e.Or != nil:
+		return json.Marshal(map[string][]*FilterExpr{"or": e.Or})
+	case e.Not != nil:
+		return json.Marshal(map[string]*FilterExpr{"not": e.Not})
+	}
+	if e.Match == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(e.Match)
+}
+
+// Record holds an SDR API record. Pivoted records have no name or value and
+// instead hold a value per measurement name in Values. Aggregated records hold
+// the name of the aggregation function which produced them.
 type Record struct {
-	Timestamp time.Time         `json:"timestamp"`
-	Name      string            `json:"name"`
-	Value     interface{}       `json:"value"`
-	Meta      map[string]string `json:"meta"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Name        string                 `json:"name"`
+	Value       interface{}            `json:"value"`
+	Values      map[string]interface{} `json:"values,omitempty"`
+	Aggregation string                 `json:"aggregation,omitempty"`
+	Meta        map[string]string      `json:"meta"`
 }
+
+// MarshalJSON always includes the name and value of records, even when they're
+// empty, except for pivoted records, which have neither.
+func (rec Record) MarshalJSON() ([]byte, error) {
+	if rec.Values != nil {
+		return json.Marshal(struct {
+			Timestamp   time.Time              `json:"timestamp"`
+			Values      map[string]interface{} `json:"values"`
+			Aggregation string                 `json:"aggregation,omitempty"`
+			Meta        map[string]string      `json:"meta"`
+		}{rec.Timestamp, rec.Values, rec.Aggregation, rec.Meta})
+	}
+	return json.Marshal(JSONRecord(rec))
+}
+
+// JSONRecord is a Record encoded using its struct tags alone.
+type JSONRecord Record
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// valueFilter matches record values. It is parsed from the value_filter field of
+// a query, which is one of:
+//
+//	>X, >=X, <X, <=X  numeric comparison
+//	==X, !=X          numeric comparison if X is a number, otherwise string comparison
+//	X..Y              numeric range X <= value <= Y
+//	=~RE, !~RE        string regular expression match
+//
+// Numeric filters only match numeric values and string filters only match string values.
+type valueFilter struct {
+	op      string
+	numeric bool
+	num     float64
+	// max is the upper bound of a range.
+	max float64
+	str string
+	re  *regexp.Regexp
+}
+
+// valueFilterOps lists the prefix operators. Longer operators must come first.
+var valueFilterOps = []string{">=", "<=", "==", "!=", "=~", "!~", ">", "<"}
+
+func parseValueFilter(s string) (*valueFilter, error) {
+	for _, op := range valueFilterOps {
+		if !strings.HasPrefix(s, op) {
+			continue
+		}
+		operand := strings.TrimSpace(strings.TrimPrefix(s, op))
+		f := &valueFilter{op: op}
+
+		switch op {
+		case "=~", "!~":
+			re, err := regexp.Compile(operand)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value_filter %q: %s", s, err.Error())
+			}
+			f.str = operand
+			f.re = re
+		case "==", "!=":
+			if x, err := strconv.ParseFloat(operand, 64); err == nil {
+				if !isFinite(x) {
+					return nil, fmt.Errorf("invalid value_filter %q: %q is not a finite number", s, operand)
+				}
+				f.numeric = true
+				f.num = x
+			} else {
+				f.str = operand
+			}
+		default:
+			x, err := strconv.ParseFloat(operand, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value_filter %q: %q is not a number", s, operand)
+			}
+			if !isFinite(x) {
+				return nil, fmt.Errorf("invalid value_filter %q: %q is not a finite number", s, operand)
+			}
+			f.numeric = true
+			f.num = x
+		}
+		return f, nil
+	}
+
+	if a, b, ok := strings.Cut(s, ".."); ok {
+		lo, err1 := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		hi, err2 := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid value_filter %q: range bounds must be numbers", s)
+		}
+		if !isFinite(lo) || !isFinite(hi) {
+			return nil, fmt.Errorf("invalid value_filter %q: range bounds must be finite numbers", s)
+		}
+		if lo > hi {
+			return nil, fmt.Errorf("invalid value_filter %q: range is empty", s)
+		}
+		return &valueFilter{op: "..", numeric: true, num: lo, max: hi}, nil
+	}
+
+	return nil, fmt.Errorf("invalid value_filter %q", s)
+}
+
+// isFinite reports whether x is neither NaN nor infinite. Flux has no literals
+// for them, so they can't be used in filters.
+func isFinite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
+// match reports whether a record value matches the filter.
+func (f *valueFilter) match(v interface{}) bool {
+	if !f.numeric {
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		switch f.op {
+		case "==":
+			return s == f.str
+		case "!=":
+			return s != f.str
+		case "=~":
+			return f.re.MatchString(s)
+		case "!~":
+			return !f.re.MatchString(s)
+		}
+		return false
+	}
+
+	x, ok := toFloat64(v)
+	if !ok {
+		return false
+	}
+	switch f.op {
+	case ">":
+		return x > f.num
+	case ">=":
+		return x >= f.num
+	case "<":
+		return x < f.num
+	case "<=":
+		return x <= f.num
+	case "==":
+		return x == f.num
+	case "!=":
+		return x != f.num
+	case "..":
+		return f.num <= x && x <= f.max
+	}
+	return false
+}
+
+// fluxPredicate builds the body of a Flux filter predicate equivalent to match.
+// It uses the types package, which must be imported by the query. Values are
+// converted before comparing, as the type of _value differs between series.
+func (f *valueFilter) fluxPredicate() string {
+	if !f.numeric {
+		isString := `types.isType(v: r._value, type: "string")`
+		switch f.op {
+		case "=~", "!~":
+			return fmt.Sprintf("%s and string(v: r._value) %s /%s/", isString, f.op, escapeFluxRegex(f.str))
+		default:
+			return fmt.Sprintf("%s and string(v: r._value) %s %s", isString, f.op, quoteFluxString(f.str))
+		}
+	}
+
+	isNumeric := `types.isNumeric(v: r._value)`
+	if f.op == ".." {
+		return fmt.Sprintf("%s and float(v: r._value) >= %s and float(v: r._value) <= %s", isNumeric, formatFluxFloat(f.num), formatFluxFloat(f.max))
+	}
+	return fmt.Sprintf("%s and float(v: r._value) %s %s", isNumeric, f.op, formatFluxFloat(f.num))
+}
+
+// formatFluxFloat formats x as a Flux float literal, which requires a decimal point.
+func formatFluxFloat(x float64) string {
+	s := strconv.FormatFloat(x, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+var fluxStringReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"${", `\${`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+)
+
+// quoteFluxString quotes s as a Flux string literal.
+func quoteFluxString(s string) string {
+	return `"` + fluxStringReplacer.Replace(s) + `"`
+}
+
+// escapeFluxRegex escapes unescaped forward slashes and newlines in a regular
+// expression, so it can be used in a Flux /.../ regular expression literal.
+func escapeFluxRegex(re string) string {
+	var b strings.Builder
+	escaped := false
+	for _, c := range re {
+		switch {
+		case c == '\n':
+			b.WriteString(`\n`)
+			escaped = false
+			continue
+		case c == '/' && !escaped:
+			b.WriteByte('\\')
+		}
+		escaped = c == '\\' && !escaped
+		b.WriteRune(c)
+	}
+	return b.String()
+}
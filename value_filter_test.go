@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestValueFilterMatch(t *testing.T) {
+	testcases := map[string]struct {
+		Filter string
+		Match  []interface{}
+		Reject []interface{}
+	}{
+		"Greater":        {">40", []interface{}{40.5, 41, int64(100)}, []interface{}{40.0, 12, "50", true}},
+		"GreaterEqual":   {">=40", []interface{}{40.0, 41}, []interface{}{39.9}},
+		"Less":           {"<-1.5", []interface{}{-2.0}, []interface{}{-1.5, 0}},
+		"LessEqual":      {"<= 3", []interface{}{3, 2.5}, []interface{}{3.1}},
+		"EqualNumber":    {"==3", []interface{}{3, 3.0}, []interface{}{"3", 4}},
+		"NotEqualNumber": {"!=3", []interface{}{4, 2.5}, []interface{}{3, "4"}},
+		"EqualString":    {"==ok", []interface{}{"ok"}, []interface{}{"OK", 1}},
+		"NotEqualString": {"!=ok", []interface{}{"bad"}, []interface{}{"ok", 1}},
+		"Between":        {"10..20", []interface{}{10, 15.5, 20}, []interface{}{9.9, 20.1, "15"}},
+		"NegativeRange":  {"-5..-1", []interface{}{-3}, []interface{}{0}},
+		"Regex":          {"=~^img/.*\\.jpg$", []interface{}{"img/a.jpg"}, []interface{}{"img/a.png", 1}},
+		"NotRegex":       {"!~error", []interface{}{"ok"}, []interface{}{"some error", 1}},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			f, err := parseValueFilter(tc.Filter)
+			if err != nil {
+				t.Fatalf("parse error: %s", err)
+			}
+			for _, v := range tc.Match {
+				if !f.match(v) {
+					t.Errorf("expected %#v to match", v)
+				}
+			}
+			for _, v := range tc.Reject {
+				if f.match(v) {
+					t.Errorf("expected %#v not to match", v)
+				}
+			}
+		})
+	}
+}
+
+func TestValueFilterInvalid(t *testing.T) {
+	for _, s := range []string{"", "40", ">abc", "20..10", "a..b", "=~(", ">NaN", "<=-Inf", "==NaN", "!=+Inf", "0..Inf", "NaN..1"} {
+		if _, err := parseValueFilter(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
+
+func TestValueFilterFlux(t *testing.T) {
+	testcases := map[string]struct {
+		Filter string
+		Expect string
+	}{
+		"Greater":     {">40", `types.isNumeric(v: r._value) and float(v: r._value) > 40.0`},
+		"Between":     {"0.5..1e3", `types.isNumeric(v: r._value) and float(v: r._value) >= 0.5 and float(v: r._value) <= 1000.0`},
+		"EqualString": {`==say "hi"`, `types.isType(v: r._value, type: "string") and string(v: r._value) == "say \"hi\""`},
+		"Regex":       {"=~^a/b\\/c", `types.isType(v: r._value, type: "string") and string(v: r._value) =~ /^a\/b\/c/`},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			f, err := parseValueFilter(tc.Filter)
+			if err != nil {
+				t.Fatalf("parse error: %s", err)
+			}
+			if s := f.fluxPredicate(); s != tc.Expect {
+				t.Fatalf("flux predicate mismatch\nexpect: %s\noutput: %s", tc.Expect, s)
+			}
+		})
+	}
+}